@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gecko/internal/service"
+	"gecko/internal/shared"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runCommand(args []string) {
+	if signsCertificates(args) {
+		if err := service.UnlockRootCAKey(); err != nil {
+			fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
+	}
+	switch args[0] {
+	case "vhost":
+		runVHostCommand(args[1:])
+	case "hosts":
+		runHostsCommand(args[1:])
+	case "dns":
+		runDNSCommand(args[1:])
+	case "proxy":
+		runProxyCommand(args[1:])
+	case "access":
+		runAccessCommand(args[1:])
+	case "env":
+		runEnvCommand(args[1:])
+	case "logs":
+		runLogsCommand(args[1:])
+	case "mail":
+		runMailCommand(args[1:])
+	case "procs":
+		runProcsCommand(args[1:])
+	case "certs":
+		runCertsCommand(args[1:])
+	case "ca":
+		runCACommand(args[1:])
+	case "db":
+		runDBCommand(args[1:])
+	case "acme":
+		runACMECommand(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+	default:
+		fmt.Printf("%sUnknown command '%s'.%s\n", shared.ColorRed, args[0], shared.ColorReset)
+		printUsage()
+	}
+}
+
+// signsCertificates reports whether a command may issue certificates, so a
+// passphrase-protected Root CA key is unlocked before it runs.
+func signsCertificates(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	switch args[0] + " " + args[1] {
+	case "vhost import", "vhost alias", "certs renew", "certs client", "proxy serve", "acme serve":
+		return true
+	}
+	// Requiring client certificates may sign the first CRL.
+	return args[0] == "access" && len(args) > 2 && args[2] == "clientcert"
+}
+
+func printUsage() {
+	fmt.Println("Usage: gecko [command]")
+	fmt.Println()
+	fmt.Println("Run without a command to open the interactive menu.")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  vhost export <domain> [archive.zip]   Pack a site, its config and database into an archive")
+	fmt.Println("  vhost import <archive.zip>            Recreate a site from an exported archive")
+	fmt.Println("  vhost enable <domain>                 Put a disabled site back online")
+	fmt.Println("  vhost disable <domain>                Take a site offline, keeping its files and certs")
+	fmt.Println("  vhost upstream <domain> <target>      Route a site via the front proxy to webserver, fastcgi or a URL")
+	fmt.Println("  vhost alias <domain> [add|remove <name>]  List or change a site's extra names (*.name allowed)")
+	fmt.Println("  access <domain> show                  Show who may reach a site")
+	fmt.Println("  access <domain> user add <name> [pw]  Require basic auth; a password is generated if omitted")
+	fmt.Println("  access <domain> user remove <name>")
+	fmt.Println("  access <domain> allow|disallow <cidr> Let a network (or single IP) reach the site")
+	fmt.Println("  access <domain> clientcert on|off     Require a client certificate from the Gecko CA over HTTPS")
+	fmt.Println("  env list <domain>                     Show the variables a site's PHP code receives")
+	fmt.Println("  env set <domain> KEY=VALUE...         Set variables, rendered as SetEnv/fastcgi_param")
+	fmt.Println("  env unset <domain> KEY...")
+	fmt.Println("  env sync <domain> [file|off]          Keep a project .env file (default: docroot/.env) in step")
+	fmt.Println("  db create <name> [--engine mysql|postgres] [--vhost <domain>]")
+	fmt.Println("                                        Create a database and its own user; link it to a site")
+	fmt.Println("  db list                               Show databases and the sites using them")
+	fmt.Println("  db drop <name> [--engine mysql|postgres]  Drop a database and its user")
+	fmt.Println("  logs stats <domain> [--window 1h]     Summarise a site's access log (15m, 6h, 7d or all)")
+	fmt.Println("  mail list                             List messages caught by the mail catcher")
+	fmt.Println("  mail show <id> [--html|--raw]         Show a message's headers and body")
+	fmt.Println("  mail attachment <id> <n> [dir]        Save attachment n of a message")
+	fmt.Println("  mail delete <id> | mail clear")
+	fmt.Println("  mail serve                            Run the mail catcher in the foreground")
+	fmt.Println("  procs list [domain]                   Show the processes declared for sites")
+	fmt.Println("  procs add <domain> <name> [--dir d] <command...>")
+	fmt.Println("                                        Run a worker with the site, e.g. php artisan queue:work")
+	fmt.Println("  procs remove <domain> <name>")
+	fmt.Println("  procs serve                           Supervise site processes in the foreground")
+	fmt.Println("  certs list                            Show every certificate with its names, issuer and expiry")
+	fmt.Println("  certs renew [domain...] [--all]       Re-issue expiring (or the named) certificates and reload")
+	fmt.Println("  certs trust [--store a,b]             Install the Root CA in the Windows, WSL, Firefox and Java stores")
+	fmt.Println("  certs untrust [--store a,b]           Remove the Root CA from those stores again")
+	fmt.Println("  certs client issue <name> [password]  Issue a client certificate as PEM files and a .p12 bundle")
+	fmt.Println("  certs client list                     Show issued client certificates")
+	fmt.Println("  certs client revoke <name|serial>     Revoke a client certificate and update the CRL")
+	fmt.Println("  ca rotate                             Replace the Root CA, re-issue every certificate and update trust stores")
+	fmt.Println("  ca protect none|dpapi|passphrase      Store the Root CA key plain, encrypted for this Windows user, or with a passphrase")
+	fmt.Println("  certs share [--port 8020]             Serve the Root CA to phones on the LAN, with a QR code (dev mode)")
+	fmt.Println("  hosts add|remove <host> [--dry-run]   Map a hostname to loopback in the hosts file")
+	fmt.Println("  hosts enable|disable <host> [--dry-run]")
+	fmt.Println("  dns serve                             Run the local DNS resolver in the foreground")
+	fmt.Println("  proxy serve                           Run the HTTPS front proxy in the foreground")
+	fmt.Println("  acme serve                            Run the local ACME server in the foreground")
+}
+
+func runVHostCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	var err error
+	switch args[0] {
+	case "export":
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+		outPath := ""
+		if len(args) > 2 {
+			outPath = args[2]
+		}
+		err = service.ExportVirtualHost(args[1], outPath)
+	case "import":
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+		err = service.ImportVirtualHost(args[1], bufio.NewReader(os.Stdin))
+	case "enable", "disable":
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+		if args[0] == "enable" {
+			err = service.EnableVirtualHost(args[1])
+		} else {
+			err = service.DisableVirtualHost(args[1])
+		}
+	case "upstream":
+		if len(args) < 3 {
+			printUsage()
+			return
+		}
+		err = service.SetVHostUpstream(args[1], args[2])
+	case "alias":
+		switch {
+		case len(args) == 2:
+			err = service.ListVHostAliases(args[1])
+		case len(args) == 4 && args[2] == "add":
+			err = service.AddVHostAlias(args[1], args[3])
+		case len(args) == 4 && args[2] == "remove":
+			err = service.RemoveVHostAlias(args[1], args[3])
+		default:
+			printUsage()
+			return
+		}
+	default:
+		fmt.Printf("%sUnknown vhost command '%s'.%s\n", shared.ColorRed, args[0], shared.ColorReset)
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runAccessCommand(args []string) {
+	if len(args) < 2 {
+		printUsage()
+		return
+	}
+	domain := args[0]
+	var err error
+	switch {
+	case args[1] == "show":
+		err = service.ShowVHostAccess(domain)
+	case args[1] == "user" && len(args) >= 4 && args[2] == "add":
+		password := ""
+		if len(args) > 4 {
+			password = args[4]
+		}
+		err = service.AddVHostUser(domain, args[3], password)
+	case args[1] == "user" && len(args) >= 4 && args[2] == "remove":
+		err = service.RemoveVHostUser(domain, args[3])
+	case args[1] == "allow" && len(args) >= 3:
+		err = service.AllowVHostNetwork(domain, args[2])
+	case args[1] == "disallow" && len(args) >= 3:
+		err = service.RemoveVHostNetwork(domain, args[2])
+	case args[1] == "clientcert" && len(args) == 3 && (args[2] == "on" || args[2] == "off"):
+		err = service.SetVHostClientAuth(domain, args[2] == "on")
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runEnvCommand(args []string) {
+	if len(args) < 2 {
+		printUsage()
+		return
+	}
+	var err error
+	switch args[0] {
+	case "list":
+		err = service.ListVHostEnv(args[1])
+	case "set", "unset":
+		if len(args) < 3 {
+			printUsage()
+			return
+		}
+		if args[0] == "set" {
+			err = service.SetVHostEnv(args[1], args[2:])
+		} else {
+			err = service.UnsetVHostEnv(args[1], args[2:])
+		}
+	case "sync":
+		path := ""
+		if len(args) > 2 {
+			path = args[2]
+		}
+		err = service.SyncVHostEnvFile(args[1], path)
+	default:
+		fmt.Printf("%sUnknown env command '%s'.%s\n", shared.ColorRed, args[0], shared.ColorReset)
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runLogsCommand(args []string) {
+	if len(args) < 2 || args[0] != "stats" {
+		printUsage()
+		return
+	}
+	window := "all"
+	for i := 2; i < len(args); i++ {
+		if args[i] == "--window" && i+1 < len(args) {
+			window = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], "--window=") {
+			window = strings.TrimPrefix(args[i], "--window=")
+		}
+	}
+	duration, err := service.ParseLogWindow(window)
+	if err == nil {
+		err = service.ShowAccessLogStats(args[1], duration)
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runMailCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	var err error
+	switch {
+	case args[0] == "list":
+		err = service.ListMail()
+	case args[0] == "show" && len(args) >= 2:
+		html, raw := false, false
+		for _, flag := range args[2:] {
+			html = html || flag == "--html"
+			raw = raw || flag == "--raw"
+		}
+		err = service.ShowMail(args[1], html, raw)
+	case args[0] == "attachment" && len(args) >= 3:
+		n, convErr := strconv.Atoi(args[2])
+		if convErr != nil {
+			fmt.Printf("%sError: '%s' is not an attachment number%s\n", shared.ColorRed, args[2], shared.ColorReset)
+			return
+		}
+		dir := ""
+		if len(args) > 3 {
+			dir = args[3]
+		}
+		err = service.SaveMailAttachment(args[1], n, dir)
+	case args[0] == "delete" && len(args) >= 2:
+		if err = service.DeleteMail(args[1]); err == nil {
+			fmt.Printf("%sMessage %s deleted.%s\n", shared.ColorGreen, args[1], shared.ColorReset)
+		}
+	case args[0] == "clear":
+		var count int
+		if count, err = service.ClearMail(); err == nil {
+			fmt.Printf("%sDeleted %d message(s).%s\n", shared.ColorGreen, count, shared.ColorReset)
+		}
+	case args[0] == "serve":
+		config, cfgErr := service.GetConfig()
+		if cfgErr != nil {
+			err = cfgErr
+			break
+		}
+		if err = service.StartMailCatcher(); err == nil {
+			fmt.Printf("%sMail catcher listening on 127.0.0.1:%s (viewer on 127.0.0.1:%s). Press Ctrl+C to stop.%s\n", shared.ColorGreen, config.MailSMTPPort, config.MailHTTPPort, shared.ColorReset)
+			select {}
+		}
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runProcsCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	var err error
+	switch {
+	case args[0] == "list":
+		domain := ""
+		if len(args) > 1 {
+			domain = args[1]
+		}
+		err = service.ListVHostProcesses(domain)
+	case args[0] == "add" && len(args) >= 4:
+		dir, command := "", args[3:]
+		if command[0] == "--dir" && len(command) >= 3 {
+			dir, command = command[1], command[2:]
+		}
+		err = service.AddVHostProcess(args[1], args[2], strings.Join(command, " "), dir)
+	case args[0] == "remove" && len(args) >= 3:
+		err = service.RemoveVHostProcess(args[1], args[2])
+	case args[0] == "serve":
+		err = service.ServeProcessesUntilInterrupt()
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runCertsCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	var err error
+	switch args[0] {
+	case "list":
+		err = service.ListCertificates()
+	case "renew":
+		all := false
+		var domains []string
+		for _, arg := range args[1:] {
+			if arg == "--all" {
+				all = true
+			} else {
+				domains = append(domains, arg)
+			}
+		}
+		err = service.RenewCertificates(domains, all)
+	case "share":
+		port := ""
+		if len(args) > 2 && args[1] == "--port" {
+			port = args[2]
+		}
+		err = service.ShareRootCAUntilInterrupt(port)
+	case "client":
+		switch {
+		case len(args) >= 3 && args[1] == "issue":
+			password := ""
+			if len(args) > 3 {
+				password = args[3]
+			}
+			err = service.IssueClientCert(args[2], password)
+		case len(args) == 2 && args[1] == "list":
+			err = service.ListClientCerts()
+		case len(args) == 3 && args[1] == "revoke":
+			err = service.RevokeClientCert(args[2])
+		default:
+			printUsage()
+			return
+		}
+	case "trust", "untrust":
+		var only []string
+		for i := 1; i < len(args); i++ {
+			if args[i] == "--store" && i+1 < len(args) {
+				only = append(only, strings.Split(args[i+1], ",")...)
+				i++
+			}
+		}
+		if args[0] == "trust" {
+			err = service.InstallRootCATrust(only)
+		} else {
+			err = service.UninstallRootCATrust(only)
+		}
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runDBCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	engine, domain := "", ""
+	var rest []string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--engine" && i+1 < len(args):
+			engine = args[i+1]
+			i++
+		case args[i] == "--vhost" && i+1 < len(args):
+			domain = args[i+1]
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	var err error
+	switch {
+	case args[0] == "create" && len(rest) == 1:
+		err = service.CreateDatabase(rest[0], engine, domain)
+	case args[0] == "list":
+		err = service.ListDatabases()
+	case args[0] == "drop" && len(rest) == 1:
+		fmt.Printf("%sDrop database '%s' and its user? All its data will be lost. (y/n): %s", shared.ColorRed, rest[0], shared.ColorReset)
+		confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(confirm)) != "y" {
+			fmt.Println("Cancelled.")
+			return
+		}
+		err = service.DropDatabase(rest[0], engine)
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runCACommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	var err error
+	switch {
+	case args[0] == "rotate":
+		err = service.RotateRootCA()
+	case args[0] == "protect" && len(args) == 2:
+		err = service.ProtectRootCAKey(args[1])
+	default:
+		printUsage()
+		return
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runHostsCommand(args []string) {
+	dryRun := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "--dry-run" {
+			dryRun = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) < 2 {
+		printUsage()
+		return
+	}
+	if err := service.UpdateHostsEntry(rest[1], rest[0], dryRun); err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runDNSCommand(args []string) {
+	if len(args) == 0 || args[0] != "serve" {
+		printUsage()
+		return
+	}
+	if err := service.ServeDNSUntilInterrupt(); err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+func runACMECommand(args []string) {
+	if len(args) == 0 || args[0] != "serve" {
+		printUsage()
+		return
+	}
+	config, err := service.GetConfig()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	if err := service.StartACMEServer(); err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	service.PrintACMEUsage(config)
+	fmt.Println("Press Ctrl+C to stop.")
+	select {}
+}
+
+func runProxyCommand(args []string) {
+	if len(args) == 0 || args[0] != "serve" {
+		printUsage()
+		return
+	}
+	config, err := service.GetConfig()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	if !config.FrontProxyEnabled {
+		fmt.Printf("%sThe front proxy is disabled. Enable it from the menu first so the web server moves to its backend ports.%s\n", shared.ColorYellow, shared.ColorReset)
+		return
+	}
+	if err := service.StartFrontProxy(); err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	fmt.Printf("%sFront proxy listening on ports %s/%s. Press Ctrl+C to stop.%s\n", shared.ColorGreen, config.ApachePort, config.ApacheSSLPort, shared.ColorReset)
+	select {}
+}
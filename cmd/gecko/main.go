@@ -9,7 +9,6 @@ import (
 	"gecko/internal/utils"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,7 +18,7 @@ import (
 func main() {
 	utils.CheckAndRequestAdmin()
 
-	_, err := service.LoadConfig()
+	config, err := service.LoadConfig()
 	if err != nil {
 		fmt.Printf("%sFatal Error: Could not load or create configuration file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
 		fmt.Println("Press Enter to exit.")
@@ -27,6 +26,80 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	// The front proxy and renewals sign in the background, so a
+	// passphrase-protected CA key is unlocked up front.
+	if err := service.UnlockRootCAKey(); err != nil {
+		fmt.Printf("%sWarning: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		time.Sleep(2 * time.Second)
+	}
+
+	if config.DNSResolverEnabled {
+		if err := service.StartDNSResolver(); err != nil {
+			fmt.Printf("%sWarning: local DNS resolver could not start: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	if config.FrontProxyEnabled {
+		if err := service.StartFrontProxy(); err != nil {
+			fmt.Printf("%sWarning: front proxy could not start: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	// Sites whose web server is already up get their processes back.
+	if service.IsWebServerRunning() {
+		if err := service.StartProcessSupervisor(); err != nil {
+			fmt.Printf("%sNote: site processes not started here: %v%s\n", shared.ColorYellow, err, shared.ColorReset)
+		}
+	}
+
+	if config.MailCatcherEnabled {
+		if err := service.StartMailCatcher(); err != nil {
+			fmt.Printf("%sWarning: mail catcher could not start: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	if config.ACMEServerEnabled {
+		if err := service.StartACMEServer(); err != nil {
+			fmt.Printf("%sWarning: ACME server could not start: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	if err := service.RefreshClientCRL(false); err != nil {
+		fmt.Printf("%sWarning: could not renew the client certificate CRL: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+
+	if notAfter, expiring := service.RootCAExpiry(); expiring {
+		fmt.Printf("%sWarning: the Gecko Root CA expires on %s. Replace it with \"gecko ca rotate\".%s\n", shared.ColorYellow, notAfter.Local().Format("2006-01-02"), shared.ColorReset)
+		time.Sleep(2 * time.Second)
+	}
+
+	if expiring := service.ExpiringCertificates(); len(expiring) > 0 {
+		fmt.Printf("%sWarning: these certificates have expired or expire within 30 days:%s\n", shared.ColorYellow, shared.ColorReset)
+		for _, owner := range expiring {
+			fmt.Printf("  - %s\n", owner)
+		}
+		fmt.Print(shared.ColorYellow, "Renew them now? (y/n): ", shared.ColorReset)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(answer)) == "y" {
+			if err := service.RenewCertificates(nil, false); err != nil {
+				fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			}
+			time.Sleep(2 * time.Second)
+		} else {
+			fmt.Println("You can renew them later with \"gecko certs renew\".")
+			time.Sleep(2 * time.Second)
+		}
+	}
+
 	mainMenu()
 }
 
@@ -45,13 +118,13 @@ func mainMenu() {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		apacheStatus := service.IsServiceRunning("httpd.exe")
+		webServerStatus := service.IsWebServerRunning()
 		mysqlStatus := service.IsServiceRunning("mysqld.exe")
 		pgStatus := service.IsServiceRunning("postgres.exe")
 		ngrokStatus := service.IsServiceRunning("ngrok.exe")
 		cloudflareStatus := service.IsServiceRunning("cloudflared.exe")
 
-		cli.DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus)
+		cli.DisplayMenu(webServerStatus, mysqlStatus, ngrokStatus, cloudflareStatus)
 
 		fmt.Print(shared.ColorYellow, "\nEnter your choice: ", shared.ColorReset)
 		choice, _ := reader.ReadString('\n')
@@ -60,10 +133,10 @@ func mainMenu() {
 		clearScreen()
 		switch choice {
 		case "1":
-			if apacheStatus {
-				service.StopApache()
+			if webServerStatus {
+				service.StopWebServer()
 			} else {
-				service.StartApache()
+				service.StartWebServer()
 			}
 		case "2":
 			if mysqlStatus {
@@ -86,7 +159,7 @@ func mainMenu() {
 		case "6":
 			handleDeleteVHost(reader)
 		case "7":
-			service.InitializeMySQL()
+			service.InitializeMySQL(reader)
 			fmt.Println("\nPress Enter to continue...")
 			reader.ReadString('\n')
 		case "8":
@@ -131,13 +204,43 @@ func mainMenu() {
 			service.ToggleDevelopmentMode()
 			fmt.Println("\nPress Enter to continue...")
 			reader.ReadString('\n')
+		case "17":
+			handleToggleVHost(reader)
+		case "18":
+			service.ToggleDNSResolver()
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
+		case "19":
+			service.ToggleFrontProxy()
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
+		case "20":
+			handleLogStats(reader)
+		case "21":
+			service.ToggleMailCatcher()
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
+		case "22":
+			service.ShareRootCAUntilEnter(reader)
+		case "23":
+			service.ToggleACMEServer()
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
+		case "24":
+			service.ManageMySQLRootPassword(reader)
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
 		case "x", "X":
 			fmt.Println(shared.ColorYellow, "\nStopping all services...", shared.ColorReset)
-			service.StopApache()
+			service.StopWebServer()
 			service.StopMySQL()
 			service.StopPostgreSQL()
 			service.StopNgrokTunnels()
 			service.StopCloudflareTunnel()
+			service.StopDNSResolver()
+			service.StopFrontProxy()
+			service.StopMailCatcher()
+			service.StopACMEServer()
 			fmt.Println(shared.ColorGreen, "Bye!", shared.ColorReset)
 			return
 		default:
@@ -149,13 +252,32 @@ func mainMenu() {
 
 func handleCreateVHost(reader *bufio.Reader) {
 	fmt.Print(shared.ColorYellow, "Enter the new domain name (e.g., mysite.test): ", shared.ColorReset)
-	domainName, _ := reader.ReadString('\n')
-	domainName = strings.TrimSpace(domainName)
+	input, _ := reader.ReadString('\n')
+
+	domainName, warnings, err := service.NormalizeDomainName(input)
+	if err != nil {
+		fmt.Printf("%sInvalid domain name: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+	if len(warnings) > 0 {
+		for _, warning := range warnings {
+			fmt.Printf("%sWarning: %s%s\n", shared.ColorYellow, warning, shared.ColorReset)
+		}
+		fmt.Print(shared.ColorYellow, "Continue with '", domainName, "' anyway? (y/n): ", shared.ColorReset)
+		confirm, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(confirm)) != "y" {
+			fmt.Println(shared.ColorYellow, "Operation cancelled.", shared.ColorReset)
+			fmt.Println("\nPress Enter to continue...")
+			reader.ReadString('\n')
+			return
+		}
+	}
 
-	vhostConfigFile := filepath.Join(`C:\Gecko\etc\config\httpd\sites-enabled`, domainName+".conf")
 	replaceChoice := ""
 
-	if _, err := os.Stat(vhostConfigFile); err == nil {
+	if service.VirtualHostExists(domainName) {
 		fmt.Printf("%sWarning: VHost for '%s' already exists.%s\n", shared.ColorRed, domainName, shared.ColorReset)
 		fmt.Print(shared.ColorYellow, "Do you want to replace it and format its directory? (y/n): ", shared.ColorReset)
 		replaceChoice, _ = reader.ReadString('\n')
@@ -168,11 +290,28 @@ func handleCreateVHost(reader *bufio.Reader) {
 		}
 	}
 
-	service.CreateVirtualHost(domainName, replaceChoice)
+	if service.CreateVirtualHost(domainName, replaceChoice) {
+		promptCreateDatabase(reader, domainName)
+	}
 	fmt.Println("\nPress Enter to continue...")
 	reader.ReadString('\n')
 }
 
+func promptCreateDatabase(reader *bufio.Reader, domainName string) {
+	if vhost, err := service.GetVHost(domainName); err != nil || vhost.Database != nil {
+		return
+	}
+	fmt.Print(shared.ColorYellow, "Create a database for this site? (mysql/postgres/n): ", shared.ColorReset)
+	engine, _ := reader.ReadString('\n')
+	engine = strings.TrimSpace(strings.ToLower(engine))
+	if engine == "" || engine == "n" || engine == "no" {
+		return
+	}
+	if err := service.CreateDatabase(service.DatabaseNameFor(domainName), engine, domainName); err != nil {
+		fmt.Printf("%sError creating database: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
 func handleDeleteVHost(reader *bufio.Reader) {
 	vhosts, err := service.ListVirtualHosts()
 	if err != nil {
@@ -181,6 +320,8 @@ func handleDeleteVHost(reader *bufio.Reader) {
 		reader.ReadString('\n')
 		return
 	}
+	disabled, _ := service.ListDisabledVirtualHosts()
+	vhosts = append(vhosts, disabled...)
 
 	if len(vhosts) == 0 {
 		fmt.Println(shared.ColorYellow, "No deletable virtual hosts found.", shared.ColorReset)
@@ -226,6 +367,100 @@ func handleDeleteVHost(reader *bufio.Reader) {
 	reader.ReadString('\n')
 }
 
+func handleToggleVHost(reader *bufio.Reader) {
+	enabled, err := service.ListVirtualHosts()
+	if err != nil {
+		fmt.Printf("%sError listing virtual hosts: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+	disabled, _ := service.ListDisabledVirtualHosts()
+	vhosts := append(append([]string{}, enabled...), disabled...)
+
+	if len(vhosts) == 0 {
+		fmt.Println(shared.ColorYellow, "No virtual hosts found.", shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+
+	fmt.Println(shared.ColorGreen, "Select a virtual host to enable or disable:", shared.ColorReset)
+	for i, vhost := range vhosts {
+		if i < len(enabled) {
+			fmt.Printf("%d. %s\n", i+1, vhost)
+		} else {
+			fmt.Printf("%s%d. %s (disabled)%s\n", shared.ColorGray, i+1, vhost, shared.ColorReset)
+		}
+	}
+	fmt.Println("0. Cancel")
+
+	fmt.Print(shared.ColorYellow, "\nEnter your choice: ", shared.ColorReset)
+	choiceStr, _ := reader.ReadString('\n')
+	choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+
+	if err != nil || choice <= 0 || choice > len(vhosts) {
+		fmt.Println(shared.ColorYellow, "Operation cancelled.", shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+
+	domain := vhosts[choice-1]
+	if choice <= len(enabled) {
+		err = service.DisableVirtualHost(domain)
+	} else {
+		err = service.EnableVirtualHost(domain)
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	fmt.Println("\nPress Enter to continue...")
+	reader.ReadString('\n')
+}
+
+func handleLogStats(reader *bufio.Reader) {
+	vhosts, err := service.ListVirtualHosts()
+	if err != nil || len(vhosts) == 0 {
+		fmt.Println(shared.ColorYellow, "No virtual hosts found.", shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+
+	fmt.Println(shared.ColorGreen, "Select a virtual host:", shared.ColorReset)
+	for i, vhost := range vhosts {
+		fmt.Printf("%d. %s\n", i+1, vhost)
+	}
+	fmt.Println("0. Cancel")
+
+	fmt.Print(shared.ColorYellow, "\nEnter your choice: ", shared.ColorReset)
+	choiceStr, _ := reader.ReadString('\n')
+	choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+	if err != nil || choice <= 0 || choice > len(vhosts) {
+		fmt.Println(shared.ColorYellow, "Operation cancelled.", shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+
+	fmt.Print(shared.ColorYellow, "Time window (15m, 1h, 24h, 7d, all) [1h]: ", shared.ColorReset)
+	windowStr, _ := reader.ReadString('\n')
+	if strings.TrimSpace(windowStr) == "" {
+		windowStr = "1h"
+	}
+	window, err := service.ParseLogWindow(windowStr)
+	if err == nil {
+		fmt.Println()
+		err = service.ShowAccessLogStats(vhosts[choice-1], window)
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	fmt.Println("\nPress Enter to continue...")
+	reader.ReadString('\n')
+}
+
 func handleStartTunnel(reader *bufio.Reader, tunnelType string) {
 	vhosts, err := service.ListVirtualHosts()
 	if err != nil {
@@ -90,14 +90,15 @@ func printRow(content ...string) {
 	fmt.Printf("   ║%s║\n", lineContent)
 }
 
-func DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool) {
+func DisplayMenu(webServerStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool) {
 	clearScreen()
-	apacheVersion := service.GetApacheVersion()
+	webServerName := service.WebServerName()
+	webServerVersion := service.GetWebServerVersion()
 	mysqlVersion := service.GetMySQLVersion()
 	pgVersion := service.GetPostgreSQLVersion()
 	phpVersion := service.GetPHPVersion()
 	pgStatus := service.IsServiceRunning("postgres.exe")
-	apachePortToDisplay := service.GetApachePort()
+	webServerPortToDisplay := service.GetWebServerPort()
 	mysqlPortToDisplay := service.GetMySQLPort()
 	pgPortToDisplay := service.GetPostgreSQLPort()
 	config, _ := service.GetConfig()
@@ -119,17 +120,18 @@ func DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool)
 	fmt.Println("   ╔═════════════════════════ INFORMATION ══════════════════════════╗")
 	printRow(fmt.Sprintf("Gecko Version : %s1.0.3%s", shared.ColorGreen, shared.ColorReset))
 	printRow(fmt.Sprintf("PHP (Active)  : %s%s%s", shared.ColorGreen, phpVersion, shared.ColorReset))
-	printRow(fmt.Sprintf("Apache        : %s%s%s", shared.ColorGreen, apacheVersion, shared.ColorReset))
+	printRow(fmt.Sprintf("%-14s: %s%s%s", webServerName, shared.ColorGreen, webServerVersion, shared.ColorReset))
 	printRow(fmt.Sprintf("MySQL         : %s%s%s", shared.ColorGreen, mysqlVersion, shared.ColorReset))
 	printRow(fmt.Sprintf("PostgreSQL    : %s%s%s", shared.ColorGreen, pgVersion, shared.ColorReset))
 	fmt.Println("   ╟════════════════════════════ STATUS ════════════════════════════╢")
 
-	apacheStatusLine := fmt.Sprintf("Apache: %s%-10s%s | Port: %s%s%s",
-		ternary(apacheStatus, shared.ColorGreen, shared.ColorRed),
-		ternary(apacheStatus, "Running", "Stopped"),
-		shared.ColorReset, shared.ColorGreen, apachePortToDisplay, shared.ColorReset,
+	webServerStatusLine := fmt.Sprintf("%-7s %s%-10s%s | Port: %s%s%s",
+		webServerName+":",
+		ternary(webServerStatus, shared.ColorGreen, shared.ColorRed),
+		ternary(webServerStatus, "Running", "Stopped"),
+		shared.ColorReset, shared.ColorGreen, webServerPortToDisplay, shared.ColorReset,
 	)
-	printRow(apacheStatusLine)
+	printRow(webServerStatusLine)
 
 	mysqlStatusLine := fmt.Sprintf("MySQL:  %s%-10s%s | Port: %s%s%s",
 		ternary(mysqlStatus, shared.ColorGreen, shared.ColorRed),
@@ -145,6 +147,34 @@ func DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool)
 	)
 	printRow(pgStatusLine)
 
+	dnsStatus := service.IsDNSResolverRunning()
+	dnsStatusLine := fmt.Sprintf("DNS:    %s%-10s%s | Suffix: %s%s%s",
+		ternary(dnsStatus, shared.ColorGreen, shared.ColorRed),
+		ternary(dnsStatus, "Active", "Hosts file"),
+		shared.ColorReset, shared.ColorGreen, config.DefaultDomainSuffix, shared.ColorReset,
+	)
+	printRow(dnsStatusLine)
+
+	proxyStatus := service.IsFrontProxyRunning()
+	proxyStatusLine := fmt.Sprintf("Proxy:  %s%-10s%s | Ports: %s%s/%s%s",
+		ternary(proxyStatus, shared.ColorGreen, shared.ColorRed),
+		ternary(proxyStatus, "Active", "Off"),
+		shared.ColorReset, shared.ColorGreen, config.ApachePort, config.ApacheSSLPort, shared.ColorReset,
+	)
+	printRow(proxyStatusLine)
+
+	for _, proc := range service.ProcessStatuses() {
+		detail := proc.Domain + "/" + proc.Name
+		if proc.Restarts > 0 {
+			detail += fmt.Sprintf(" (%d restarts)", proc.Restarts)
+		}
+		printRow(fmt.Sprintf("Proc:   %s%-10s%s | %s",
+			ternary(proc.State == service.ProcessRunning, shared.ColorGreen, ternary(proc.State == service.ProcessRestarting, shared.ColorYellow, shared.ColorRed)),
+			proc.State,
+			shared.ColorReset, detail,
+		))
+	}
+
 	securityStatusLine := fmt.Sprintf("Security: %s%-15s%s",
 		ternary(devModeStatus, shared.ColorRed, shared.ColorGreen),
 		ternary(devModeStatus, "DEV MODE (Public)", "PRIVATE (Local)"),
@@ -184,7 +214,7 @@ func DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool)
 	fmt.Println("   ╔═════════════════════════ GECKO MANAGER ════════════════════════╗")
 	printRow(" ")
 	printRow(fmt.Sprintf("%s:: SERVICES%s", shared.ColorYellow, shared.ColorReset))
-	printRow(ternary(apacheStatus, "1. Stop Apache", "1. Start Apache"), ternary(mysqlStatus, "2. Stop MySQL", "2. Start MySQL"))
+	printRow(ternary(webServerStatus, "1. Stop ", "1. Start ")+webServerName, ternary(mysqlStatus, "2. Stop MySQL", "2. Start MySQL"))
 	printRow(ternary(pgStatus, "3. Stop PostgreSQL", "3. Start PostgreSQL"), "")
 	printRow(" ")
 
@@ -192,6 +222,10 @@ func DisplayMenu(apacheStatus, mysqlStatus, ngrokStatus, cloudflareStatus bool)
 	printRow("4. Reset PgSQL DB", "5. Create VHost APP")
 	printRow("6. Delete VHost APP", "7. Reset MySQL DB")
 	printRow("8. Change Service Port", "9. View PgSQL Password")
+	printRow("17. Enable/Disable VHost", ternary(dnsStatus, "18. Stop Local DNS", "18. Start Local DNS"))
+	printRow(ternary(config.FrontProxyEnabled, "19. Disable Front Proxy", "19. Enable Front Proxy"), "20. Access Log Stats")
+	printRow(ternary(config.MailCatcherEnabled, "21. Stop Mail Catcher", "21. Start Mail Catcher"), "22. Share Root CA (Phones)")
+	printRow(ternary(config.ACMEServerEnabled, "23. Stop ACME Server", "23. Start ACME Server"), "24. MySQL Root Password")
 	printRow(" ")
 
 	printRow(fmt.Sprintf("%s:: TOOLS & TUNNELS%s", shared.ColorYellow, shared.ColorReset))
@@ -0,0 +1,444 @@
+package service
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"gecko/internal/shared"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	htpasswdDir  = `C:\Gecko\etc\config\htpasswd`
+	apr1Magic    = "$apr1$"
+	apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// VHostAccess narrows who may reach a site. Basic auth users live in the
+// site's htpasswd file rather than in the registry.
+type VHostAccess struct {
+	AllowFrom []string `json:"allow_from,omitempty"`
+}
+
+type htpasswdEntry struct {
+	User string
+	Hash string
+}
+
+func htpasswdPath(domainName string) string {
+	return filepath.Join(htpasswdDir, domainName+".htpasswd")
+}
+
+func readHtpasswd(path string) ([]htpasswdEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []htpasswdEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if ok {
+			entries = append(entries, htpasswdEntry{User: user, Hash: hash})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func writeHtpasswd(path string, entries []htpasswdEntry) error {
+	if len(entries) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		b.WriteString(entry.User + ":" + entry.Hash + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// vhostAuthUserFile returns the site's htpasswd file if it has any users.
+func vhostAuthUserFile(domainName string) string {
+	path := htpasswdPath(domainName)
+	if entries, err := readHtpasswd(path); err == nil && len(entries) > 0 {
+		return path
+	}
+	return ""
+}
+
+func AddVHostUser(domainName, user, password string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if !VirtualHostExists(domainName) {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	if user == "" || strings.ContainsAny(user, ": \t") {
+		return fmt.Errorf("user name must not be empty or contain ':' or spaces")
+	}
+	generated := password == ""
+	if generated {
+		var err error
+		if password, err = generateRandomPassword(16); err != nil {
+			return err
+		}
+	}
+	hash, err := apr1Hash(password)
+	if err != nil {
+		return err
+	}
+
+	path := htpasswdPath(domainName)
+	entries, err := readHtpasswd(path)
+	if err != nil {
+		return err
+	}
+	wasProtected := len(entries) > 0
+	replaced := false
+	for i := range entries {
+		if entries[i].User == user {
+			entries[i].Hash = hash
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, htpasswdEntry{User: user, Hash: hash})
+	}
+	if err := writeHtpasswd(path, entries); err != nil {
+		return err
+	}
+	if replaced {
+		fmt.Printf("%sPassword for '%s' on %s updated.%s\n", shared.ColorGreen, user, domainName, shared.ColorReset)
+	} else {
+		fmt.Printf("%sUser '%s' added to %s.%s\n", shared.ColorGreen, user, domainName, shared.ColorReset)
+	}
+	if generated {
+		fmt.Printf("Password: %s%s%s\n", shared.ColorYellow, password, shared.ColorReset)
+	}
+	if wasProtected {
+		// The config already points at the file, which is read on every request.
+		return nil
+	}
+	return applyVHostConfig(domainName)
+}
+
+func RemoveVHostUser(domainName, user string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	path := htpasswdPath(domainName)
+	entries, err := readHtpasswd(path)
+	if err != nil {
+		return err
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.User != user {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return fmt.Errorf("user '%s' not found for %s", user, domainName)
+	}
+	if err := writeHtpasswd(path, kept); err != nil {
+		return err
+	}
+	fmt.Printf("%sUser '%s' removed from %s.%s\n", shared.ColorGreen, user, domainName, shared.ColorReset)
+	if len(kept) > 0 {
+		return nil
+	}
+	fmt.Printf("%sNo users left, basic auth is now off for %s.%s\n", shared.ColorYellow, domainName, shared.ColorReset)
+	return applyVHostConfig(domainName)
+}
+
+func AllowVHostNetwork(domainName, network string) error {
+	return updateVHostAllowlist(domainName, network, true)
+}
+
+func RemoveVHostNetwork(domainName, network string) error {
+	return updateVHostAllowlist(domainName, network, false)
+}
+
+func updateVHostAllowlist(domainName, network string, add bool) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if !VirtualHostExists(domainName) {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	cidr, err := normalizeCIDR(network)
+	if err != nil {
+		return err
+	}
+	vhost, err := GetVHost(domainName)
+	if err != nil {
+		return err
+	}
+	if vhost.Access == nil {
+		vhost.Access = &VHostAccess{}
+	}
+	var allow []string
+	found := false
+	for _, existing := range vhost.Access.AllowFrom {
+		if existing == cidr {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		allow = append(allow, existing)
+	}
+	if add && found {
+		return fmt.Errorf("%s is already allowed for %s", cidr, domainName)
+	}
+	if !add && !found {
+		return fmt.Errorf("%s is not in the allowlist for %s", cidr, domainName)
+	}
+	if add {
+		allow = append(allow, cidr)
+	}
+	vhost.Access.AllowFrom = allow
+	if len(allow) == 0 {
+		vhost.Access = nil
+	}
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	return applyVHostConfig(domainName)
+}
+
+// normalizeCIDR accepts a network or a single address and returns it in
+// canonical CIDR form.
+func normalizeCIDR(network string) (string, error) {
+	network = strings.TrimSpace(network)
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return "", fmt.Errorf("'%s' is not an IP address or CIDR range", network)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return "", fmt.Errorf("'%s' is not an IP address or CIDR range", network)
+	}
+	return ipNet.String(), nil
+}
+
+func ShowVHostAccess(domainName string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if !VirtualHostExists(domainName) {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	vhost, err := GetVHost(domainName)
+	if err != nil {
+		return err
+	}
+	entries, err := readHtpasswd(htpasswdPath(domainName))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sAccess rules for %s%s\n", shared.ColorGreen, domainName, shared.ColorReset)
+	networks := "this computer"
+	if vhost.Access != nil && len(vhost.Access.AllowFrom) > 0 {
+		networks += ", " + strings.Join(vhost.Access.AllowFrom, ", ")
+	} else if config, err := GetConfig(); err == nil && config.DevelopmentMode {
+		networks += " and the local network (dev mode)"
+	}
+	fmt.Println("  Networks:   " + networks)
+	if vhost.ClientAuth {
+		fmt.Println("  Client TLS: certificate required over HTTPS")
+	}
+	if len(entries) == 0 {
+		fmt.Println("  Basic auth: off")
+		return nil
+	}
+	var users []string
+	for _, entry := range entries {
+		users = append(users, entry.User)
+	}
+	fmt.Println("  Basic auth: " + strings.Join(users, ", "))
+	return nil
+}
+
+// regenerateAccessControlledSites re-renders every site with access rules,
+// whose config the plain Require local/all granted swap cannot express.
+func regenerateAccessControlledSites() error {
+	enabled, _ := listVHostConfigs(sitesEnabledDir())
+	disabled, _ := listVHostConfigs(sitesAvailableDir())
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	for _, domain := range append(enabled, disabled...) {
+		vhost := registry[domain]
+		hasAllowlist := vhost != nil && vhost.Access != nil && len(vhost.Access.AllowFrom) > 0
+		if hasAllowlist || vhostAuthUserFile(domain) != "" {
+			if err := rewriteVHostFile(domain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func apacheAccessDirectives(spec *vhostSpec, indent string) string {
+	base := "Require local"
+	if spec.DevMode && len(spec.AllowFrom) == 0 {
+		base = "Require all granted"
+	}
+	if len(spec.AllowFrom) == 0 && spec.AuthUserFile == "" {
+		return indent + base + "\n"
+	}
+
+	var lines []string
+	if spec.AuthUserFile != "" {
+		lines = append(lines,
+			"AuthType Basic",
+			fmt.Sprintf(`AuthName "Gecko: %s"`, spec.Domain),
+			fmt.Sprintf(`AuthUserFile "%s"`, filepath.ToSlash(spec.AuthUserFile)),
+		)
+	}
+	lines = append(lines, "<RequireAll>")
+	if len(spec.AllowFrom) > 0 {
+		lines = append(lines, "    <RequireAny>", "        Require local")
+		for _, cidr := range spec.AllowFrom {
+			lines = append(lines, "        Require ip "+cidr)
+		}
+		lines = append(lines, "    </RequireAny>")
+	} else {
+		lines = append(lines, "    "+base)
+	}
+	if spec.AuthUserFile != "" {
+		lines = append(lines, "    Require valid-user")
+	}
+	lines = append(lines, "</RequireAll>")
+	return indent + strings.Join(lines, "\n"+indent) + "\n"
+}
+
+func nginxAccessRules(spec *vhostSpec, indent string) string {
+	var lines []string
+	if !spec.DevMode || len(spec.AllowFrom) > 0 {
+		lines = append(lines, "allow 127.0.0.1;", "allow ::1;")
+		for _, cidr := range spec.AllowFrom {
+			lines = append(lines, "allow "+cidr+";")
+		}
+		lines = append(lines, "deny all;")
+	}
+	if spec.AuthUserFile != "" {
+		lines = append(lines,
+			fmt.Sprintf(`auth_basic "Gecko: %s";`, spec.Domain),
+			fmt.Sprintf(`auth_basic_user_file "%s";`, filepath.ToSlash(spec.AuthUserFile)),
+		)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return indent + strings.Join(lines, "\n"+indent) + "\n"
+}
+
+// apr1Hash produces an Apache MD5 ("$apr1$") hash, the one format that both
+// Apache and nginx accept on Windows.
+func apr1Hash(password string) (string, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	salt := make([]byte, 8)
+	for i, b := range raw {
+		salt[i] = apr1Alphabet[int(b)%len(apr1Alphabet)]
+	}
+	return apr1Crypt(password, string(salt)), nil
+}
+
+func apr1Crypt(password, salt string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + apr1Magic + salt))
+	for n := len(pw); n > 0; n -= 16 {
+		ctx.Write(alt[:min(n, 16)])
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(apr1Magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return out.String()
+}
+
+// checkHtpasswd verifies a password against the hash formats Gecko writes
+// or that users commonly paste in by hand.
+func checkHtpasswd(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, apr1Magic), "$")
+		expected = apr1Crypt(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
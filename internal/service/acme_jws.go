@@ -0,0 +1,148 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JSON Web Signature handling for the ACME server: only the flattened JSON
+// serialization ACME uses (RFC 8555 section 6.2) and the algorithms ACME
+// clients actually send.
+
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk"`
+	KID   string          `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+var b64url = base64.RawURLEncoding
+
+// parseJWK returns the public key and its RFC 7638 thumbprint.
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, string, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, "", fmt.Errorf("invalid JWK: %v", err)
+	}
+	var pub crypto.PublicKey
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := b64url.DecodeString(jwk.N)
+		e, err2 := b64url.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", fmt.Errorf("invalid RSA JWK")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, "", fmt.Errorf("RSA account keys must be at least 2048 bits")
+		}
+		pub = key
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err1 := b64url.DecodeString(jwk.X)
+		y, err2 := b64url.DecodeString(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, "", fmt.Errorf("invalid EC JWK")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, "", fmt.Errorf("EC JWK point is not on the curve")
+		}
+		pub = key
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		x, err := b64url.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("unsupported OKP JWK")
+		}
+		pub = ed25519.PublicKey(x)
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Crv, jwk.X)
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return pub, b64url.EncodeToString(sum[:]), nil
+}
+
+// verifyJWS checks sig over the JWS signing input with the algorithm the
+// header names, which must match the key.
+func verifyJWS(alg string, pub crypto.PublicKey, signingInput, sig []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		sum := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		case alg == "ES512" && key.Curve == elliptic.P521():
+			sum := sha512.Sum512(signingInput)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s does not match the account key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("bad ECDSA signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("signature does not verify")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signingInput, sig) {
+			return fmt.Errorf("signature does not verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s for this key", alg)
+}
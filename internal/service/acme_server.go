@@ -0,0 +1,1007 @@
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"gecko/internal/shared"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultACMEPort    = "14000"
+	acmeAccountsPath   = `C:\Gecko\etc\acme\accounts.json`
+	acmeOrderLifetime  = 7 * 24 * time.Hour
+	acmeNonceLifetime  = time.Hour
+	acmeMaxRequestSize = 64 << 10
+	acmeErrorPrefix    = "urn:ietf:params:acme:error:"
+)
+
+var (
+	acmeMu         sync.Mutex
+	acmeHTTPServer *http.Server
+)
+
+func IsACMEServerRunning() bool {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	return acmeHTTPServer != nil
+}
+
+func acmeDirectoryURL(config *Config) string {
+	return fmt.Sprintf("https://localhost:%s/acme/directory", config.ACMEPort)
+}
+
+// StartACMEServer serves an RFC 8555 directory over HTTPS on the ACME port,
+// signing with the Gecko Root CA. It only listens on loopback unless
+// acme_listen_lan is set in the config.
+func StartACMEServer() error {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	if acmeHTTPServer != nil {
+		return nil
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	ca, err := loadRootCA()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.issueLeafCert(certNamesFor("localhost")...)
+	if err != nil {
+		return err
+	}
+	acme, err := newACMEServer(ca)
+	if err != nil {
+		return err
+	}
+	addr := "127.0.0.1:" + config.ACMEPort
+	if config.ACMEListenLAN {
+		addr = ":" + config.ACMEPort
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on port %s: %w", config.ACMEPort, err)
+	}
+	acmeHTTPServer = &http.Server{
+		Handler:           acme,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12},
+	}
+	go acmeHTTPServer.ServeTLS(ln, "", "")
+	return nil
+}
+
+func StopACMEServer() {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	if acmeHTTPServer != nil {
+		acmeHTTPServer.Close()
+		acmeHTTPServer = nil
+	}
+}
+
+func ToggleACMEServer() {
+	config, err := GetConfig()
+	if err != nil {
+		fmt.Printf("%sFailed to load configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	if config.ACMEServerEnabled {
+		StopACMEServer()
+		config.ACMEServerEnabled = false
+		if err := SaveConfig(config); err != nil {
+			fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return
+		}
+		fmt.Printf("%sACME server stopped.%s\n", shared.ColorGreen, shared.ColorReset)
+		return
+	}
+
+	fmt.Printf("%sStarting ACME server on port %s...%s\n", shared.ColorYellow, config.ACMEPort, shared.ColorReset)
+	if err := StartACMEServer(); err != nil {
+		fmt.Printf("%sError starting ACME server: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	config.ACMEServerEnabled = true
+	if err := SaveConfig(config); err != nil {
+		StopACMEServer()
+		fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	PrintACMEUsage(config)
+}
+
+func PrintACMEUsage(config *Config) {
+	fmt.Printf("%sACME server active. Directory: %s%s\n", shared.ColorGreen, acmeDirectoryURL(config), shared.ColorReset)
+	if suffix, ok := acmeAutoApproveSuffix(); ok {
+		fmt.Printf("Names ending in %s are approved automatically; ", suffix)
+	}
+	fmt.Println("names of other Gecko sites must pass HTTP-01 from the site's own folder.")
+	fmt.Printf("  certbot certonly --server %s --webroot -w %s -d <site>\n", acmeDirectoryURL(config), filepath.Join(wwwDir, "<site>"))
+	fmt.Println("Clients that do not use the Windows trust store need the Root CA, e.g. NODE_EXTRA_CA_CERTS or LEGO_CA_CERTIFICATES=" + caCertPath)
+}
+
+// acmeAutoApproveSuffix is the name ending whose authorizations start out
+// valid: the default domain suffix, as long as it is a reserved TLD that
+// nothing outside this machine can own.
+func acmeAutoApproveSuffix() (string, bool) {
+	suffix := getDefaultDomainSuffix()
+	return suffix, hasReservedTLD(suffix)
+}
+
+func acmeAutoApproved(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "localhost" {
+		return true
+	}
+	suffix, ok := acmeAutoApproveSuffix()
+	return ok && strings.HasSuffix(name, suffix)
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func acmeError(status int, kind, format string, args ...any) *acmeProblem {
+	return &acmeProblem{Type: acmeErrorPrefix + kind, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAccount struct {
+	ID         string          `json:"id"`
+	Key        json.RawMessage `json:"key"`
+	Thumbprint string          `json:"thumbprint"`
+	Contact    []string        `json:"contact,omitempty"`
+	Status     string          `json:"status"`
+	Created    time.Time       `json:"created"`
+	publicKey  any
+}
+
+type acmeOrder struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []string
+	certID      string
+	problem     *acmeProblem
+}
+
+type acmeAuthz struct {
+	id         string
+	accountID  string
+	identifier acmeIdentifier
+	status     string
+	expires    time.Time
+	wildcard   bool
+	challenge  *acmeChallenge
+}
+
+type acmeChallenge struct {
+	id        string
+	token     string
+	status    string
+	validated time.Time
+	problem   *acmeProblem
+}
+
+type acmeCert struct {
+	accountID string
+	chain     []byte
+	serial    string
+	notAfter  time.Time
+	revoked   bool
+}
+
+// acmeServer keeps orders, authorizations and certificates in memory;
+// only accounts survive a restart, since clients keep their account URL.
+type acmeServer struct {
+	ca       *rootCA
+	mu       sync.Mutex
+	nonces   map[string]time.Time
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	chals    map[string]*acmeAuthz
+	certs    map[string]*acmeCert
+	validate func(site, token, keyAuth string) error
+}
+
+func newACMEServer(ca *rootCA) (*acmeServer, error) {
+	s := &acmeServer{
+		ca:       ca,
+		nonces:   make(map[string]time.Time),
+		accounts: make(map[string]*acmeAccount),
+		orders:   make(map[string]*acmeOrder),
+		authzs:   make(map[string]*acmeAuthz),
+		chals:    make(map[string]*acmeAuthz),
+		certs:    make(map[string]*acmeCert),
+		validate: validateHTTP01,
+	}
+	data, err := os.ReadFile(acmeAccountsPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var accounts []*acmeAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", acmeAccountsPath, err)
+	}
+	for _, account := range accounts {
+		if account.publicKey, _, err = parseJWK(account.Key); err == nil {
+			s.accounts[account.ID] = account
+		}
+	}
+	return s, nil
+}
+
+// saveAccounts is called with s.mu held.
+func (s *acmeServer) saveAccounts() error {
+	accounts := make([]*acmeAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Created.Before(accounts[j].Created) })
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(acmeAccountsPath), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(acmeAccountsPath, data, 0600)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *acmeServer) newNonce() string {
+	nonce := b64url.EncodeToString([]byte(randomID()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, issued := range s.nonces {
+		if now.Sub(issued) > acmeNonceLifetime {
+			delete(s.nonces, n)
+		}
+	}
+	s.nonces[nonce] = now
+	return nonce
+}
+
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	issued, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Since(issued) <= acmeNonceLifetime
+}
+
+func acmeBaseURL(r *http.Request) string {
+	return "https://" + r.Host + "/acme"
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/acme/")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	kind, id, _ := strings.Cut(path, "/")
+
+	switch kind {
+	case "directory":
+		base := acmeBaseURL(r)
+		s.writeJSON(w, r, http.StatusOK, map[string]any{
+			"newNonce":   base + "/new-nonce",
+			"newAccount": base + "/new-account",
+			"newOrder":   base + "/new-order",
+			"revokeCert": base + "/revoke-cert",
+			"keyChange":  base + "/key-change",
+			"meta": map[string]any{
+				"website":                 "https://github.com/shiwildy/Gecko",
+				"externalAccountRequired": false,
+			},
+		}, "")
+		return
+	case "new-nonce":
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		s.writeProblem(w, r, acmeError(http.StatusMethodNotAllowed, "malformed", "%s requires POST", r.URL.Path))
+		return
+	}
+	req, problem := s.parseRequest(r, kind == "new-account" || kind == "revoke-cert")
+	if problem != nil {
+		s.writeProblem(w, r, problem)
+		return
+	}
+
+	switch kind {
+	case "new-account":
+		s.handleNewAccount(w, r, req)
+	case "account":
+		s.handleAccount(w, r, req, id)
+	case "new-order":
+		s.handleNewOrder(w, r, req)
+	case "order":
+		s.handleOrder(w, r, req, id)
+	case "authz":
+		s.handleAuthz(w, r, req, id)
+	case "chall":
+		s.handleChallenge(w, r, req, id)
+	case "finalize":
+		s.handleFinalize(w, r, req, id)
+	case "cert":
+		s.handleCert(w, r, req, id)
+	case "revoke-cert":
+		s.handleRevoke(w, r, req)
+	case "key-change":
+		s.writeProblem(w, r, acmeError(http.StatusNotImplemented, "malformed", "key rollover is not supported; create a new account instead"))
+	default:
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown resource %s", r.URL.Path))
+	}
+}
+
+// acmeRequest is a verified JWS: the payload plus either the account that
+// signed it or, for new accounts, the embedded key.
+type acmeRequest struct {
+	payload    []byte
+	account    *acmeAccount
+	jwk        json.RawMessage
+	key        any
+	thumbprint string
+}
+
+func (s *acmeServer) parseRequest(r *http.Request, jwkAllowed bool) (*acmeRequest, *acmeProblem) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, acmeMaxRequestSize))
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "could not read request")
+	}
+	var msg jwsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "request is not a flattened JWS")
+	}
+	headerJSON, err := b64url.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "bad protected header encoding")
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "bad protected header")
+	}
+	if !s.useNonce(header.Nonce) {
+		return nil, acmeError(http.StatusBadRequest, "badNonce", "nonce is missing, used or expired")
+	}
+	if header.URL != "https://"+r.Host+r.URL.Path {
+		return nil, acmeError(http.StatusUnauthorized, "unauthorized", "JWS url %q does not match the request", header.URL)
+	}
+
+	req := &acmeRequest{}
+	switch {
+	case len(header.JWK) > 0 && header.KID == "":
+		if !jwkAllowed {
+			return nil, acmeError(http.StatusBadRequest, "malformed", "this request must be signed with the account key id")
+		}
+		req.key, req.thumbprint, err = parseJWK(header.JWK)
+		if err != nil {
+			return nil, acmeError(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+		req.jwk = header.JWK
+		s.mu.Lock()
+		for _, account := range s.accounts {
+			if account.Thumbprint == req.thumbprint {
+				req.account = account
+			}
+		}
+		s.mu.Unlock()
+	case header.KID != "" && len(header.JWK) == 0:
+		prefix := acmeBaseURL(r) + "/account/"
+		s.mu.Lock()
+		account := s.accounts[strings.TrimPrefix(header.KID, prefix)]
+		s.mu.Unlock()
+		if !strings.HasPrefix(header.KID, prefix) || account == nil {
+			return nil, acmeError(http.StatusBadRequest, "accountDoesNotExist", "unknown account %s", header.KID)
+		}
+		if account.Status != "valid" {
+			return nil, acmeError(http.StatusUnauthorized, "unauthorized", "account is %s", account.Status)
+		}
+		req.account, req.key = account, account.publicKey
+	default:
+		return nil, acmeError(http.StatusBadRequest, "malformed", "exactly one of jwk and kid is required")
+	}
+
+	sig, err := b64url.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "bad signature encoding")
+	}
+	if err := verifyJWS(header.Alg, req.key, []byte(msg.Protected+"."+msg.Payload), sig); err != nil {
+		if strings.Contains(err.Error(), "algorithm") {
+			return nil, acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+		}
+		return nil, acmeError(http.StatusUnauthorized, "unauthorized", "%v", err)
+	}
+	if req.payload, err = b64url.DecodeString(msg.Payload); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "bad payload encoding")
+	}
+	return req, nil
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, r *http.Request, status int, body any, location string) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Link", fmt.Sprintf(`<%s/directory>;rel="index"`, acmeBaseURL(r)))
+	w.Header().Set("Content-Type", "application/json")
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, r *http.Request, problem *acmeProblem) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func (s *acmeServer) accountJSON(base string, account *acmeAccount) map[string]any {
+	return map[string]any{
+		"status":  account.Status,
+		"contact": account.Contact,
+		"orders":  base + "/account/" + account.ID + "/orders",
+	}
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "bad newAccount payload"))
+		return
+	}
+	base := acmeBaseURL(r)
+	if req.account != nil {
+		s.writeJSON(w, r, http.StatusOK, s.accountJSON(base, req.account), base+"/account/"+req.account.ID)
+		return
+	}
+	if payload.OnlyReturnExisting {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "accountDoesNotExist", "no account for this key"))
+		return
+	}
+	account := &acmeAccount{
+		ID:         randomID(),
+		Key:        req.jwk,
+		Thumbprint: req.thumbprint,
+		Contact:    payload.Contact,
+		Status:     "valid",
+		Created:    time.Now().UTC(),
+		publicKey:  req.key,
+	}
+	s.mu.Lock()
+	s.accounts[account.ID] = account
+	err := s.saveAccounts()
+	s.mu.Unlock()
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusInternalServerError, "serverInternal", "could not store account: %v", err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusCreated, s.accountJSON(base, account), base+"/account/"+account.ID)
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	base := acmeBaseURL(r)
+	if strings.HasSuffix(id, "/orders") {
+		if strings.TrimSuffix(id, "/orders") != req.account.ID {
+			s.writeProblem(w, r, acmeError(http.StatusUnauthorized, "unauthorized", "account URL does not match the signing key"))
+			return
+		}
+		s.mu.Lock()
+		var urls []string
+		for _, order := range s.orders {
+			if order.accountID == req.account.ID {
+				urls = append(urls, base+"/order/"+order.id)
+			}
+		}
+		s.mu.Unlock()
+		sort.Strings(urls)
+		s.writeJSON(w, r, http.StatusOK, map[string]any{"orders": urls}, "")
+		return
+	}
+	if id != req.account.ID {
+		s.writeProblem(w, r, acmeError(http.StatusUnauthorized, "unauthorized", "account URL does not match the signing key"))
+		return
+	}
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "bad account update"))
+			return
+		}
+	}
+	s.mu.Lock()
+	if payload.Contact != nil {
+		req.account.Contact = payload.Contact
+	}
+	if payload.Status == "deactivated" {
+		req.account.Status = "deactivated"
+	}
+	err := s.saveAccounts()
+	s.mu.Unlock()
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusInternalServerError, "serverInternal", "could not store account: %v", err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, s.accountJSON(base, req.account), "")
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "an order needs identifiers"))
+		return
+	}
+	order := &acmeOrder{
+		id:        randomID(),
+		accountID: req.account.ID,
+		status:    "pending",
+		expires:   time.Now().Add(acmeOrderLifetime).UTC(),
+	}
+	var authzs []*acmeAuthz
+	seen := make(map[string]bool)
+	for _, ident := range payload.Identifiers {
+		name := strings.ToLower(strings.TrimSuffix(ident.Value, "."))
+		if ident.Type != "dns" {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "unsupportedIdentifier", "only dns identifiers are supported"))
+			return
+		}
+		if err := checkAlias(name); err != nil && name != "localhost" {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s: %v", name, err))
+			return
+		}
+		auto := acmeAutoApproved(name)
+		if strings.HasPrefix(name, "*.") && !auto {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s: wildcards need DNS-01, which is not offered", name))
+			return
+		}
+		// Anything else must be a Gecko site, or the Root CA trusted on this
+		// machine would vouch for names on the public internet.
+		if _, ok := siteForName(name); !ok && !auto {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s is not a Gecko site", name))
+			return
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		authz := &acmeAuthz{
+			id:         randomID(),
+			accountID:  req.account.ID,
+			identifier: acmeIdentifier{Type: "dns", Value: strings.TrimPrefix(name, "*.")},
+			status:     "pending",
+			expires:    order.expires,
+			wildcard:   strings.HasPrefix(name, "*."),
+			challenge:  &acmeChallenge{id: randomID(), token: randomToken(), status: "pending"},
+		}
+		if auto {
+			authz.status, authz.challenge.status = "valid", "valid"
+			authz.challenge.validated = time.Now().UTC()
+		}
+		order.identifiers = append(order.identifiers, acmeIdentifier{Type: "dns", Value: name})
+		authzs = append(authzs, authz)
+	}
+
+	s.mu.Lock()
+	s.prune()
+	for _, authz := range authzs {
+		s.authzs[authz.id] = authz
+		s.chals[authz.challenge.id] = authz
+		order.authzs = append(order.authzs, authz.id)
+	}
+	s.orders[order.id] = order
+	s.updateOrderStatus(order)
+	body := s.orderJSON(acmeBaseURL(r), order)
+	s.mu.Unlock()
+	s.writeJSON(w, r, http.StatusCreated, body, acmeBaseURL(r)+"/order/"+order.id)
+}
+
+// prune forgets expired orders with their authorizations, and certificates
+// past their expiry. Callers hold s.mu.
+func (s *acmeServer) prune() {
+	now := time.Now()
+	for id, order := range s.orders {
+		if now.Before(order.expires) {
+			continue
+		}
+		for _, authzID := range order.authzs {
+			if authz := s.authzs[authzID]; authz != nil {
+				delete(s.chals, authz.challenge.id)
+			}
+			delete(s.authzs, authzID)
+		}
+		delete(s.orders, id)
+	}
+	for id, cert := range s.certs {
+		if now.After(cert.notAfter) {
+			delete(s.certs, id)
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b64url.EncodeToString(b)
+}
+
+// updateOrderStatus moves a pending order to ready or invalid once its
+// authorizations are settled. Callers hold s.mu.
+func (s *acmeServer) updateOrderStatus(order *acmeOrder) {
+	if order.status != "pending" {
+		return
+	}
+	if time.Now().After(order.expires) {
+		order.status = "invalid"
+		return
+	}
+	ready := true
+	for _, id := range order.authzs {
+		switch s.authzs[id].status {
+		case "invalid":
+			order.status = "invalid"
+			order.problem = s.authzs[id].challenge.problem
+			return
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+	if ready {
+		order.status = "ready"
+	}
+}
+
+// orderJSON renders an order. Callers hold s.mu.
+func (s *acmeServer) orderJSON(base string, order *acmeOrder) map[string]any {
+	authzURLs := make([]string, len(order.authzs))
+	for i, id := range order.authzs {
+		authzURLs[i] = base + "/authz/" + id
+	}
+	body := map[string]any{
+		"status":         order.status,
+		"expires":        order.expires.Format(time.RFC3339),
+		"identifiers":    order.identifiers,
+		"authorizations": authzURLs,
+		"finalize":       base + "/finalize/" + order.id,
+	}
+	if order.certID != "" {
+		body["certificate"] = base + "/cert/" + order.certID
+	}
+	if order.problem != nil {
+		body["error"] = order.problem
+	}
+	return body
+}
+
+func (s *acmeServer) handleOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	s.mu.Lock()
+	order := s.orders[id]
+	if order == nil || order.accountID != req.account.ID {
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "no such order"))
+		return
+	}
+	s.updateOrderStatus(order)
+	body := s.orderJSON(acmeBaseURL(r), order)
+	s.mu.Unlock()
+	s.writeJSON(w, r, http.StatusOK, body, "")
+}
+
+// challengeJSON renders a challenge. Callers hold s.mu.
+func challengeJSON(base string, authz *acmeAuthz) map[string]any {
+	chal := authz.challenge
+	body := map[string]any{
+		"type":   "http-01",
+		"url":    base + "/chall/" + chal.id,
+		"token":  chal.token,
+		"status": chal.status,
+	}
+	if !chal.validated.IsZero() {
+		body["validated"] = chal.validated.Format(time.RFC3339)
+	}
+	if chal.problem != nil {
+		body["error"] = chal.problem
+	}
+	return body
+}
+
+func (s *acmeServer) handleAuthz(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if len(req.payload) > 0 {
+		json.Unmarshal(req.payload, &payload)
+	}
+	s.mu.Lock()
+	authz := s.authzs[id]
+	if authz == nil || authz.accountID != req.account.ID {
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "no such authorization"))
+		return
+	}
+	if payload.Status == "deactivated" {
+		authz.status = "deactivated"
+	}
+	body := map[string]any{
+		"status":     authz.status,
+		"expires":    authz.expires.Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"challenges": []any{challengeJSON(acmeBaseURL(r), authz)},
+	}
+	if authz.wildcard {
+		body["wildcard"] = true
+	}
+	s.mu.Unlock()
+	s.writeJSON(w, r, http.StatusOK, body, "")
+}
+
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	base := acmeBaseURL(r)
+	s.mu.Lock()
+	authz := s.chals[id]
+	if authz == nil || authz.accountID != req.account.ID {
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "no such challenge"))
+		return
+	}
+	// An empty JSON object asks for validation; an empty payload just reads.
+	if len(req.payload) > 0 && authz.challenge.status == "pending" {
+		authz.challenge.status = "processing"
+		go s.runValidation(authz, req.account.Thumbprint)
+	}
+	body := challengeJSON(base, authz)
+	s.mu.Unlock()
+	w.Header().Set("Link", fmt.Sprintf(`<%s/authz/%s>;rel="up"`, base, authz.id))
+	s.writeJSON(w, r, http.StatusOK, body, "")
+}
+
+func (s *acmeServer) runValidation(authz *acmeAuthz, thumbprint string) {
+	token := authz.challenge.token
+	site, ok := siteForName(authz.identifier.Value)
+	err := fmt.Errorf("%s is no longer a Gecko site", authz.identifier.Value)
+	if ok {
+		err = s.validate(site, token, token+"."+thumbprint)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		authz.challenge.status, authz.status = "invalid", "invalid"
+		authz.challenge.problem = acmeError(http.StatusForbidden, "unauthorized", "%v", err)
+	} else {
+		authz.challenge.status, authz.status = "valid", "valid"
+		authz.challenge.validated = time.Now().UTC()
+	}
+	for _, order := range s.orders {
+		for _, id := range order.authzs {
+			if id == authz.id {
+				s.updateOrderStatus(order)
+			}
+		}
+	}
+}
+
+// validateHTTP01 reads the key authorization from the site's own folder
+// rather than over HTTP, where a catch-all vhost could answer for any name.
+func validateHTTP01(site, token, keyAuth string) error {
+	path := filepath.Join(wwwDir, site, ".well-known", "acme-challenge", token)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist", path)
+	}
+	if err != nil {
+		return err
+	}
+	if got := strings.TrimSpace(string(data)); got != keyAuth {
+		return fmt.Errorf("%s holds %q, expected the key authorization", path, truncateForDisplay(got, 80))
+	}
+	return nil
+}
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "bad finalize payload"))
+		return
+	}
+	der, err := b64url.DecodeString(payload.CSR)
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "bad CSR encoding"))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	order := s.orders[id]
+	if order == nil || order.accountID != req.account.ID {
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "no such order"))
+		return
+	}
+	s.updateOrderStatus(order)
+	if order.status != "ready" {
+		status := order.status
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusForbidden, "orderNotReady", "order is %s", status))
+		return
+	}
+	order.status = "processing"
+	ordered := make(map[string]bool)
+	var names []string
+	for _, ident := range order.identifiers {
+		ordered[ident.Value] = true
+		names = append(names, ident.Value)
+	}
+	s.mu.Unlock()
+
+	requested := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		requested[cn] = true
+	}
+	var problem *acmeProblem
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 || len(requested) != len(ordered) {
+		problem = acmeError(http.StatusBadRequest, "badCSR", "the CSR must name exactly the order's identifiers")
+	}
+	for name := range requested {
+		if !ordered[name] {
+			problem = acmeError(http.StatusBadRequest, "badCSR", "%s is not part of the order", name)
+		}
+	}
+
+	var leaf *x509.Certificate
+	if problem == nil {
+		if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+			// Keep the requested common name first so it becomes the subject.
+			sort.SliceStable(names, func(i, j int) bool { return names[i] == cn && names[j] != cn })
+		}
+		if leaf, err = s.ca.signLeaf(csr.PublicKey, names); err != nil {
+			problem = acmeError(http.StatusInternalServerError, "serverInternal", "signing failed: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	if problem != nil {
+		order.status = "ready"
+		s.mu.Unlock()
+		s.writeProblem(w, r, problem)
+		return
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.cert.Raw})...)
+	order.certID = randomID()
+	s.certs[order.certID] = &acmeCert{accountID: req.account.ID, chain: chain, serial: leaf.SerialNumber.String(), notAfter: leaf.NotAfter}
+	order.status = "valid"
+	body := s.orderJSON(acmeBaseURL(r), order)
+	s.mu.Unlock()
+	fmt.Printf("%sACME: issued a certificate for %s%s\n", shared.ColorGreen, strings.Join(names, ", "), shared.ColorReset)
+	s.writeJSON(w, r, http.StatusOK, body, acmeBaseURL(r)+"/order/"+order.id)
+}
+
+func (s *acmeServer) handleCert(w http.ResponseWriter, r *http.Request, req *acmeRequest, id string) {
+	s.mu.Lock()
+	cert := s.certs[id]
+	s.mu.Unlock()
+	if cert == nil || cert.accountID != req.account.ID {
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "no such certificate"))
+		return
+	}
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(cert.chain)
+}
+
+func (s *acmeServer) handleRevoke(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "bad revocation payload"))
+		return
+	}
+	der, err := b64url.DecodeString(payload.Certificate)
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "bad certificate encoding"))
+		return
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "%v", err))
+		return
+	}
+	s.mu.Lock()
+	var found *acmeCert
+	for _, cert := range s.certs {
+		if cert.serial == leaf.SerialNumber.String() {
+			found = cert
+		}
+	}
+	// Either the issuing account or the certificate's own key may revoke.
+	allowed := found != nil && ((req.account != nil && req.account.ID == found.accountID) || (req.jwk != nil && publicKeysEqual(req.key, leaf.PublicKey)))
+	switch {
+	case found == nil:
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "certificate was not issued by this server"))
+		return
+	case !allowed:
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusForbidden, "unauthorized", "not allowed to revoke this certificate"))
+		return
+	case found.revoked:
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "alreadyRevoked", "certificate is already revoked"))
+		return
+	}
+	found.revoked = true
+	s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.WriteHeader(http.StatusOK)
+}
+
+func publicKeysEqual(a, b any) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
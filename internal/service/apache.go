@@ -1,38 +1,172 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"gecko/internal/shared"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/sys/windows"
 )
 
 const (
-	apacheExe = `C:\Gecko\bin\httpd\bin\httpd.exe`
-	apacheDir = `C:\Gecko\bin\httpd\`
+	apacheExe               = `C:\Gecko\bin\httpd\bin\httpd.exe`
+	apacheDir               = `C:\Gecko\bin\httpd\`
+	apacheConfigDir         = `C:\Gecko\etc\config\httpd`
+	apacheSitesEnabledDir   = `C:\Gecko\etc\config\httpd\sites-enabled`
+	apacheSitesAvailableDir = `C:\Gecko\etc\config\httpd\sites-available`
+	apachePidFile           = `C:\Gecko\logs\httpd\gecko-httpd.pid`
+	apacheDotfilesConfig    = "00-gecko-dotfiles.conf"
 )
 
+// apacheDotfilesRule applies to every site, the default one included, since
+// that one serves the whole www folder. .well-known stays reachable.
+const apacheDotfilesRule = `# Dotfiles such as .env and .git hold secrets, not content.
+<LocationMatch "/\.(?!well-known(/|$))">
+    Require all denied
+</LocationMatch>
+`
+
+var apacheSyntaxErrorPattern = regexp.MustCompile(`(?m)Syntax error on line (\d+) of (.+):\r?$\s*([^\r\n]*)`)
+
 func StartApache() {
+	if err := writeApacheDotfilesRule(); err != nil {
+		fmt.Printf("%sCould not write %s: %v%s\n", shared.ColorYellow, apacheDotfilesConfig, err, shared.ColorReset)
+	}
 	cmd := exec.Command(apacheExe, "-d", apacheDir)
 	err := cmd.Start()
 	if err != nil {
 		fmt.Printf("%sError starting Apache: %v%s\n", shared.ColorRed, err, shared.ColorReset)
 		return
 	}
+	// The process we start is Apache's parent, which owns the restart event.
+	os.MkdirAll(filepath.Dir(apachePidFile), os.ModePerm)
+	os.WriteFile(apachePidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	cmd.Process.Release()
 	fmt.Printf("%sApache started in background.%s\n", shared.ColorGreen, shared.ColorReset)
 }
 
 func StopApache() {
 	cmd := exec.Command("taskkill", "/F", "/IM", "httpd.exe")
 	err := cmd.Run()
+	os.Remove(apachePidFile)
 	if err == nil {
 		fmt.Printf("%sApache stopped.%s\n", shared.ColorYellow, shared.ColorReset)
 	}
 }
 
+// RestartApache kills and starts Apache. Use it only when a graceful reload
+// is not enough, such as after a port or PHP module change.
 func RestartApache() {
 	fmt.Printf("%sRestarting Apache to apply changes...%s\n", shared.ColorYellow, shared.ColorReset)
 	StopApache()
-	time.Sleep(1 * time.Second)
+	waitForApacheExit(10 * time.Second)
 	StartApache()
 }
+
+// ReloadApache asks the running Apache to gracefully restart, letting
+// in-flight requests finish. Apache is started if it is not running.
+func ReloadApache() {
+	if !IsServiceRunning("httpd.exe") {
+		StartApache()
+		return
+	}
+	fmt.Printf("%sGracefully reloading Apache...%s\n", shared.ColorYellow, shared.ColorReset)
+	if err := writeApacheDotfilesRule(); err != nil {
+		fmt.Printf("%sCould not write %s: %v%s\n", shared.ColorYellow, apacheDotfilesConfig, err, shared.ColorReset)
+	}
+	if err := signalApacheRestart(); err != nil {
+		fmt.Printf("%sGraceful reload unavailable (%v). Falling back to a full restart.%s\n", shared.ColorYellow, err, shared.ColorReset)
+		RestartApache()
+		return
+	}
+	fmt.Printf("%sApache reloaded.%s\n", shared.ColorGreen, shared.ColorReset)
+}
+
+func writeApacheDotfilesRule() error {
+	path := filepath.Join(apacheSitesEnabledDir, apacheDotfilesConfig)
+	if data, err := os.ReadFile(path); err == nil && string(data) == apacheDotfilesRule {
+		return nil
+	}
+	if err := os.MkdirAll(apacheSitesEnabledDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(apacheDotfilesRule), 0644)
+}
+
+// signalApacheRestart sets the "ap<pid>_restart" event that mpm_winnt watches,
+// which is what "httpd -k restart" does for a console (non-service) Apache.
+func signalApacheRestart() error {
+	data, err := os.ReadFile(apachePidFile)
+	if err != nil {
+		return fmt.Errorf("Apache was not started by Gecko")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid file: %w", err)
+	}
+	name, err := windows.UTF16PtrFromString(fmt.Sprintf("ap%d_restart", pid))
+	if err != nil {
+		return err
+	}
+	event, err := windows.OpenEvent(windows.EVENT_MODIFY_STATE, false, name)
+	if err != nil {
+		return fmt.Errorf("could not open Apache restart event: %w", err)
+	}
+	defer windows.CloseHandle(event)
+	return windows.SetEvent(event)
+}
+
+// waitForApacheExit waits until httpd.exe is gone and its ports can be bound
+// again, instead of guessing with a fixed sleep.
+func waitForApacheExit(timeout time.Duration) {
+	config, _ := GetConfig()
+	httpPort, sslPort := webServerPorts(config)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !IsServiceRunning("httpd.exe") && isPortFree(httpPort) && isPortFree(sslPort) {
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func isPortFree(port string) bool {
+	if port == "" {
+		return true
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+func testApacheConfig() error {
+	cmd := exec.Command(apacheExe, "-t", "-d", apacheDir)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// Without httpd.exe nothing is validated, so nothing may be committed.
+		return fmt.Errorf("could not run %s to test the configuration: %w", apacheExe, err)
+	}
+	out := strings.TrimSpace(string(output))
+	configErr := &configTestError{Output: out}
+	if m := apacheSyntaxErrorPattern.FindStringSubmatch(out); m != nil {
+		configErr.Line, _ = strconv.Atoi(m[1])
+		configErr.File = filepath.FromSlash(m[2])
+		configErr.Message = strings.TrimSpace(m[3])
+	}
+	return configErr
+}
@@ -0,0 +1,417 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"gecko/internal/shared"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	certKeyRSA   = "rsa"
+	certKeyECDSA = "ecdsa"
+
+	defaultCAValidityDays   = 3650
+	defaultLeafValidityDays = 825
+	defaultCAKeyBits        = 4096
+	defaultLeafKeyBits      = 2048
+	defaultECDSAKeySize     = 256
+)
+
+// caMu keeps two callers from generating competing Root CAs.
+var caMu sync.Mutex
+
+// applyCertDefaults fills in certificate settings missing from the config
+// with the values Gecko has always used, and reports whether it changed any.
+// Key sizes that do not suit the key type, such as the RSA defaults left
+// behind after switching to ecdsa, get that type's default.
+func applyCertDefaults(config *Config) bool {
+	changed := false
+	setString := func(field *string, value string) {
+		if *field == "" {
+			*field, changed = value, true
+		}
+	}
+	setInt := func(field *int, value int) {
+		if *field == 0 {
+			*field, changed = value, true
+		}
+	}
+	setKeySize := func(field *int, name string, ca bool) {
+		value := defaultKeySize(config.CertKeyType, ca)
+		if value == 0 || validKeySize(config.CertKeyType, *field) {
+			return
+		}
+		if *field != 0 && *field != defaultCAKeyBits && *field != defaultLeafKeyBits {
+			fmt.Printf("%sWarning: %s %d does not suit %s keys; using %d.%s\n", shared.ColorYellow, name, *field, config.CertKeyType, value, shared.ColorReset)
+		}
+		*field, changed = value, true
+	}
+	setString(&config.CertCountry, "ID")
+	setString(&config.CertProvince, "DKI Jakarta")
+	setString(&config.CertLocality, "Jakarta Utara")
+	setString(&config.CertOrganization, "Gecko")
+	setString(&config.CertKeyType, certKeyRSA)
+	setKeySize(&config.CAKeySize, "ca_key_size", true)
+	setKeySize(&config.LeafKeySize, "leaf_key_size", false)
+	setInt(&config.CAValidityDays, defaultCAValidityDays)
+	setInt(&config.LeafValidityDays, defaultLeafValidityDays)
+	return changed
+}
+
+// defaultKeySize is the key size used for keyType when none that suits it is
+// configured, or 0 for an unknown type.
+func defaultKeySize(keyType string, ca bool) int {
+	switch strings.ToLower(keyType) {
+	case certKeyRSA:
+		if ca {
+			return defaultCAKeyBits
+		}
+		return defaultLeafKeyBits
+	case certKeyECDSA:
+		return defaultECDSAKeySize
+	}
+	return 0
+}
+
+func validKeySize(keyType string, size int) bool {
+	switch strings.ToLower(keyType) {
+	case certKeyRSA:
+		return size >= 2048
+	case certKeyECDSA:
+		return size == 256 || size == 384 || size == 521
+	}
+	return false
+}
+
+// checkCertKeyType warns about a cert_key_type nothing can be issued with.
+func checkCertKeyType(config *Config) {
+	if defaultKeySize(config.CertKeyType, false) == 0 {
+		fmt.Printf("%sWarning: unknown cert_key_type '%s' in %s (use %s or %s); certificates cannot be issued.%s\n", shared.ColorRed, config.CertKeyType, geckoConfigPath, certKeyRSA, certKeyECDSA, shared.ColorReset)
+	}
+}
+
+// certSettings reads the certificate settings, falling back to the defaults
+// when the config cannot be loaded.
+func certSettings() *Config {
+	config, err := GetConfig()
+	if err != nil {
+		config = &Config{}
+	}
+	settings := *config
+	applyCertDefaults(&settings)
+	return &settings
+}
+
+func geckoSubject(commonName string) pkix.Name {
+	settings := certSettings()
+	return pkix.Name{
+		Country:      []string{settings.CertCountry},
+		Province:     []string{settings.CertProvince},
+		Locality:     []string{settings.CertLocality},
+		Organization: []string{settings.CertOrganization},
+		CommonName:   commonName,
+	}
+}
+
+// generateKey makes an RSA key of size bits, or an ECDSA key on the P-size
+// curve.
+func generateKey(keyType string, size int) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case certKeyRSA:
+		if size < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits, not %d", size)
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case certKeyECDSA:
+		var curve elliptic.Curve
+		switch size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ECDSA key size must be 256, 384 or 521, not %d (check ca_key_size and leaf_key_size)", size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown cert_key_type '%s' (use %s or %s)", keyType, certKeyRSA, certKeyECDSA)
+}
+
+func daysDuration(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// generateRootCA creates GeckoRootCA.key and GeckoRootCA.pem in sslBaseDir,
+// the same files the openssl-based setup produced.
+func generateRootCA() error {
+	caMu.Lock()
+	defer caMu.Unlock()
+	if _, err := os.Stat(caCertPath); err == nil {
+		return nil
+	}
+	fmt.Printf("%sGenerating new Gecko Root CA...%s\n", shared.ColorYellow, shared.ColorReset)
+	der, key, err := createRootCA()
+	if err != nil {
+		return err
+	}
+	if err := writeRootCA(der, key, CAKeyPlain, ""); err != nil {
+		return err
+	}
+	fmt.Printf("%sGecko Root CA created at %s%s\n", shared.ColorGreen, caCertPath, shared.ColorReset)
+	return nil
+}
+
+// createRootCA makes a new self-signed CA in memory.
+func createRootCA() ([]byte, crypto.Signer, error) {
+	settings := certSettings()
+	key, err := generateKey(settings.CertKeyType, settings.CAKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               geckoSubject(caCommonName),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(daysDuration(settings.CAValidityDays)),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, key, nil
+}
+
+// writeRootCA stores the key first, so a certificate on disk always has its
+// key next to it.
+func writeRootCA(der []byte, key crypto.Signer, protection, passphrase string) error {
+	keyPEM, err := encodeCAKey(key, protection, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(caKeyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(caCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// rootCA is the Gecko Root CA loaded into memory for signing.
+type rootCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func loadRootCA() (*rootCA, error) {
+	certPEM, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("Gecko Root CA not found. Please run 'Install Gecko Root CA' from the menu first")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", caCertPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Root CA certificate: %w", err)
+	}
+
+	key, err := readCAKey()
+	if err != nil {
+		return nil, err
+	}
+	return &rootCA{cert: cert, key: key}, nil
+}
+
+// parsePrivateKeyPEM accepts the PKCS#1 keys older openssl versions write as
+// well as the PKCS#8 keys written by OpenSSL 3.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it into
+// place, so a reader never sees a half-written certificate or key.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// issueLeafCert signs a server certificate for the given names. Names that
+// parse as IP addresses become IP SANs, everything else a DNS SAN.
+func (ca *rootCA) issueLeafCert(names ...string) (*tls.Certificate, error) {
+	settings := certSettings()
+	key, err := generateKey(settings.CertKeyType, settings.LeafKeySize)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := ca.signLeaf(key.Public(), names)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// signLeaf signs a server certificate for a public key generated elsewhere,
+// such as one from an ACME client's CSR.
+func (ca *rootCA) signLeaf(pub crypto.PublicKey, names []string) (*x509.Certificate, error) {
+	settings := certSettings()
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               geckoSubject(names[0]),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(daysDuration(settings.LeafValidityDays)),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	// Only RSA keys do key exchange by encryption.
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// signClient signs a TLS client certificate whose subject is commonName.
+func (ca *rootCA) signClient(pub crypto.PublicKey, commonName string) (*x509.Certificate, error) {
+	settings := certSettings()
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               geckoSubject(commonName),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(daysDuration(settings.LeafValidityDays)),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// generateCert signs a certificate for names in memory and writes the key and
+// certificate atomically. The first name becomes the subject.
+func generateCert(names []string, certOutPath, keyOutPath string) error {
+	ca, err := loadRootCA()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.issueLeafCert(names...)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKeyPEM(cert.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyOutPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certOutPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"gecko/internal/shared"
+	"gecko/internal/utils"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The Root CA key can be stored as plain PKCS#8, encrypted with DPAPI for the
+// current Windows user, or encrypted with a passphrase (PBKDF2-SHA256 and
+// AES-256-GCM). Protected keys use a PEM block of their own; the headers say
+// how to open it.
+const (
+	CAKeyPlain      = "none"
+	CAKeyDPAPI      = "dpapi"
+	CAKeyPassphrase = "passphrase"
+
+	protectedKeyPEMType  = "GECKO PROTECTED PRIVATE KEY"
+	caPassphraseEnv      = "GECKO_CA_PASSPHRASE"
+	caKeyPBKDF2Rounds    = 600000
+	caKeyMinPassphrase   = 8
+	protectionHeader     = "Protection"
+	kdfHeader            = "KDF"
+	saltHeader           = "Salt"
+	iterationsHeader     = "Iterations"
+	protectedKeyKDFValue = "pbkdf2-sha256"
+)
+
+var (
+	caKeyMu sync.Mutex
+	// caPassphrase is remembered for the life of the process once the key
+	// has been unlocked, so the front proxy can sign without prompting.
+	caPassphrase string
+)
+
+// caKeyProtection reports how the key on disk is stored.
+func caKeyProtection() (string, error) {
+	data, err := os.ReadFile(caKeyPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("%s does not contain a PEM key", caKeyPath)
+	}
+	if block.Type != protectedKeyPEMType {
+		return CAKeyPlain, nil
+	}
+	return block.Headers[protectionHeader], nil
+}
+
+// currentCAPassphrase returns the remembered passphrase or the one in
+// GECKO_CA_PASSPHRASE.
+func currentCAPassphrase() string {
+	caKeyMu.Lock()
+	defer caKeyMu.Unlock()
+	if caPassphrase != "" {
+		return caPassphrase
+	}
+	return os.Getenv(caPassphraseEnv)
+}
+
+// UnlockRootCAKey asks for the passphrase of a passphrase-protected Root CA
+// key so certificates can be signed later without a prompt. It does nothing
+// for other keys or when the passphrase is already known.
+func UnlockRootCAKey() error {
+	if protection, err := caKeyProtection(); err != nil || protection != CAKeyPassphrase {
+		return nil
+	}
+	if passphrase := currentCAPassphrase(); passphrase != "" {
+		if _, err := readCAKeyWith(passphrase); err == nil {
+			return nil
+		}
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		passphrase, err := utils.ReadPassword("Passphrase for the Gecko Root CA key (blank to skip): ")
+		if err != nil || passphrase == "" {
+			fmt.Printf("%sThe Root CA stays locked; new certificates cannot be signed until it is unlocked.%s\n", shared.ColorYellow, shared.ColorReset)
+			return nil
+		}
+		if _, err := readCAKeyWith(passphrase); err != nil {
+			fmt.Printf("%s%v%s\n", shared.ColorRed, err, shared.ColorReset)
+			continue
+		}
+		caKeyMu.Lock()
+		caPassphrase = passphrase
+		caKeyMu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("could not unlock the Root CA key")
+}
+
+func readCAKey() (crypto.Signer, error) {
+	return readCAKeyWith(currentCAPassphrase())
+}
+
+func readCAKeyWith(passphrase string) (crypto.Signer, error) {
+	data, err := os.ReadFile(caKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Root CA key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != protectedKeyPEMType {
+		key, err := parsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Root CA key: %w", err)
+		}
+		return key, nil
+	}
+
+	var der []byte
+	switch block.Headers[protectionHeader] {
+	case CAKeyDPAPI:
+		der, err = utils.UnprotectData(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Windows could not decrypt the Root CA key (it is tied to the user that protected it): %w", err)
+		}
+	case CAKeyPassphrase:
+		if passphrase == "" {
+			return nil, fmt.Errorf("the Root CA key is locked; unlock it from the menu or set %s", caPassphraseEnv)
+		}
+		der, err = openWithPassphrase(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown Root CA key protection %q", block.Headers[protectionHeader])
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Root CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// encodeCAKey renders key for disk with the given protection.
+func encodeCAKey(key crypto.Signer, protection, passphrase string) ([]byte, error) {
+	if protection == CAKeyPlain || protection == "" {
+		return encodePrivateKeyPEM(key)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: protectedKeyPEMType, Headers: map[string]string{protectionHeader: protection}}
+	switch protection {
+	case CAKeyDPAPI:
+		block.Bytes, err = utils.ProtectData(der)
+	case CAKeyPassphrase:
+		err = sealWithPassphrase(block, der, passphrase)
+	default:
+		err = fmt.Errorf("unknown key protection '%s' (choose %s, %s or %s)", protection, CAKeyPlain, CAKeyDPAPI, CAKeyPassphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+func passphraseAEAD(passphrase string, salt []byte, rounds int) (cipher.AEAD, error) {
+	aesKey, err := pbkdf2.Key(sha256.New, passphrase, salt, rounds, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithPassphrase stores the nonce in front of the ciphertext; the salt
+// and round count travel in the PEM headers.
+func sealWithPassphrase(block *pem.Block, der []byte, passphrase string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := passphraseAEAD(passphrase, salt, caKeyPBKDF2Rounds)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	block.Headers[kdfHeader] = protectedKeyKDFValue
+	block.Headers[iterationsHeader] = strconv.Itoa(caKeyPBKDF2Rounds)
+	block.Headers[saltHeader] = hex.EncodeToString(salt)
+	block.Bytes = aead.Seal(nonce, nonce, der, []byte(protectedKeyPEMType))
+	return nil
+}
+
+func openWithPassphrase(block *pem.Block, passphrase string) ([]byte, error) {
+	if block.Headers[kdfHeader] != protectedKeyKDFValue {
+		return nil, fmt.Errorf("unsupported key derivation %q", block.Headers[kdfHeader])
+	}
+	salt, err := hex.DecodeString(block.Headers[saltHeader])
+	if err != nil {
+		return nil, fmt.Errorf("corrupt Root CA key salt")
+	}
+	rounds, err := strconv.Atoi(block.Headers[iterationsHeader])
+	if err != nil || rounds < 1 {
+		return nil, fmt.Errorf("corrupt Root CA key iteration count")
+	}
+	aead, err := passphraseAEAD(passphrase, salt, rounds)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupt Root CA key")
+	}
+	nonce, sealed := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	der, err := aead.Open(nil, nonce, sealed, []byte(protectedKeyPEMType))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase for the Root CA key")
+	}
+	return der, nil
+}
+
+// askNewPassphrase prompts twice and enforces a minimum length.
+func askNewPassphrase() (string, error) {
+	passphrase, err := utils.ReadPassword("New passphrase for the Root CA key: ")
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) < caKeyMinPassphrase {
+		return "", fmt.Errorf("the passphrase must be at least %d characters", caKeyMinPassphrase)
+	}
+	confirm, err := utils.ReadPassword("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm != passphrase {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// ProtectRootCAKey re-encodes the Root CA key with the chosen protection.
+func ProtectRootCAKey(protection string) error {
+	caMu.Lock()
+	defer caMu.Unlock()
+	if protection != CAKeyPlain && protection != CAKeyDPAPI && protection != CAKeyPassphrase {
+		return fmt.Errorf("unknown key protection '%s' (choose %s, %s or %s)", protection, CAKeyPlain, CAKeyDPAPI, CAKeyPassphrase)
+	}
+	if err := UnlockRootCAKey(); err != nil {
+		return err
+	}
+	key, err := readCAKey()
+	if err != nil {
+		return err
+	}
+	passphrase := ""
+	if protection == CAKeyPassphrase {
+		if passphrase, err = askNewPassphrase(); err != nil {
+			return err
+		}
+	}
+	keyPEM, err := encodeCAKey(key, protection, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(caKeyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	caKeyMu.Lock()
+	caPassphrase = passphrase
+	caKeyMu.Unlock()
+
+	switch protection {
+	case CAKeyPlain:
+		fmt.Printf("%sThe Root CA key is now stored unencrypted.%s\n", shared.ColorYellow, shared.ColorReset)
+	case CAKeyDPAPI:
+		fmt.Printf("%sThe Root CA key is now encrypted for this Windows account.%s\n", shared.ColorGreen, shared.ColorReset)
+	case CAKeyPassphrase:
+		fmt.Printf("%sThe Root CA key is now passphrase-protected. Gecko asks for it at startup, or reads %s.%s\n", shared.ColorGreen, caPassphraseEnv, shared.ColorReset)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+)
+
+// RotateRootCA replaces the Gecko Root CA: the new one is written and checked
+// over the old key, every site certificate is re-issued by it, and it is
+// trusted in place of the old one. The key keeps its current protection.
+func RotateRootCA() error {
+	caMu.Lock()
+	defer caMu.Unlock()
+	oldCert, err := readCertificateFile(caCertPath)
+	if err != nil {
+		return fmt.Errorf("there is no Root CA to rotate; install one from the menu first")
+	}
+	oldCertPEM, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return err
+	}
+	oldKeyPEM, err := os.ReadFile(caKeyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	protection, err := caKeyProtection()
+	if err != nil {
+		protection = CAKeyPlain
+	}
+	// The old key is not needed to rotate, so a forgotten passphrase only
+	// means choosing a new one.
+	passphrase := ""
+	if protection == CAKeyPassphrase {
+		UnlockRootCAKey()
+		passphrase = currentCAPassphrase()
+		if _, err := readCAKeyWith(passphrase); err != nil {
+			fmt.Println("The old passphrase is not known; choose one for the new key.")
+			if passphrase, err = askNewPassphrase(); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("%sGenerating a new Gecko Root CA...%s\n", shared.ColorYellow, shared.ColorReset)
+	der, key, err := createRootCA()
+	if err != nil {
+		return err
+	}
+
+	// The new CA is stored and checked before any trust store changes, so a
+	// failure leaves the machine trusting the old one as before.
+	restoreOld := func() {
+		writeFileAtomic(caCertPath, oldCertPEM, 0644)
+		if oldKeyPEM != nil {
+			writeFileAtomic(caKeyPath, oldKeyPEM, 0600)
+		}
+	}
+	if err := writeRootCA(der, key, protection, passphrase); err != nil {
+		restoreOld()
+		return fmt.Errorf("could not store the new Root CA, the old one was kept: %w", err)
+	}
+	if err := verifyStoredRootCA(der, passphrase); err != nil {
+		restoreOld()
+		return fmt.Errorf("the new Root CA did not read back correctly, the old one was kept: %w", err)
+	}
+	caKeyMu.Lock()
+	caPassphrase = passphrase
+	caKeyMu.Unlock()
+	if err := RefreshClientCRL(true); err != nil {
+		fmt.Printf("%sCould not re-sign the client CRL: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	resetFrontProxyCertificates()
+	fmt.Printf("%sNew Gecko Root CA written to %s%s\n", shared.ColorGreen, caCertPath, shared.ColorReset)
+
+	if err := RenewCertificates(nil, true); err != nil {
+		fmt.Printf("%sError re-issuing certificates: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+
+	fmt.Printf("%sTrusting the new Root CA...%s\n", shared.ColorYellow, shared.ColorReset)
+	failed := updateTrustStores(trustStores, true)
+	// The other stores keep the CA under a fixed name, so installing the new
+	// one replaced the old there; Windows keys it by serial number.
+	fmt.Printf("%sRemoving the old Root CA from the Windows store...%s\n", shared.ColorYellow, shared.ColorReset)
+	if err := removeCertFromWindows(oldCert); err != nil {
+		fmt.Printf("%sThe old CA is still trusted by Windows; remove serial %X with certmgr.msc: %v%s\n", shared.ColorYellow, oldCert.SerialNumber, err, shared.ColorReset)
+	}
+
+	fmt.Printf("%sRoot CA rotated. The old CA (serial %X) can no longer sign anything.%s\n", shared.ColorGreen, oldCert.SerialNumber, shared.ColorReset)
+	fmt.Println("Phones and other devices that installed the old CA still trust it; remove it there and use 'gecko certs share' to install the new one.")
+	if anyVHostRequiresClientCert() {
+		fmt.Println("Client certificates from the old CA are no longer accepted; issue new ones with 'gecko certs client issue'.")
+	}
+	if failed > 0 {
+		return fmt.Errorf("the new CA could not be installed in %d store(s); run 'gecko certs trust' to retry", failed)
+	}
+	return nil
+}
+
+// verifyStoredRootCA reads the CA back from disk and checks that it is the
+// certificate just created and that the key matches it.
+func verifyStoredRootCA(der []byte, passphrase string) error {
+	cert, err := readCertificateFile(caCertPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Raw, der) {
+		return fmt.Errorf("%s does not hold the new certificate", caCertPath)
+	}
+	key, err := readCAKeyWith(passphrase)
+	if err != nil {
+		return err
+	}
+	if public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(cert.PublicKey) {
+		return fmt.Errorf("%s does not match the new certificate", caKeyPath)
+	}
+	return nil
+}
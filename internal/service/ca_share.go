@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"gecko/internal/shared"
+	"gecko/internal/utils"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+const defaultCAServerPort = "8020"
+
+// caShareFiles are served under /ca/ as name -> content type.
+var caShareFiles = map[string]string{
+	"gecko-root-ca.pem":          "application/x-pem-file",
+	"gecko-root-ca.crt":          "application/x-x509-ca-cert",
+	"gecko-root-ca.mobileconfig": "application/x-apple-aspen-config",
+}
+
+var caSharePage = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Gecko Root CA</title>
+<style>body{font-family:system-ui,sans-serif;max-width:36em;margin:1.5em auto;padding:0 1em;line-height:1.5}
+a.button{display:block;padding:.8em;margin:.6em 0;background:#2e7d32;color:#fff;text-decoration:none;border-radius:6px;text-align:center}
+code{font-size:.85em;word-break:break-all}</style></head>
+<body>
+<h1>Gecko Root CA</h1>
+<p>Install this certificate to trust HTTPS sites served by Gecko on {{.Host}}.</p>
+<p><small>SHA-256 fingerprint:<br><code>{{.Fingerprint}}</code></small></p>
+<h2>iPhone / iPad</h2>
+<a class="button" href="/ca/gecko-root-ca.mobileconfig">Download profile</a>
+<p>Open <b>Settings &rsaquo; Profile Downloaded</b> and install it, then turn on full trust under
+<b>Settings &rsaquo; General &rsaquo; About &rsaquo; Certificate Trust Settings</b>.</p>
+<h2>Android</h2>
+<a class="button" href="/ca/gecko-root-ca.crt">Download certificate</a>
+<p>Open <b>Settings &rsaquo; Security &rsaquo; More security settings &rsaquo; Install from storage &rsaquo; CA certificate</b>
+and pick the downloaded file. Chrome on Android trusts user CAs; apps only do if they opt in.</p>
+<h2>Other devices</h2>
+<a class="button" href="/ca/gecko-root-ca.pem">Download PEM</a>
+</body></html>`))
+
+// startCAShare serves the Gecko Root CA on the LAN so phones and tablets can
+// install it, and prints a QR code of the address.
+func startCAShare(port string) (*http.Server, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !config.DevelopmentMode {
+		return nil, fmt.Errorf("other devices can only reach this machine in Development Mode; turn it on first")
+	}
+	cert, err := readCertificateFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("the Gecko Root CA has not been generated yet")
+	}
+	lanIPs := getLANIPs()
+	if len(lanIPs) == 0 {
+		return nil, fmt.Errorf("no LAN address found on this machine")
+	}
+	if port == "" {
+		port = defaultCAServerPort
+	}
+
+	pemData, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(cert.Raw)
+	files := map[string][]byte{
+		"gecko-root-ca.pem":          pemData,
+		"gecko-root-ca.crt":          cert.Raw,
+		"gecko-root-ca.mobileconfig": caMobileConfig(cert.Raw, sum),
+	}
+
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on port %s: %w", port, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ca", http.StatusFound)
+	})
+	mux.HandleFunc("/ca", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		caSharePage.Execute(w, map[string]string{"Host": r.Host, "Fingerprint": formatFingerprint(sum[:])})
+	})
+	mux.HandleFunc("/ca/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len("/ca/"):]
+		data, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Printf("%s%s downloaded %s%s\n", shared.ColorGreen, r.RemoteAddr, name, shared.ColorReset)
+		w.Header().Set("Content-Type", caShareFiles[name])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Write(data)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(ln)
+
+	url := fmt.Sprintf("http://%s/ca", net.JoinHostPort(lanIPs[0].String(), port))
+	if modules, err := utils.EncodeQR(url); err == nil {
+		fmt.Print(utils.QRToTerminal(modules))
+	}
+	fmt.Printf("%sScan the code, or open %s on the device.%s\n", shared.ColorGreen, url, shared.ColorReset)
+	for _, ip := range lanIPs[1:] {
+		fmt.Printf("  Also reachable at http://%s/ca\n", net.JoinHostPort(ip.String(), port))
+	}
+	fmt.Printf("Fingerprint (SHA-256): %s\n", formatFingerprint(sum[:]))
+	fmt.Println("Allow Gecko through the Windows Firewall if the page does not load.")
+	return server, nil
+}
+
+// ShareRootCAUntilEnter is the menu entry: it serves until Enter is pressed.
+func ShareRootCAUntilEnter(reader *bufio.Reader) {
+	server, err := startCAShare("")
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		fmt.Println("\nPress Enter to continue...")
+		reader.ReadString('\n')
+		return
+	}
+	fmt.Println("\nPress Enter to stop sharing...")
+	reader.ReadString('\n')
+	server.Close()
+}
+
+// ShareRootCAUntilInterrupt is the CLI entry: it serves until Ctrl+C.
+func ShareRootCAUntilInterrupt(port string) error {
+	server, err := startCAShare(port)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Press Ctrl+C to stop.")
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	return server.Close()
+}
+
+func formatFingerprint(sum []byte) string {
+	out := make([]byte, 0, len(sum)*3)
+	for i, b := range sum {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, fmt.Sprintf("%02X", b)...)
+	}
+	return string(out)
+}
+
+// caMobileConfig wraps the CA in an iOS configuration profile. The UUIDs are
+// derived from the certificate so reinstalling replaces the old profile.
+func caMobileConfig(der []byte, sum [32]byte) []byte {
+	uuid := func(salt byte) string {
+		b := sum
+		b[0] ^= salt
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>gecko-root-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>dev.gecko.rootca.cert</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDescription</key>
+	<string>Trusts HTTPS sites served by Gecko on your development machine.</string>
+	<key>PayloadDisplayName</key>
+	<string>%s</string>
+	<key>PayloadIdentifier</key>
+	<string>dev.gecko.rootca</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(der), caCommonName, uuid(1), caCommonName, uuid(2)))
+}
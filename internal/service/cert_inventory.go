@@ -0,0 +1,247 @@
+package service
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// certRenewWindow is how close to expiry a certificate must be before Gecko
+// warns about it and "gecko certs renew" picks it up.
+const certRenewWindow = 30 * 24 * time.Hour
+
+const (
+	certOwnerRootCA  = "(root CA)"
+	certOwnerDefault = "localhost"
+)
+
+type certInfo struct {
+	Path     string
+	Owner    string
+	Orphan   bool
+	Subject  string
+	Issuer   string
+	SANs     []string
+	NotAfter time.Time
+	// ForeignCA is set for leaf certificates the current Root CA did not sign.
+	ForeignCA bool
+}
+
+func (c *certInfo) expiresWithin(d time.Duration) bool {
+	return time.Until(c.NotAfter) < d
+}
+
+func readCertificateFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// collectCertificates reads the Root CA, the default localhost certificate
+// and every site certificate.
+func collectCertificates() ([]*certInfo, error) {
+	var caCert *x509.Certificate
+	var certs []*certInfo
+	if cert, err := readCertificateFile(caCertPath); err == nil {
+		caCert = cert
+		certs = append(certs, newCertInfo(caCertPath, certOwnerRootCA, cert, nil))
+	}
+	if cert, err := readCertificateFile(defaultCertPath); err == nil {
+		certs = append(certs, newCertInfo(defaultCertPath, certOwnerDefault, cert, caCert))
+	}
+
+	files, err := os.ReadDir(vhostCertsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".crt") {
+			continue
+		}
+		path := filepath.Join(vhostCertsDir, file.Name())
+		cert, err := readCertificateFile(path)
+		if err != nil {
+			fmt.Printf("%sSkipping %s: %v%s\n", shared.ColorYellow, path, err, shared.ColorReset)
+			continue
+		}
+		domain := strings.TrimSuffix(file.Name(), ".crt")
+		info := newCertInfo(path, domain, cert, caCert)
+		info.Orphan = !VirtualHostExists(domain)
+		certs = append(certs, info)
+	}
+	return certs, nil
+}
+
+func newCertInfo(path, owner string, cert, caCert *x509.Certificate) *certInfo {
+	info := &certInfo{
+		Path:     path,
+		Owner:    owner,
+		Subject:  cert.Subject.CommonName,
+		Issuer:   cert.Issuer.CommonName,
+		NotAfter: cert.NotAfter,
+		SANs:     append([]string{}, cert.DNSNames...),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	if caCert != nil {
+		info.ForeignCA = cert.CheckSignatureFrom(caCert) != nil
+	}
+	return info
+}
+
+func ListCertificates() error {
+	certs, err := collectCertificates()
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		fmt.Printf("%sNo certificates found. Install the Gecko Root CA from the menu first.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	for _, c := range certs {
+		color, state := shared.ColorGreen, "valid"
+		left := time.Until(c.NotAfter)
+		switch {
+		case left <= 0:
+			color, state = shared.ColorRed, "EXPIRED"
+		case left < certRenewWindow:
+			color, state = shared.ColorYellow, "expiring soon"
+		}
+		owner := c.Owner
+		if c.Orphan {
+			owner += " (no such vhost)"
+		}
+		fmt.Printf("%s%s%s\n", shared.ColorGreen, owner, shared.ColorReset)
+		fmt.Printf("  File:    %s\n", c.Path)
+		if len(c.SANs) > 0 {
+			fmt.Printf("  Names:   %s\n", strings.Join(c.SANs, ", "))
+		} else {
+			fmt.Printf("  Subject: %s\n", c.Subject)
+		}
+		issuer := c.Issuer
+		if c.ForeignCA {
+			issuer += " (not signed by the current Gecko Root CA)"
+		}
+		fmt.Printf("  Issuer:  %s\n", issuer)
+		fmt.Printf("  Expires: %s%s, %s (%s)%s\n", color, c.NotAfter.Local().Format("2006-01-02"), state, formatTimeLeft(left), shared.ColorReset)
+	}
+	return nil
+}
+
+func formatTimeLeft(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	switch {
+	case d <= 0:
+		return fmt.Sprintf("%d days ago", -days)
+	case days == 0:
+		return "today"
+	case days == 1:
+		return "1 day left"
+	}
+	return fmt.Sprintf("%d days left", days)
+}
+
+// ExpiringCertificates returns the owners of certificates that have expired or
+// will within certRenewWindow, for the startup warning. The Root CA is left
+// out because renewing cannot replace it; see RootCAExpiry.
+func ExpiringCertificates() []string {
+	certs, err := collectCertificates()
+	if err != nil {
+		return nil
+	}
+	var owners []string
+	for _, c := range certs {
+		if c.expiresWithin(certRenewWindow) && !c.Orphan && c.Owner != certOwnerRootCA {
+			owners = append(owners, fmt.Sprintf("%s (%s)", c.Owner, formatTimeLeft(time.Until(c.NotAfter))))
+		}
+	}
+	return owners
+}
+
+// RootCAExpiry returns when the Root CA expires and whether that is within
+// certRenewWindow, in which case only 'gecko ca rotate' helps.
+func RootCAExpiry() (time.Time, bool) {
+	cert, err := readCertificateFile(caCertPath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return cert.NotAfter, time.Until(cert.NotAfter) < certRenewWindow
+}
+
+// RenewCertificates re-issues site certificates and reloads the web server.
+// targets may name sites (or "localhost"); with none, every certificate
+// within certRenewWindow of expiry is renewed, and with all set every one.
+func RenewCertificates(targets []string, all bool) error {
+	certs, err := collectCertificates()
+	if err != nil {
+		return err
+	}
+	byOwner := make(map[string]*certInfo)
+	for _, c := range certs {
+		byOwner[c.Owner] = c
+	}
+
+	var renew []*certInfo
+	switch {
+	case len(targets) > 0:
+		for _, target := range targets {
+			target = strings.ToLower(strings.TrimSpace(target))
+			c, ok := byOwner[target]
+			if !ok || target == certOwnerRootCA {
+				return fmt.Errorf("no certificate found for '%s'", target)
+			}
+			renew = append(renew, c)
+		}
+	default:
+		for _, c := range certs {
+			if c.Owner != certOwnerRootCA && !c.Orphan && (all || c.expiresWithin(certRenewWindow) || c.ForeignCA) {
+				renew = append(renew, c)
+			}
+		}
+	}
+	if ca, ok := byOwner[certOwnerRootCA]; ok && ca.expiresWithin(certRenewWindow) {
+		fmt.Printf("%sThe Gecko Root CA itself expires on %s; renewed certificates cannot outlive it.%s\n", shared.ColorYellow, ca.NotAfter.Local().Format("2006-01-02"), shared.ColorReset)
+	}
+	if len(renew) == 0 {
+		fmt.Printf("%sNo certificates need renewing.%s\n", shared.ColorGreen, shared.ColorReset)
+		return nil
+	}
+
+	sort.Slice(renew, func(i, j int) bool { return renew[i].Owner < renew[j].Owner })
+	renewed := 0
+	for _, c := range renew {
+		fmt.Printf("%sRenewing certificate for %s...%s\n", shared.ColorYellow, c.Owner, shared.ColorReset)
+		var err error
+		if c.Owner == certOwnerDefault {
+			err = generateCert(certNamesFor("localhost"), defaultCertPath, defaultKeyPath)
+		} else {
+			err = GenerateVHostCert(c.Owner)
+		}
+		if err != nil {
+			fmt.Printf("%sCould not renew %s: %v%s\n", shared.ColorRed, c.Owner, err, shared.ColorReset)
+			continue
+		}
+		renewed++
+	}
+	if renewed == 0 {
+		return fmt.Errorf("no certificate could be renewed")
+	}
+	if IsWebServerRunning() {
+		ReloadWebServer()
+	}
+	fmt.Printf("%sRenewed %d certificate(s).%s\n", shared.ColorGreen, renewed, shared.ColorReset)
+	return nil
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"gecko/internal/shared"
+	"gecko/internal/utils"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	clientCertsDir  = `C:\Gecko\etc\ssl\clients`
+	clientIndexPath = `C:\Gecko\etc\ssl\clients\index.json`
+	clientCRLPath   = `C:\Gecko\etc\ssl\GeckoRootCA.crl`
+	// The CRL is re-signed at startup once it is within certRenewWindow of
+	// expiring; Apache and nginx reject every client once it has expired.
+	clientCRLValidity = 90 * 24 * time.Hour
+)
+
+var clientNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// clientCertRecord tracks an issued client certificate so it can be listed
+// and revoked. Serial is upper-case hex.
+type clientCertRecord struct {
+	Name      string     `json:"name"`
+	Serial    string     `json:"serial"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type clientCertIndex struct {
+	CRLNumber int64               `json:"crl_number"`
+	Certs     []*clientCertRecord `json:"certs"`
+}
+
+func loadClientIndex() (*clientCertIndex, error) {
+	index := &clientCertIndex{}
+	data, err := os.ReadFile(clientIndexPath)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate index: %w", err)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate index: %w", err)
+	}
+	return index, nil
+}
+
+func saveClientIndex(index *clientCertIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(clientIndexPath, data, 0644)
+}
+
+// active returns the unrevoked certificate issued to name, if any.
+func (index *clientCertIndex) active(name string) *clientCertRecord {
+	for _, record := range index.Certs {
+		if strings.EqualFold(record.Name, name) && record.RevokedAt == nil {
+			return record
+		}
+	}
+	return nil
+}
+
+func clientCertPaths(name string) (certPath, keyPath, bundlePath string) {
+	base := filepath.Join(clientCertsDir, name)
+	return base + ".crt", base + ".key", base + ".p12"
+}
+
+// IssueClientCert signs a client certificate for name and writes it as PEM
+// files and as a PKCS#12 bundle for browsers. A random bundle password is
+// generated when none is given.
+func IssueClientCert(name, password string) error {
+	name = strings.TrimSpace(name)
+	if !clientNamePattern.MatchString(name) {
+		return fmt.Errorf("'%s' is not a valid client name (letters, digits, '.', '_', '@' and '-')", name)
+	}
+	index, err := loadClientIndex()
+	if err != nil {
+		return err
+	}
+	if index.active(name) != nil {
+		return fmt.Errorf("'%s' already has a certificate; revoke it first with 'gecko certs client revoke %s'", name, name)
+	}
+	ca, err := loadRootCA()
+	if err != nil {
+		return err
+	}
+	settings := certSettings()
+	key, err := generateKey(settings.CertKeyType, settings.LeafKeySize)
+	if err != nil {
+		return err
+	}
+	cert, err := ca.signClient(key.Public(), name)
+	if err != nil {
+		return err
+	}
+
+	generated := password == ""
+	if generated {
+		if password, err = generateRandomPassword(16); err != nil {
+			return err
+		}
+	}
+	bundle, err := utils.EncodePKCS12(key, cert, []*x509.Certificate{ca.cert}, "Gecko client: "+name, password)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath, bundlePath := clientCertPaths(name)
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(bundlePath, bundle, 0600); err != nil {
+		return err
+	}
+
+	index.Certs = append(index.Certs, &clientCertRecord{
+		Name:     name,
+		Serial:   fmt.Sprintf("%X", cert.SerialNumber),
+		NotAfter: cert.NotAfter,
+	})
+	if err := saveClientIndex(index); err != nil {
+		return err
+	}
+	if err := ensureClientCRL(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%sClient certificate for '%s' issued (serial %X).%s\n", shared.ColorGreen, name, cert.SerialNumber, shared.ColorReset)
+	fmt.Printf("  Certificate: %s\n", certPath)
+	fmt.Printf("  Key:         %s\n", keyPath)
+	fmt.Printf("  Bundle:      %s (import into a browser or the Windows certificate store)\n", bundlePath)
+	if generated {
+		fmt.Printf("  Bundle password: %s%s%s\n", shared.ColorYellow, password, shared.ColorReset)
+	}
+	fmt.Printf("  curl --cert %s --key %s https://<site>\n", certPath, keyPath)
+	return nil
+}
+
+func ListClientCerts() error {
+	index, err := loadClientIndex()
+	if err != nil {
+		return err
+	}
+	if len(index.Certs) == 0 {
+		fmt.Printf("%sNo client certificates issued yet. Use 'gecko certs client issue <name>'.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	caCert, _ := readCertificateFile(caCertPath)
+	for _, record := range index.Certs {
+		color, state := shared.ColorGreen, "valid"
+		left := time.Until(record.NotAfter)
+		switch {
+		case record.RevokedAt != nil:
+			color, state = shared.ColorRed, "REVOKED "+record.RevokedAt.Local().Format("2006-01-02")
+		case left <= 0:
+			color, state = shared.ColorRed, "EXPIRED"
+		case caCert != nil && !clientCertFromCA(record.Name, caCert):
+			color, state = shared.ColorYellow, "issued by an old Root CA"
+		case left < certRenewWindow:
+			color, state = shared.ColorYellow, "expiring soon"
+		}
+		fmt.Printf("%s%s%s\n", shared.ColorGreen, record.Name, shared.ColorReset)
+		fmt.Printf("  Serial:  %s\n", record.Serial)
+		fmt.Printf("  Expires: %s%s, %s (%s)%s\n", color, record.NotAfter.Local().Format("2006-01-02"), state, formatTimeLeft(left), shared.ColorReset)
+	}
+	return nil
+}
+
+// clientCertFromCA reports whether the certificate on disk for name was
+// signed by caCert. A missing file counts as signed, since there is nothing
+// better to show.
+func clientCertFromCA(name string, caCert *x509.Certificate) bool {
+	certPath, _, _ := clientCertPaths(name)
+	cert, err := readCertificateFile(certPath)
+	return err != nil || cert.CheckSignatureFrom(caCert) == nil
+}
+
+// RevokeClientCert revokes the active certificate of a client, given its
+// name or serial, and publishes a new CRL.
+func RevokeClientCert(nameOrSerial string) error {
+	index, err := loadClientIndex()
+	if err != nil {
+		return err
+	}
+	record := index.active(nameOrSerial)
+	if record == nil {
+		for _, r := range index.Certs {
+			if strings.EqualFold(r.Serial, nameOrSerial) {
+				record = r
+			}
+		}
+	}
+	if record == nil {
+		return fmt.Errorf("no client certificate named or numbered '%s'", nameOrSerial)
+	}
+	if record.RevokedAt != nil {
+		return fmt.Errorf("the certificate %s of '%s' is already revoked", record.Serial, record.Name)
+	}
+	now := time.Now().UTC()
+	record.RevokedAt = &now
+	if err := writeClientCRL(index); err != nil {
+		return err
+	}
+	fmt.Printf("%sRevoked the certificate of '%s' (serial %s).%s\n", shared.ColorGreen, record.Name, record.Serial, shared.ColorReset)
+	// Apache and nginx only read the CRL when they (re)load.
+	if IsWebServerRunning() && anyVHostRequiresClientCert() {
+		ReloadWebServer()
+	}
+	return nil
+}
+
+// writeClientCRL signs a CRL of the revoked client certificates with the
+// current Root CA and bumps its number.
+func writeClientCRL(index *clientCertIndex) error {
+	ca, err := loadRootCA()
+	if err != nil {
+		return err
+	}
+	var revoked []x509.RevocationListEntry
+	for _, record := range index.Certs {
+		if record.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(record.Serial, 16)
+		if !ok {
+			continue
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *record.RevokedAt})
+	}
+	index.CRLNumber++
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(index.CRLNumber),
+		ThisUpdate:                now.Add(-time.Hour),
+		NextUpdate:                now.Add(clientCRLValidity),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		if ca.cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+			return fmt.Errorf("the Root CA may not sign CRLs; replace it with 'gecko ca rotate' first")
+		}
+		return fmt.Errorf("could not sign the client CRL: %w", err)
+	}
+	if err := writeFileAtomic(clientCRLPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return saveClientIndex(index)
+}
+
+// ensureClientCRL writes a first CRL, which the web server config of a site
+// requiring client certificates points at.
+func ensureClientCRL() error {
+	if _, err := os.Stat(clientCRLPath); !os.IsNotExist(err) {
+		return nil
+	}
+	index, err := loadClientIndex()
+	if err != nil {
+		return err
+	}
+	return writeClientCRL(index)
+}
+
+// RefreshClientCRL re-signs the CRL when it is close to expiring or was
+// signed by another Root CA. It does nothing if no CRL was ever written.
+func RefreshClientCRL(force bool) error {
+	data, err := os.ReadFile(clientCRLPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !force {
+		block, _ := pem.Decode(data)
+		if block != nil {
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			caCert, caErr := readCertificateFile(caCertPath)
+			if err == nil && caErr == nil && crl.CheckSignatureFrom(caCert) == nil && time.Until(crl.NextUpdate) > certRenewWindow {
+				return nil
+			}
+		}
+	}
+	index, err := loadClientIndex()
+	if err != nil {
+		return err
+	}
+	return writeClientCRL(index)
+}
+
+// revokedClientSerials returns the serials on the CRL, for the front proxy.
+func revokedClientSerials() map[string]bool {
+	revoked := make(map[string]bool)
+	data, err := os.ReadFile(clientCRLPath)
+	if err != nil {
+		return revoked
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return revoked
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return revoked
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[fmt.Sprintf("%X", entry.SerialNumber)] = true
+	}
+	return revoked
+}
+
+// SetVHostClientAuth turns client certificate checks on or off for a site's
+// HTTPS traffic, and sends its plain HTTP traffic to HTTPS. Only certificates
+// from the Gecko Root CA that are not on its CRL are accepted.
+func SetVHostClientAuth(domainName string, require bool) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	if vhost.ClientAuth == require {
+		if require {
+			return fmt.Errorf("%s already requires a client certificate", vhost.Domain)
+		}
+		return fmt.Errorf("%s does not require a client certificate", vhost.Domain)
+	}
+	if require {
+		if !isSSLEnabled() {
+			return fmt.Errorf("install the Gecko Root CA from the menu first")
+		}
+		if err := ensureClientCRL(); err != nil {
+			return err
+		}
+	}
+	vhost.ClientAuth = require
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	if err := applyVHostConfig(vhost.Domain); err != nil {
+		return err
+	}
+	if !require {
+		fmt.Printf("%s%s no longer asks for a client certificate.%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+		return nil
+	}
+	fmt.Printf("%shttps://%s now requires a client certificate from the Gecko Root CA.%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+	if !frontProxyEnabled() && !vhostHasCert(vhost.Domain) {
+		fmt.Printf("%sThe site has no SSL certificate yet, so this takes effect once it gets one.%s\n", shared.ColorYellow, shared.ColorReset)
+	}
+	fmt.Println("Plain HTTP requests are redirected to HTTPS. Issue certificates with 'gecko certs client issue <name>'.")
+	return nil
+}
+
+// rewriteClientAuthVHosts re-renders the sites that require a client
+// certificate, since their plain HTTP side depends on the ports and on the
+// front proxy. Callers test and reload the web server.
+func rewriteClientAuthVHosts() bool {
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return false
+	}
+	for _, vhost := range registry {
+		if !vhost.ClientAuth || vhostConfigPath(vhost.Domain) == "" {
+			continue
+		}
+		if err := rewriteVHostFile(vhost.Domain); err != nil {
+			fmt.Printf("%sError updating %s: %v%s\n", shared.ColorRed, vhost.Domain, err, shared.ColorReset)
+			return false
+		}
+	}
+	return true
+}
+
+func anyVHostRequiresClientCert() bool {
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return false
+	}
+	for _, vhost := range registry {
+		if vhost.ClientAuth {
+			return true
+		}
+	}
+	return false
+}
@@ -12,12 +12,39 @@ const (
 )
 
 type Config struct {
-	ApachePort       string `json:"apache_port"`
-	ApacheSSLPort    string `json:"apache_ssl_port"`
-	MySQLPort        string `json:"mysql_port"`
-	PostgresPort     string `json:"postgres_port"`
-	PostgresPassword string `json:"postgres_password"`
-	DevelopmentMode  bool   `json:"development_mode"`
+	ApachePort          string `json:"apache_port"`
+	ApacheSSLPort       string `json:"apache_ssl_port"`
+	MySQLPort           string `json:"mysql_port"`
+	PostgresPort        string `json:"postgres_port"`
+	PostgresPassword    string `json:"postgres_password"`
+	MySQLRootPassword   string `json:"mysql_root_password"`
+	DevelopmentMode     bool   `json:"development_mode"`
+	DefaultDomainSuffix string `json:"default_domain_suffix"`
+	DNSResolverEnabled  bool   `json:"dns_resolver_enabled"`
+	DNSUpstream         string `json:"dns_upstream"`
+	WebServer           string `json:"web_server"`
+	PHPFastCGIPort      string `json:"php_fastcgi_port"`
+	FrontProxyEnabled   bool   `json:"front_proxy_enabled"`
+	BackendHTTPPort     string `json:"backend_http_port"`
+	BackendSSLPort      string `json:"backend_ssl_port"`
+	MailCatcherEnabled  bool   `json:"mail_catcher_enabled"`
+	MailSMTPPort        string `json:"mail_smtp_port"`
+	MailHTTPPort        string `json:"mail_http_port"`
+	ACMEServerEnabled   bool   `json:"acme_server_enabled"`
+	ACMEPort            string `json:"acme_port"`
+	// ACMEListenLAN lets other machines use the ACME server; it only ever
+	// listens on loopback otherwise, Development Mode or not.
+	ACMEListenLAN bool `json:"acme_listen_lan"`
+	// Certificate settings; see certSettings for how they are applied.
+	CertCountry      string `json:"cert_country"`
+	CertProvince     string `json:"cert_province"`
+	CertLocality     string `json:"cert_locality"`
+	CertOrganization string `json:"cert_organization"`
+	CertKeyType      string `json:"cert_key_type"`
+	CAKeySize        int    `json:"ca_key_size"`
+	LeafKeySize      int    `json:"leaf_key_size"`
+	CAValidityDays   int    `json:"ca_validity_days"`
+	LeafValidityDays int    `json:"leaf_validity_days"`
 }
 
 var globalConfig *Config
@@ -26,13 +53,24 @@ func LoadConfig() (*Config, error) {
 	if _, err := os.Stat(geckoConfigPath); os.IsNotExist(err) {
 		fmt.Printf("%sConfig file not found. Creating a default one at %s...%s\n", shared.ColorYellow, geckoConfigPath, shared.ColorReset)
 		defaultConfig := &Config{
-			ApachePort:       "80",
-			ApacheSSLPort:    "443",
-			MySQLPort:        "3306",
-			PostgresPort:     "5432",
-			PostgresPassword: "",
-			DevelopmentMode:  false,
+			ApachePort:          "80",
+			ApacheSSLPort:       "443",
+			MySQLPort:           "3306",
+			PostgresPort:        "5432",
+			PostgresPassword:    "",
+			MySQLRootPassword:   "",
+			DevelopmentMode:     false,
+			DefaultDomainSuffix: defaultDomainSuffix,
+			DNSUpstream:         defaultDNSUpstream,
+			WebServer:           webServerApache,
+			PHPFastCGIPort:      defaultFastCGIPort,
+			BackendHTTPPort:     defaultBackendHTTPPort,
+			BackendSSLPort:      defaultBackendSSLPort,
+			MailSMTPPort:        defaultMailSMTPPort,
+			MailHTTPPort:        defaultMailHTTPPort,
+			ACMEPort:            defaultACMEPort,
 		}
+		applyCertDefaults(defaultConfig)
 		if err := SaveConfig(defaultConfig); err != nil {
 			return nil, fmt.Errorf("failed to create default config: %w", err)
 		}
@@ -55,6 +93,56 @@ func LoadConfig() (*Config, error) {
 		SaveConfig(&config)
 	}
 
+	if config.DefaultDomainSuffix == "" {
+		config.DefaultDomainSuffix = defaultDomainSuffix
+		SaveConfig(&config)
+	}
+
+	if config.DNSUpstream == "" {
+		config.DNSUpstream = defaultDNSUpstream
+		SaveConfig(&config)
+	}
+
+	if config.WebServer == "" || config.PHPFastCGIPort == "" {
+		if config.WebServer == "" {
+			config.WebServer = webServerApache
+		}
+		if config.PHPFastCGIPort == "" {
+			config.PHPFastCGIPort = defaultFastCGIPort
+		}
+		SaveConfig(&config)
+	}
+
+	if config.BackendHTTPPort == "" || config.BackendSSLPort == "" {
+		if config.BackendHTTPPort == "" {
+			config.BackendHTTPPort = defaultBackendHTTPPort
+		}
+		if config.BackendSSLPort == "" {
+			config.BackendSSLPort = defaultBackendSSLPort
+		}
+		SaveConfig(&config)
+	}
+
+	if config.MailSMTPPort == "" || config.MailHTTPPort == "" {
+		if config.MailSMTPPort == "" {
+			config.MailSMTPPort = defaultMailSMTPPort
+		}
+		if config.MailHTTPPort == "" {
+			config.MailHTTPPort = defaultMailHTTPPort
+		}
+		SaveConfig(&config)
+	}
+
+	if config.ACMEPort == "" {
+		config.ACMEPort = defaultACMEPort
+		SaveConfig(&config)
+	}
+
+	if applyCertDefaults(&config) {
+		SaveConfig(&config)
+	}
+	checkCertKeyType(&config)
+
 	globalConfig = &config
 	return &config, nil
 }
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A database created by Gecko gets a user of the same name that can only
+// reach that database. Linking it to a site records the credentials in the
+// registry, which hands them to PHP as DB_* variables.
+
+// mysqlMaxUserLength is MySQL's limit; MariaDB allows longer user names.
+const mysqlMaxUserLength = 32
+
+var (
+	nonIdentifierChars = regexp.MustCompile(`[^a-z0-9_]+`)
+	systemDatabases    = map[string]bool{
+		"mysql": true, "information_schema": true, "performance_schema": true, "sys": true,
+		"postgres": true, "template0": true, "template1": true,
+	}
+	// reservedDatabaseUsers are accounts the servers themselves rely on. A
+	// database named after one would otherwise create, or later drop, it.
+	reservedDatabaseUsers = map[string]bool{
+		"root": true, "mysql.sys": true, "mariadb.sys": true, "postgres": true,
+	}
+)
+
+// normalizeDBEngine accepts the names people commonly type for each engine.
+func normalizeDBEngine(engine string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(engine)) {
+	case "", "mysql", "mariadb":
+		return "mysql", nil
+	case "postgres", "postgresql", "pgsql", "pg":
+		return "postgres", nil
+	}
+	return "", fmt.Errorf("unknown database engine '%s' (use mysql or postgres)", engine)
+}
+
+func dbEngineName(engine string) string {
+	if engine == "postgres" {
+		return "PostgreSQL"
+	}
+	return "MySQL"
+}
+
+func requireDBServer(engine string) error {
+	process := "mysqld.exe"
+	if engine == "postgres" {
+		process = "postgres.exe"
+	}
+	if !IsServiceRunning(process) {
+		return fmt.Errorf("%s is not running. Please start it first", dbEngineName(engine))
+	}
+	return nil
+}
+
+// DatabaseNameFor derives a database name from a site's first label, e.g.
+// "my-shop.test" becomes "my_shop".
+func DatabaseNameFor(domainName string) string {
+	label, _, _ := strings.Cut(strings.ToLower(domainName), ".")
+	name := strings.Trim(nonIdentifierChars.ReplaceAllString(label, "_"), "_")
+	if len(name) > mysqlMaxUserLength {
+		name = name[:mysqlMaxUserLength]
+	}
+	return name
+}
+
+func checkDatabaseName(name, engine string) error {
+	if !isValidSQLIdentifier(name) {
+		return fmt.Errorf("'%s' is not a valid database name (letters, digits and '_', up to 63)", name)
+	}
+	if systemDatabases[name] {
+		return fmt.Errorf("'%s' is a system database", name)
+	}
+	if engine == "mysql" && len(name) > mysqlMaxUserLength {
+		return fmt.Errorf("MySQL user names are limited to %d characters", mysqlMaxUserLength)
+	}
+	return nil
+}
+
+// listServerDatabases returns the application databases on a running server.
+func listServerDatabases(engine string) ([]string, error) {
+	var output string
+	var err error
+	if engine == "postgres" {
+		output, err = runPostgresQuery("postgres", "SELECT datname FROM pg_database WHERE NOT datistemplate ORDER BY datname")
+	} else {
+		output, err = runMySQLQuery("SHOW DATABASES")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(line)
+		if name != "" && !systemDatabases[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func databaseUserExists(engine, user string) (bool, error) {
+	var output string
+	var err error
+	if engine == "postgres" {
+		output, err = runPostgresQuery("postgres", fmt.Sprintf("SELECT 1 FROM pg_roles WHERE rolname = '%s'", user))
+	} else {
+		output, err = runMySQLQuery(fmt.Sprintf("SELECT 1 FROM mysql.user WHERE User = '%s'", user))
+	}
+	return strings.TrimSpace(output) != "", err
+}
+
+func databaseDSN(db *VHostDatabase) string {
+	config, _ := GetConfig()
+	if db.Engine == "postgres" {
+		return fmt.Sprintf("postgresql://%s:%s@127.0.0.1:%s/%s", db.User, db.Password, config.PostgresPort, db.Name)
+	}
+	return fmt.Sprintf("mysql://%s:%s@127.0.0.1:%s/%s", db.User, db.Password, config.MySQLPort, db.Name)
+}
+
+// CreateDatabase creates a database and its user with a generated password.
+// The credentials are recorded for domainName, or for the site named
+// name+DefaultDomainSuffix when no domain is given and that site exists.
+func CreateDatabase(name, engine, domainName string) error {
+	engine, err := normalizeDBEngine(engine)
+	if err != nil {
+		return err
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err := checkDatabaseName(name, engine); err != nil {
+		return err
+	}
+	if reservedDatabaseUsers[name] {
+		return fmt.Errorf("'%s' is a reserved user name", name)
+	}
+	if domainName == "" && VirtualHostExists(name+getDefaultDomainSuffix()) {
+		domainName = name + getDefaultDomainSuffix()
+	}
+	var vhost *VHost
+	if domainName != "" {
+		if vhost, err = getExistingVHost(domainName); err != nil {
+			return err
+		}
+		if vhost.Database != nil {
+			return fmt.Errorf("%s already uses the %s database '%s'; drop it first with 'gecko db drop %s'", vhost.Domain, vhost.Database.Engine, vhost.Database.Name, vhost.Database.Name)
+		}
+	}
+	if err := requireDBServer(engine); err != nil {
+		return err
+	}
+	existing, err := listServerDatabases(engine)
+	if err != nil {
+		return err
+	}
+	for _, existingName := range existing {
+		if strings.EqualFold(existingName, name) {
+			return fmt.Errorf("%s database '%s' already exists", dbEngineName(engine), name)
+		}
+	}
+	if exists, err := databaseUserExists(engine, name); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%s user '%s' already exists", dbEngineName(engine), name)
+	}
+
+	password, err := generateRandomPassword(24)
+	if err != nil {
+		return err
+	}
+	db := &VHostDatabase{Engine: engine, Name: name, User: name, Password: password}
+	if engine == "postgres" {
+		err = ensurePostgresDatabase(db)
+	} else {
+		err = ensureMySQLDatabase(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s%s database '%s' created with user '%s'.%s\n", shared.ColorGreen, dbEngineName(engine), db.Name, db.User, shared.ColorReset)
+	fmt.Printf("  Password: %s%s%s\n", shared.ColorYellow, db.Password, shared.ColorReset)
+	fmt.Printf("  DSN:      %s\n", databaseDSN(db))
+	if vhost == nil {
+		fmt.Printf("%sNot linked to a site, so these credentials are not stored anywhere; note them now.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	vhost.Database = db
+	if err := saveVHostEnv(vhost); err != nil {
+		return err
+	}
+	fmt.Printf("Linked to %s, whose PHP code now receives DB_HOST, DB_PORT, DB_DATABASE, DB_USERNAME and DB_PASSWORD.\n", vhost.Domain)
+	return nil
+}
+
+// linkedDatabases maps "engine/name" to the site using that database.
+func linkedDatabases() map[string]*VHost {
+	linked := make(map[string]*VHost)
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return linked
+	}
+	for _, vhost := range registry {
+		if vhost.Database != nil {
+			linked[vhost.Database.Engine+"/"+vhost.Database.Name] = vhost
+		}
+	}
+	return linked
+}
+
+func ListDatabases() error {
+	linked := linkedDatabases()
+	for _, engine := range []string{"mysql", "postgres"} {
+		fmt.Printf("%s%s%s\n", shared.ColorGreen, dbEngineName(engine), shared.ColorReset)
+		var names []string
+		if err := requireDBServer(engine); err == nil {
+			if names, err = listServerDatabases(engine); err != nil {
+				fmt.Printf("  %s%v%s\n", shared.ColorRed, err, shared.ColorReset)
+				continue
+			}
+		} else {
+			// Without the server only the linked databases are known.
+			fmt.Printf("  %s(not running; showing databases linked to sites)%s\n", shared.ColorYellow, shared.ColorReset)
+			for key := range linked {
+				if name, ok := strings.CutPrefix(key, engine+"/"); ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+		}
+		if len(names) == 0 {
+			fmt.Println("  (none)")
+		}
+		for _, name := range names {
+			site := "(no site)"
+			if vhost := linked[engine+"/"+name]; vhost != nil {
+				site = vhost.Domain + " as " + vhost.Database.User
+			}
+			fmt.Printf("  %-24s %s\n", name, site)
+		}
+	}
+	return nil
+}
+
+// DropDatabase drops a database and unlinks it from its site. Only the user
+// Gecko recorded for that site is dropped with it; a database no site links
+// keeps whatever users it has. Without an engine, the engine of the linked
+// site is used, else MySQL.
+func DropDatabase(name, engine string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	var vhost *VHost
+	if engine == "" {
+		for _, candidate := range []string{"mysql", "postgres"} {
+			if v := linkedDatabases()[candidate+"/"+name]; v != nil {
+				engine, vhost = candidate, v
+				break
+			}
+		}
+	}
+	engine, err := normalizeDBEngine(engine)
+	if err != nil {
+		return err
+	}
+	if err := checkDatabaseName(name, engine); err != nil {
+		return err
+	}
+	if vhost == nil {
+		vhost = linkedDatabases()[engine+"/"+name]
+	}
+	user := ""
+	if vhost != nil && isValidSQLIdentifier(vhost.Database.User) && !reservedDatabaseUsers[vhost.Database.User] {
+		user = vhost.Database.User
+	}
+	if err := requireDBServer(engine); err != nil {
+		return err
+	}
+
+	if engine == "postgres" {
+		if _, err = runPostgresQuery("postgres", fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, name)); err == nil && user != "" {
+			_, err = runPostgresQuery("postgres", fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, user))
+		}
+	} else {
+		query := fmt.Sprintf("DROP DATABASE IF EXISTS `%s`;", name)
+		if user != "" {
+			query += fmt.Sprintf(" DROP USER IF EXISTS '%s'@'localhost';", user)
+		}
+		_, err = runMySQLQuery(query)
+	}
+	if err != nil {
+		return err
+	}
+	if user == "" {
+		fmt.Printf("%s%s database '%s' dropped. It was not linked to a site, so no user was dropped.%s\n", shared.ColorGreen, dbEngineName(engine), name, shared.ColorReset)
+	} else {
+		fmt.Printf("%s%s database '%s' and user '%s' dropped.%s\n", shared.ColorGreen, dbEngineName(engine), name, user, shared.ColorReset)
+	}
+
+	if vhost == nil {
+		return nil
+	}
+	vhost.Database = nil
+	return saveVHostEnv(vhost)
+}
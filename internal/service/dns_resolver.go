@@ -0,0 +1,387 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gecko/internal/shared"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsListenAddr      = "127.0.0.1:53"
+	defaultDNSUpstream = "1.1.1.1:53"
+	dnsTTL             = 60
+	dnsTypeA           = 1
+	dnsTypeAAAA        = 28
+	dnsClassIN         = 1
+	dnsHeaderLen       = 12
+	dnsUpstreamTimeout = 3 * time.Second
+	nrptRuleComment    = "Gecko local DNS"
+)
+
+var (
+	dnsMu       sync.Mutex
+	dnsUDPConn  net.PacketConn
+	dnsTCPLn    net.Listener
+	errNotLocal = errors.New("name is not under the development suffix")
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	end   int // offset just past the question section
+}
+
+func IsDNSResolverRunning() bool {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+	return dnsUDPConn != nil
+}
+
+// isDNSResolverActive reports whether the embedded resolver is up in this
+// process and answers for domainName. Sites keep their hosts file entries
+// either way, since the resolver stops with Gecko while its NRPT rule and
+// other Gecko processes would not know; only wildcard names depend on it.
+func isDNSResolverActive(domainName string) bool {
+	return IsDNSResolverRunning() && strings.HasSuffix(domainName, getDefaultDomainSuffix())
+}
+
+// StartDNSResolver answers *.<suffix> with this machine's address and forwards
+// every other query upstream, then routes the suffix to it. Sites keep their
+// hosts file entries, which Windows consults first, so they still resolve if
+// Gecko is killed with the rule in place. It runs until StopDNSResolver is
+// called. If it cannot start, leftovers of an earlier run are cleaned up.
+func StartDNSResolver() error {
+	started, err := listenDNS()
+	if err != nil {
+		releaseDNSRouting()
+		return err
+	}
+	if !started {
+		return nil
+	}
+	if err := addNRPTRule(getDefaultDomainSuffix()); err != nil {
+		stopDNSListeners()
+		releaseDNSRouting()
+		return fmt.Errorf("could not route %s queries to Gecko: %w", getDefaultDomainSuffix(), err)
+	}
+	syncHostsEntries()
+	return nil
+}
+
+// StopDNSResolver stops answering and hands the sites back to the hosts file.
+// The enabled setting is kept, so the resolver comes back on the next start.
+func StopDNSResolver() {
+	if stopDNSListeners() {
+		releaseDNSRouting()
+	}
+}
+
+// ServeDNSUntilInterrupt is the CLI entry: it serves until Ctrl+C.
+func ServeDNSUntilInterrupt() error {
+	if err := StartDNSResolver(); err != nil {
+		return err
+	}
+	fmt.Printf("%sLocal DNS resolver listening on %s. Press Ctrl+C to stop.%s\n", shared.ColorGreen, dnsListenAddr, shared.ColorReset)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	StopDNSResolver()
+	return nil
+}
+
+// listenDNS reports false when the resolver was already running.
+func listenDNS() (bool, error) {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+	if dnsUDPConn != nil {
+		return false, nil
+	}
+	udpConn, err := net.ListenPacket("udp", dnsListenAddr)
+	if err != nil {
+		return false, fmt.Errorf("could not listen on %s: %w", dnsListenAddr, err)
+	}
+	tcpLn, err := net.Listen("tcp", dnsListenAddr)
+	if err != nil {
+		udpConn.Close()
+		return false, fmt.Errorf("could not listen on %s: %w", dnsListenAddr, err)
+	}
+	dnsUDPConn, dnsTCPLn = udpConn, tcpLn
+	go serveDNSUDP(udpConn)
+	go serveDNSTCP(tcpLn)
+	return true, nil
+}
+
+// stopDNSListeners reports whether the resolver was running.
+func stopDNSListeners() bool {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+	if dnsUDPConn == nil {
+		return false
+	}
+	dnsUDPConn.Close()
+	dnsTCPLn.Close()
+	dnsUDPConn, dnsTCPLn = nil, nil
+	return true
+}
+
+// releaseDNSRouting removes the NRPT rule and makes sure the sites are in the
+// hosts file. Called without dnsMu.
+func releaseDNSRouting() {
+	if err := removeNRPTRule(getDefaultDomainSuffix()); err != nil {
+		fmt.Printf("%sCould not remove the Windows DNS rule: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	syncHostsEntries()
+}
+
+func ToggleDNSResolver() {
+	config, err := GetConfig()
+	if err != nil {
+		fmt.Printf("%sFailed to load configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	suffix := getDefaultDomainSuffix()
+
+	if config.DNSResolverEnabled {
+		StopDNSResolver()
+		config.DNSResolverEnabled = false
+		if err := SaveConfig(config); err != nil {
+			fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return
+		}
+		fmt.Printf("%sLocal DNS resolver stopped. Sites still resolve through the hosts file; wildcard aliases no longer do.%s\n", shared.ColorGreen, shared.ColorReset)
+		return
+	}
+
+	fmt.Printf("%sStarting local DNS resolver for *%s...%s\n", shared.ColorYellow, suffix, shared.ColorReset)
+	if err := StartDNSResolver(); err != nil {
+		fmt.Printf("%sError starting DNS resolver: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	config.DNSResolverEnabled = true
+	if err := SaveConfig(config); err != nil {
+		StopDNSResolver()
+		fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	fmt.Printf("%sLocal DNS resolver active while Gecko runs. Every *%s name now resolves to this machine.%s\n", shared.ColorGreen, suffix, shared.ColorReset)
+}
+
+// syncHostsEntries puts back the hosts entries of enabled sites, which earlier
+// versions removed while the resolver ran.
+func syncHostsEntries() {
+	vhosts, _ := ListVirtualHosts()
+	for _, domain := range vhosts {
+		for _, hostname := range vhostHostnames(domain) {
+			if err := updateHostsFile(hostname, true); err != nil {
+				fmt.Printf("%sCould not update hosts file for %s: %v%s\n", shared.ColorRed, hostname, err, shared.ColorReset)
+				return
+			}
+		}
+	}
+}
+
+// addNRPTRule tells the Windows DNS client to send queries for the suffix to
+// the embedded resolver, leaving every other lookup untouched.
+func addNRPTRule(suffix string) error {
+	script := fmt.Sprintf(`Add-DnsClientNrptRule -Namespace '%s' -NameServers '127.0.0.1' -Comment '%s'; Clear-DnsClientCache`, suffix, nrptRuleComment)
+	return runCmd("powershell", "-NoProfile", "-Command", script)
+}
+
+func removeNRPTRule(suffix string) error {
+	script := fmt.Sprintf(`Get-DnsClientNrptRule | Where-Object { $_.Comment -eq '%s' -and $_.Namespace -contains '%s' } | Remove-DnsClientNrptRule -Force; Clear-DnsClientCache`, nrptRuleComment, suffix)
+	return runCmd("powershell", "-NoProfile", "-Command", script)
+}
+
+func serveDNSUDP(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := handleDNSQuery(query, "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func serveDNSTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			query, err := readTCPDNSMessage(conn)
+			if err != nil {
+				return
+			}
+			if resp := handleDNSQuery(query, "tcp"); resp != nil {
+				writeTCPDNSMessage(conn, resp)
+			}
+		}()
+	}
+}
+
+func readTCPDNSMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPDNSMessage(w io.Writer, msg []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(msg))); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func handleDNSQuery(query []byte, network string) []byte {
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	if resp, err := answerLocalDNS(query, q); err == nil {
+		return resp
+	}
+	resp, err := forwardDNSQuery(query, network)
+	if err != nil {
+		return dnsErrorResponse(query, q, 2) // SERVFAIL
+	}
+	return resp
+}
+
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return nil, fmt.Errorf("expected exactly one question")
+	}
+	var labels []string
+	offset := dnsHeaderLen
+	for {
+		if offset >= len(msg) {
+			return nil, fmt.Errorf("truncated question")
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(msg) {
+			return nil, fmt.Errorf("invalid label")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return nil, fmt.Errorf("truncated question")
+	}
+	return &dnsQuestion{
+		name:  strings.ToLower(strings.Join(labels, ".")),
+		qtype: binary.BigEndian.Uint16(msg[offset : offset+2]),
+		end:   offset + 4,
+	}, nil
+}
+
+func answerLocalDNS(query []byte, q *dnsQuestion) ([]byte, error) {
+	suffix := getDefaultDomainSuffix()
+	if !strings.HasSuffix(q.name, suffix) && q.name != strings.TrimPrefix(suffix, ".") {
+		return nil, errNotLocal
+	}
+
+	var answers [][]byte
+	for _, ip := range localDNSAddresses() {
+		if ip4 := ip.To4(); ip4 != nil && q.qtype == dnsTypeA {
+			answers = append(answers, ip4)
+		} else if ip4 == nil && q.qtype == dnsTypeAAAA {
+			answers = append(answers, ip.To16())
+		}
+	}
+
+	resp := dnsResponseHeader(query, q, 0, len(answers))
+	for _, rdata := range answers {
+		record := make([]byte, 12, 12+len(rdata))
+		binary.BigEndian.PutUint16(record[0:2], 0xC000|dnsHeaderLen) // pointer to the question name
+		binary.BigEndian.PutUint16(record[2:4], q.qtype)
+		binary.BigEndian.PutUint16(record[4:6], dnsClassIN)
+		binary.BigEndian.PutUint32(record[6:10], dnsTTL)
+		binary.BigEndian.PutUint16(record[10:12], uint16(len(rdata)))
+		resp = append(resp, append(record, rdata...)...)
+	}
+	return resp, nil
+}
+
+// localDNSAddresses is loopback in private mode and the LAN address in
+// development mode, so other devices resolve sites to this machine.
+func localDNSAddresses() []net.IP {
+	config, _ := GetConfig()
+	if config != nil && config.DevelopmentMode {
+		if lanIPs := getLANIPs(); len(lanIPs) > 0 {
+			return lanIPs
+		}
+	}
+	return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+}
+
+func dnsResponseHeader(query []byte, q *dnsQuestion, rcode byte, answerCount int) []byte {
+	resp := make([]byte, q.end)
+	copy(resp, query[:q.end])
+	resp[2] = 0x80 | (query[2] & 0x78) | 0x04 | (query[2] & 0x01) // QR, opcode, AA, RD
+	resp[3] = 0x80 | rcode                                        // RA
+	binary.BigEndian.PutUint16(resp[6:8], uint16(answerCount))
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+	return resp
+}
+
+func dnsErrorResponse(query []byte, q *dnsQuestion, rcode byte) []byte {
+	resp := dnsResponseHeader(query, q, rcode, 0)
+	resp[2] &^= 0x04 // not authoritative for forwarded names
+	return resp
+}
+
+func forwardDNSQuery(query []byte, network string) ([]byte, error) {
+	upstream := defaultDNSUpstream
+	if config, err := GetConfig(); err == nil && config.DNSUpstream != "" {
+		upstream = config.DNSUpstream
+	}
+	conn, err := net.DialTimeout(network, upstream, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPDNSMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPDNSMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
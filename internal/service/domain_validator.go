@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultDomainSuffix = ".test"
+	maxDomainLength     = 253
+	maxLabelLength      = 63
+)
+
+// TLDs reserved for private use (RFC 2606, RFC 6761, RFC 8375 and ICANN's
+// .internal), which will never resolve on the public internet.
+var reservedTLDs = map[string]bool{
+	"test":      true,
+	"localhost": true,
+	"example":   true,
+	"invalid":   true,
+	"internal":  true,
+	"home.arpa": true,
+}
+
+// TLDs on the HSTS preload list. Browsers refuse plain HTTP for every name
+// under them, so a site without a trusted certificate cannot be opened.
+var hstsPreloadedTLDs = map[string]bool{
+	"app": true, "bank": true, "boo": true, "dad": true, "day": true,
+	"dev": true, "esq": true, "foo": true, "gle": true, "ing": true,
+	"meme": true, "mov": true, "new": true, "nexus": true, "page": true,
+	"phd": true, "prof": true, "rsvp": true, "soy": true, "zip": true,
+}
+
+// NormalizeDomainName lowercases and validates a new site name, appending the
+// configured default suffix when no TLD was given. The returned warnings are
+// about names that are valid but likely to cause trouble.
+func NormalizeDomainName(input string) (string, []string, error) {
+	domainName := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input)), ".")
+	if domainName == "" {
+		return "", nil, fmt.Errorf("domain name cannot be empty")
+	}
+	if !strings.Contains(domainName, ".") {
+		domainName += getDefaultDomainSuffix()
+	}
+	if err := checkDomainName(domainName); err != nil {
+		return "", nil, err
+	}
+	if domainName == "localhost" || strings.HasSuffix(domainName, ".localhost") {
+		return "", nil, fmt.Errorf("'%s' is reserved for the default Gecko host", domainName)
+	}
+	return domainName, domainWarnings(domainName), nil
+}
+
+// checkDomainName enforces RFC 1123 host name syntax. Anything that passes is
+// also safe to use as a single path element under wwwDir.
+func checkDomainName(domainName string) error {
+	if domainName == "" {
+		return fmt.Errorf("domain name cannot be empty")
+	}
+	if strings.ContainsAny(domainName, `/\:*?"<>| `) || strings.Contains(domainName, "..") {
+		return fmt.Errorf("'%s' contains characters that are not allowed in a domain name", domainName)
+	}
+	if len(domainName) > maxDomainLength {
+		return fmt.Errorf("domain name is longer than %d characters", maxDomainLength)
+	}
+	labels := strings.Split(domainName, ".")
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("'%s' contains an empty label", domainName)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("label '%s' is longer than %d characters", label, maxLabelLength)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label '%s' cannot start or end with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("'%s' contains the invalid character '%c'", domainName, c)
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	if strings.Trim(tld, "0123456789") == "" {
+		return fmt.Errorf("'%s' looks like an IP address, not a domain name", domainName)
+	}
+	return nil
+}
+
+// checkSiteName is the check for names of sites that already exist, which may
+// predate checkDomainName and contain '_' or uppercase letters. It only makes
+// sure the name is a single path element under wwwDir.
+func checkSiteName(domainName string) error {
+	if domainName == "" {
+		return fmt.Errorf("domain name cannot be empty")
+	}
+	if strings.ContainsAny(domainName, `/\:`) || strings.Contains(domainName, "..") || !filepath.IsLocal(domainName) {
+		return fmt.Errorf("'%s' is not a valid site name", domainName)
+	}
+	return nil
+}
+
+// hasReservedTLD reports whether a name, or a suffix such as ".test", ends in
+// a TLD that can never be registered publicly.
+func hasReservedTLD(domainName string) bool {
+	labels := strings.Split(strings.TrimPrefix(domainName, "."), ".")
+	if len(labels) >= 2 && reservedTLDs[strings.Join(labels[len(labels)-2:], ".")] {
+		return true
+	}
+	return reservedTLDs[labels[len(labels)-1]]
+}
+
+func domainWarnings(domainName string) []string {
+	if hasReservedTLD(domainName) {
+		return nil
+	}
+	labels := strings.Split(domainName, ".")
+	tld := labels[len(labels)-1]
+	suffix := getDefaultDomainSuffix()
+	if hstsPreloadedTLDs[tld] {
+		return []string{
+			fmt.Sprintf("'.%s' is HSTS-preloaded: browsers will only open it over HTTPS with a trusted certificate.", tld),
+			fmt.Sprintf("'.%s' is also a public TLD, so '%s' may hide a real website. Consider '%s' instead.", tld, domainName, strings.TrimSuffix(domainName, "."+tld)+suffix),
+		}
+	}
+	return []string{
+		fmt.Sprintf("'.%s' is not a reserved TLD, so '%s' may hide a real website on this machine. Consider '%s' instead.", tld, domainName, strings.TrimSuffix(domainName, "."+tld)+suffix),
+	}
+}
+
+func getDefaultDomainSuffix() string {
+	config, err := GetConfig()
+	if err != nil || config.DefaultDomainSuffix == "" {
+		return defaultDomainSuffix
+	}
+	suffix := strings.ToLower(strings.TrimSpace(config.DefaultDomainSuffix))
+	if !strings.HasPrefix(suffix, ".") {
+		suffix = "." + suffix
+	}
+	return suffix
+}
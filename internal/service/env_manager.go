@@ -0,0 +1,254 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// vhostEnvironment is what a site's PHP code sees: the linked database's
+// credentials, overridden by anything set explicitly with "gecko env set".
+func vhostEnvironment(vhost *VHost) map[string]string {
+	env := make(map[string]string)
+	if vhost == nil {
+		return env
+	}
+	if db := vhost.Database; db != nil {
+		config, _ := GetConfig()
+		env["DB_HOST"] = "127.0.0.1"
+		env["DB_DATABASE"] = db.Name
+		env["DB_USERNAME"] = db.User
+		env["DB_PASSWORD"] = db.Password
+		switch db.Engine {
+		case "mysql":
+			env["DB_CONNECTION"] = "mysql"
+			if config != nil {
+				env["DB_PORT"] = config.MySQLPort
+			}
+		case "postgres":
+			env["DB_CONNECTION"] = "pgsql"
+			if config != nil {
+				env["DB_PORT"] = config.PostgresPort
+			}
+		}
+	}
+	for key, value := range vhost.Env {
+		env[key] = value
+	}
+	return env
+}
+
+func sortedEnvKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func ListVHostEnv(domainName string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	env := vhostEnvironment(vhost)
+	if len(env) == 0 {
+		fmt.Printf("%sNo environment variables set for %s.%s\n", shared.ColorYellow, vhost.Domain, shared.ColorReset)
+		return nil
+	}
+	fmt.Printf("%sEnvironment for %s%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+	for _, key := range sortedEnvKeys(env) {
+		if _, explicit := vhost.Env[key]; explicit {
+			fmt.Printf("  %s=%s\n", key, env[key])
+		} else {
+			fmt.Printf("  %s%s=%s (from linked database)%s\n", shared.ColorGray, key, env[key], shared.ColorReset)
+		}
+	}
+	if vhost.EnvFile != "" {
+		fmt.Printf("Synced to %s\n", vhost.EnvFile)
+	}
+	return nil
+}
+
+// SetVHostEnv takes KEY=VALUE pairs.
+func SetVHostEnv(domainName string, pairs []string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	if vhost.Env == nil {
+		vhost.Env = make(map[string]string)
+	}
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("'%s' is not in KEY=VALUE form", pair)
+		}
+		if err := checkEnvVar(key, value); err != nil {
+			return err
+		}
+		vhost.Env[key] = value
+	}
+	return saveVHostEnv(vhost)
+}
+
+func UnsetVHostEnv(domainName string, keys []string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, ok := vhost.Env[key]; !ok {
+			return fmt.Errorf("%s is not set for %s", key, vhost.Domain)
+		}
+		delete(vhost.Env, key)
+	}
+	if len(vhost.Env) == 0 {
+		vhost.Env = nil
+	}
+	return saveVHostEnv(vhost)
+}
+
+// SyncVHostEnvFile keeps a project .env file in step with the site's
+// environment. An empty path means .env in the document root; "off" stops
+// syncing without touching the file.
+func SyncVHostEnvFile(domainName, path string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	switch path {
+	case "off":
+		vhost.EnvFile = ""
+		if err := SaveVHost(vhost); err != nil {
+			return err
+		}
+		fmt.Printf("%s.env syncing turned off for %s.%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+		return nil
+	case "":
+		path = filepath.Join(wwwDir, vhost.Domain, ".env")
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	vhost.EnvFile = absPath
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	return writeEnvFile(vhost)
+}
+
+func getExistingVHost(domainName string) (*VHost, error) {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if !VirtualHostExists(domainName) {
+		return nil, fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	return GetVHost(domainName)
+}
+
+func checkEnvVar(key, value string) error {
+	if !envKeyPattern.MatchString(key) {
+		return fmt.Errorf("'%s' is not a valid variable name", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("value of %s must be a single line", key)
+	}
+	// nginx expands $ in fastcgi_param values and has no way to escape it.
+	if strings.Contains(value, "$") && activeWebServer() == webServerNginx {
+		return fmt.Errorf("value of %s contains '$', which nginx cannot pass through", key)
+	}
+	return nil
+}
+
+func saveVHostEnv(vhost *VHost) error {
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	if vhost.EnvFile != "" {
+		if err := writeEnvFile(vhost); err != nil {
+			fmt.Printf("%sCould not update %s: %v%s\n", shared.ColorRed, vhost.EnvFile, err, shared.ColorReset)
+		}
+	}
+	if err := applyVHostConfig(vhost.Domain); err != nil {
+		return err
+	}
+	fmt.Printf("%sEnvironment for %s updated.%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+	return nil
+}
+
+// writeEnvFile updates keys already present in the .env file in place and
+// appends the rest, leaving comments and unrelated keys alone.
+func writeEnvFile(vhost *VHost) error {
+	env := vhostEnvironment(vhost)
+	var lines []string
+	if data, err := os.ReadFile(vhost.EnvFile); err == nil {
+		lines = strings.Split(strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), "\n")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for i, line := range lines {
+		trimmed := strings.TrimPrefix(strings.TrimSpace(line), "export ")
+		key, _, ok := strings.Cut(trimmed, "=")
+		key = strings.TrimSpace(key)
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if value, managed := env[key]; managed {
+			lines[i] = key + "=" + quoteEnvValue(value)
+			written[key] = true
+		}
+	}
+	for _, key := range sortedEnvKeys(env) {
+		if !written[key] {
+			lines = append(lines, key+"="+quoteEnvValue(env[key]))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(vhost.EnvFile), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(vhost.EnvFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s%s updated.%s\n", shared.ColorGreen, vhost.EnvFile, shared.ColorReset)
+	return nil
+}
+
+func quoteEnvValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t#\"'\\$") {
+		return value
+	}
+	// Single quotes are literal in dotenv parsers, so ${...} is not expanded.
+	if strings.Contains(value, "$") && !strings.Contains(value, "'") {
+		return "'" + value + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func apacheEnvDirectives(env map[string]string, indent string) string {
+	var b strings.Builder
+	for _, key := range sortedEnvKeys(env) {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(env[key])
+		b.WriteString(fmt.Sprintf("%sSetEnv %s \"%s\"\n", indent, key, value))
+	}
+	return b.String()
+}
+
+func nginxEnvParams(env map[string]string, indent string) string {
+	var b strings.Builder
+	for _, key := range sortedEnvKeys(env) {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(env[key])
+		b.WriteString(fmt.Sprintf("%sfastcgi_param %s \"%s\";\n", indent, key, value))
+	}
+	return b.String()
+}
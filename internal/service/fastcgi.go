@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI record types and the responder role, from the FastCGI 1.0 spec.
+const (
+	fcgiVersion        = 1
+	fcgiBeginRequest   = 1
+	fcgiEndRequest     = 3
+	fcgiParams         = 4
+	fcgiStdin          = 5
+	fcgiStdout         = 6
+	fcgiStderr         = 7
+	fcgiResponder      = 1
+	fcgiRequestID      = 1
+	fcgiMaxContent     = 65535
+	fcgiHeaderLen      = 8
+	fcgiRequestTimeout = 5 * time.Minute
+	// fcgiMaxBody bounds the request body held in memory for php-cgi.
+	fcgiMaxBody = 64 << 20
+)
+
+// fastCGIHandler serves a docroot the way the generated nginx config does:
+// static files directly, *.php through php-cgi, and anything else through
+// the site's index.php front controller.
+type fastCGIHandler struct {
+	docRoot string
+	addr    string
+	env     map[string]string
+}
+
+func (h *fastCGIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// On Windows a backslash is a path separator and could climb out of the docroot.
+	if strings.Contains(r.URL.Path, "\\") {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	// Dotfiles such as .env and .git hold secrets, not content. Windows also
+	// drops trailing dots and spaces and reads "name::$DATA" as the file
+	// itself, so "/config.php." would otherwise be served as source.
+	for _, segment := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		if strings.HasSuffix(segment, ".") || strings.HasSuffix(segment, " ") || strings.Contains(segment, ":") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	scriptName, file := urlPath, filepath.Join(h.docRoot, filepath.FromSlash(urlPath))
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		scriptName, file = "", ""
+		for _, index := range []string{"index.php", "index.html", "index.htm"} {
+			candidate := filepath.Join(h.docRoot, filepath.FromSlash(urlPath), index)
+			if _, err := os.Stat(candidate); err == nil {
+				scriptName, file = path.Join(urlPath, index), candidate
+				break
+			}
+		}
+	} else if err != nil {
+		scriptName, file = "", ""
+	}
+	if file == "" {
+		scriptName, file = "/index.php", filepath.Join(h.docRoot, "index.php")
+		if _, err := os.Stat(file); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// Decide by the name on disk, not the one in the URL.
+	file, ok := onDiskPath(file)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.EqualFold(filepath.Ext(file), ".php") {
+		http.ServeFile(w, r, file)
+		return
+	}
+	if err := h.servePHP(w, r, scriptName, file); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "502 Bad Gateway: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// onDiskPath returns file with its base name as stored in the directory, or
+// false when no entry has that name, as with 8.3 short names or other aliases
+// the file system resolves.
+func onDiskPath(file string) (string, bool) {
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		return "", false
+	}
+	base := filepath.Base(file)
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), base) {
+			return filepath.Join(filepath.Dir(file), entry.Name()), true
+		}
+	}
+	return "", false
+}
+
+func (h *fastCGIHandler) servePHP(w http.ResponseWriter, r *http.Request, scriptName, scriptFile string) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, fcgiMaxBody))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", h.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("PHP FastCGI is not reachable at %s", h.addr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fcgiRequestTimeout))
+
+	bw := bufio.NewWriter(conn)
+	writeFCGIRecord(bw, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0})
+	writeFCGIStream(bw, fcgiParams, encodeFCGIParams(h.params(r, scriptName, scriptFile, len(body))))
+	writeFCGIStream(bw, fcgiStdin, body)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	stdout := bufio.NewReader(&fcgiStdoutReader{r: bufio.NewReader(conn)})
+	header, err := textproto.NewReader(stdout).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid response from PHP: %w", err)
+	}
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		if code, err := strconv.Atoi(strings.Fields(s)[0]); err == nil {
+			status = code
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for key, values := range header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, stdout)
+	return err
+}
+
+func (h *fastCGIHandler) params(r *http.Request, scriptName, scriptFile string, contentLength int) map[string]string {
+	host, port, _ := net.SplitHostPort(r.Host)
+	if host == "" {
+		host = r.Host
+	}
+	if port == "" {
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteAddr, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+
+	params := make(map[string]string)
+	for key, value := range h.env {
+		params[key] = value
+	}
+	for key, value := range map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "Gecko",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     filepath.ToSlash(h.docRoot),
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.ToSlash(scriptFile),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    strconv.Itoa(contentLength),
+		// php-cgi refuses to run without this when cgi.force_redirect is on.
+		"REDIRECT_STATUS": "200",
+	} {
+		params[key] = value
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	for key, values := range r.Header {
+		// A Proxy header would become HTTP_PROXY, which PHP HTTP clients
+		// take as their proxy setting (httpoxy).
+		if key == "Proxy" {
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		params[name] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+func encodeFCGIParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	writeLen := func(n int) {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+			return
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+		buf.Write(b[:])
+	}
+	for name, value := range params {
+		writeLen(len(name))
+		writeLen(len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+func writeFCGIRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [fcgiHeaderLen]byte{fcgiVersion, recordType}
+	binary.BigEndian.PutUint16(header[2:4], fcgiRequestID)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	header[6] = byte(padding)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeFCGIStream splits data into records and terminates the stream with an
+// empty record.
+func writeFCGIStream(w io.Writer, recordType byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeFCGIRecord(w, recordType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeFCGIRecord(w, recordType, nil)
+}
+
+// fcgiStdoutReader yields the STDOUT stream of a FastCGI response, forwarding
+// STDERR to the proxy error log, until the END_REQUEST record arrives.
+type fcgiStdoutReader struct {
+	r       *bufio.Reader
+	pending []byte
+	done    bool
+}
+
+func (f *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		var header [fcgiHeaderLen]byte
+		if _, err := io.ReadFull(f.r, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(f.r, content); err != nil {
+			return 0, err
+		}
+		content = content[:length]
+		switch header[1] {
+		case fcgiStdout:
+			f.pending = content
+		case fcgiStderr:
+			frontProxyLog.Printf("php: %s", strings.TrimSpace(string(content)))
+		case fcgiEndRequest:
+			f.done = true
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
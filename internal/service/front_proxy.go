@@ -0,0 +1,607 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gecko/internal/shared"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	frontProxyLogFile      = `C:\Gecko\logs\proxy\error.log`
+	defaultBackendHTTPPort = "8080"
+	defaultBackendSSLPort  = "8443"
+	upstreamFastCGI        = "fastcgi"
+	clientCertHeader       = "X-Client-Cert-CN"
+	routeCheckInterval     = 2 * time.Second
+)
+
+var (
+	frontProxyMu  sync.Mutex
+	runningProxy  *frontProxy
+	frontProxyLog = log.New(io.Discard, "", log.LstdFlags)
+)
+
+// frontProxy owns the public HTTP/HTTPS ports, terminates TLS with
+// certificates signed on demand by the Gecko Root CA and hands each request
+// to the upstream registered for its Host.
+type frontProxy struct {
+	mu       sync.RWMutex
+	routes   map[string]http.Handler
+	fallback http.Handler
+	stamp    string
+	ca       *rootCA
+	certs    map[string]*tls.Certificate
+	servers  []*http.Server
+	stop     chan struct{}
+	logFile  *os.File
+	// clientAuth holds the route names that require a client certificate;
+	// revoked the serials on the client CRL.
+	clientAuth map[string]bool
+	revoked    map[string]bool
+	sslPort    string
+}
+
+func IsFrontProxyRunning() bool {
+	frontProxyMu.Lock()
+	defer frontProxyMu.Unlock()
+	return runningProxy != nil
+}
+
+func frontProxyEnabled() bool {
+	config, err := GetConfig()
+	return err == nil && config.FrontProxyEnabled
+}
+
+// StartFrontProxy listens on the configured HTTP and HTTPS ports. Apache or
+// nginx must already have been moved to the backend ports.
+func StartFrontProxy() error {
+	frontProxyMu.Lock()
+	defer frontProxyMu.Unlock()
+	if runningProxy != nil {
+		return nil
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	p := &frontProxy{
+		certs:   make(map[string]*tls.Certificate),
+		stop:    make(chan struct{}),
+		sslPort: config.ApacheSSLPort,
+	}
+	if err := os.MkdirAll(filepath.Dir(frontProxyLogFile), os.ModePerm); err == nil {
+		if f, err := os.OpenFile(frontProxyLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			p.logFile = f
+			frontProxyLog.SetOutput(f)
+		}
+	}
+	p.reloadRoutes()
+
+	httpLn, err := net.Listen("tcp", ":"+config.ApachePort)
+	if err != nil {
+		p.closeLog()
+		return fmt.Errorf("could not listen on port %s: %w", config.ApachePort, err)
+	}
+	sslLn, err := net.Listen("tcp", ":"+config.ApacheSSLPort)
+	if err != nil {
+		httpLn.Close()
+		p.closeLog()
+		return fmt.Errorf("could not listen on port %s: %w", config.ApacheSSLPort, err)
+	}
+
+	httpServer := &http.Server{Handler: p, ErrorLog: frontProxyLog}
+	httpsServer := &http.Server{
+		Handler:  p,
+		ErrorLog: frontProxyLog,
+		TLSConfig: &tls.Config{
+			GetCertificate:     p.getCertificate,
+			GetConfigForClient: p.configForClient,
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+	p.servers = []*http.Server{httpServer, httpsServer}
+	go httpServer.Serve(httpLn)
+	go httpsServer.ServeTLS(sslLn, "", "")
+	go p.watchRoutes()
+
+	runningProxy = p
+	return nil
+}
+
+func StopFrontProxy() {
+	frontProxyMu.Lock()
+	defer frontProxyMu.Unlock()
+	if runningProxy == nil {
+		return
+	}
+	close(runningProxy.stop)
+	for _, server := range runningProxy.servers {
+		server.Close()
+	}
+	runningProxy.closeLog()
+	runningProxy = nil
+}
+
+// resetFrontProxyCertificates drops the cached Root CA and site certificates
+// so the next handshake signs with the current CA.
+func resetFrontProxyCertificates() {
+	frontProxyMu.Lock()
+	defer frontProxyMu.Unlock()
+	if runningProxy == nil {
+		return
+	}
+	runningProxy.mu.Lock()
+	runningProxy.ca = nil
+	runningProxy.revoked = revokedClientSerials()
+	runningProxy.certs = make(map[string]*tls.Certificate)
+	runningProxy.mu.Unlock()
+}
+
+func (p *frontProxy) closeLog() {
+	if p.logFile != nil {
+		frontProxyLog.SetOutput(io.Discard)
+		p.logFile.Close()
+	}
+}
+
+// ToggleFrontProxy moves Apache or nginx between the public ports and the
+// backend ports and starts or stops the proxy in front of it.
+func ToggleFrontProxy() {
+	config, err := GetConfig()
+	if err != nil {
+		fmt.Printf("%sFailed to load configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	enable := !config.FrontProxyEnabled
+	wasRunning := IsWebServerRunning()
+
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	oldHTTP, oldSSL := webServerPorts(config)
+	config.FrontProxyEnabled = enable
+	newHTTP, newSSL := webServerPorts(config)
+
+	fmt.Printf("%sMoving %s to ports %s/%s...%s\n", shared.ColorYellow, WebServerName(), newHTTP, newSSL, shared.ColorReset)
+	ok := true
+	if activeWebServer() == webServerNginx {
+		if err := regenerateNginxConfig(); err != nil {
+			fmt.Printf("%sError writing nginx config: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			ok = false
+		}
+	} else {
+		ok = rewriteApachePorts(oldHTTP, oldSSL, newHTTP, newSSL)
+		// Behind the proxy the plain HTTP vhost of a client certificate site
+		// carries its HTTPS traffic, so it must stop redirecting, and start
+		// again without the proxy.
+		if ok {
+			ok = rewriteClientAuthVHosts()
+		}
+	}
+	if !ok || !commitWebServerConfig(snap) {
+		config.FrontProxyEnabled = !enable
+		return
+	}
+	if err := SaveConfig(config); err != nil {
+		fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+
+	if !enable {
+		StopFrontProxy()
+		if wasRunning {
+			RestartWebServer()
+		}
+		fmt.Printf("%sFront proxy disabled. %s serves ports %s/%s directly again.%s\n", shared.ColorGreen, WebServerName(), newHTTP, newSSL, shared.ColorReset)
+		return
+	}
+
+	if wasRunning {
+		RestartWebServer()
+	}
+	if err := StartFrontProxy(); err != nil {
+		fmt.Printf("%sError starting front proxy: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	if !isSSLEnabled() {
+		fmt.Printf("%sThe Gecko Root CA is not installed yet, so HTTPS requests will fail until it is.%s\n", shared.ColorYellow, shared.ColorReset)
+	}
+	fmt.Printf("%sFront proxy active on ports %s/%s, forwarding to %s on %s.%s\n", shared.ColorGreen, config.ApachePort, config.ApacheSSLPort, WebServerName(), newHTTP, shared.ColorReset)
+}
+
+// SetVHostUpstream chooses where the front proxy sends a site's requests:
+// the web server (empty), php-cgi directly ("fastcgi") or an http(s) URL.
+func SetVHostUpstream(domainName, upstream string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if !VirtualHostExists(domainName) {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	upstream, err := normalizeUpstream(upstream)
+	if err != nil {
+		return err
+	}
+	vhost, err := GetVHost(domainName)
+	if err != nil {
+		return err
+	}
+	vhost.Upstream = upstream
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	if upstream == "" {
+		upstream = WebServerName()
+	}
+	fmt.Printf("%s%s now routes to %s.%s\n", shared.ColorGreen, domainName, upstream, shared.ColorReset)
+	if !frontProxyEnabled() {
+		fmt.Printf("%sThe front proxy is disabled, so this takes effect once it is enabled.%s\n", shared.ColorYellow, shared.ColorReset)
+	}
+	return nil
+}
+
+func normalizeUpstream(upstream string) (string, error) {
+	upstream = strings.TrimSpace(upstream)
+	switch strings.ToLower(upstream) {
+	case "", "webserver", webServerApache, webServerNginx:
+		return "", nil
+	case upstreamFastCGI:
+		return upstreamFastCGI, nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("upstream must be 'webserver', 'fastcgi' or an http(s):// URL")
+	}
+	return upstream, nil
+}
+
+func (p *frontProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p.mu.RLock()
+	handler, routeName := p.route(host)
+	if handler == nil {
+		handler = p.fallback
+	}
+	requireCert := p.clientAuth[routeName]
+	p.mu.RUnlock()
+	if handler == nil {
+		http.Error(w, "503 Service Unavailable: no routes loaded", http.StatusServiceUnavailable)
+		return
+	}
+	// The handshake asked for a certificate based on SNI, so a request must
+	// name the same site in its Host header to ride on it.
+	if requireCert {
+		switch {
+		case r.TLS == nil:
+			http.Redirect(w, r, httpsURL(host, p.sslPort)+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		case !strings.EqualFold(r.TLS.ServerName, host):
+			http.Error(w, "421 Misdirected Request: the TLS server name does not match the Host header", http.StatusMisdirectedRequest)
+			return
+		case len(r.TLS.VerifiedChains) == 0:
+			http.Error(w, "403 Forbidden: a client certificate is required", http.StatusForbidden)
+			return
+		}
+	}
+	// Upstreams learn who a verified client is, and nobody else can claim it.
+	r.Header.Del(clientCertHeader)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		r.Header.Set(clientCertHeader, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// httpsURL is the origin of host on the HTTPS port, leaving out the default.
+func httpsURL(host, sslPort string) string {
+	if sslPort == "443" {
+		return "https://" + host
+	}
+	return "https://" + net.JoinHostPort(host, sslPort)
+}
+
+// accessHandler enforces a site's access rules in the proxy itself. The web
+// server only ever sees the proxy's loopback address, and the fastcgi and
+// URL upstreams bypass it entirely.
+type accessHandler struct {
+	realm string
+	allow []*net.IPNet
+	users map[string]string
+	next  http.Handler
+}
+
+func newAccessHandler(domainName string, vhost *VHost, next http.Handler) *accessHandler {
+	a := &accessHandler{realm: "Gecko: " + domainName, next: next}
+	if vhost != nil && vhost.Access != nil {
+		for _, cidr := range vhost.Access.AllowFrom {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				a.allow = append(a.allow, ipNet)
+			}
+		}
+	}
+	if entries, err := readHtpasswd(htpasswdPath(domainName)); err == nil && len(entries) > 0 {
+		a.users = make(map[string]string, len(entries))
+		for _, entry := range entries {
+			a.users[entry.User] = entry.Hash
+		}
+	}
+	return a
+}
+
+func (a *accessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.clientAllowed(r) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	if a.users != nil {
+		user, password, ok := r.BasicAuth()
+		hash, known := a.users[user]
+		if !ok || !known || !checkHtpasswd(hash, password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+// clientAllowed mirrors the generated config: this computer always, listed
+// networks if there is an allowlist, otherwise everyone in dev mode only.
+func (a *accessHandler) clientAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if len(a.allow) > 0 {
+		for _, ipNet := range a.allow {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	config, err := GetConfig()
+	return err == nil && config.DevelopmentMode
+}
+
+// route finds the handler for host, trying an exact match before a wildcard
+// alias covering it. It returns the matching route name. Callers hold p.mu.
+func (p *frontProxy) route(host string) (http.Handler, string) {
+	if handler, ok := p.routes[host]; ok {
+		return handler, host
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		if handler, ok := p.routes["*."+parent]; ok {
+			return handler, "*." + parent
+		}
+	}
+	return nil, ""
+}
+
+func (p *frontProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	p.mu.RLock()
+	// Only sign names that are actually served, so arbitrary SNI values
+	// cannot grow the cache. A wildcard route gets one wildcard certificate.
+	if _, routeName := p.route(name); routeName != "" {
+		name = routeName
+	} else {
+		name = "localhost"
+	}
+	cert, ok := p.certs[name]
+	p.mu.RUnlock()
+	if ok && certStillFresh(cert) {
+		return cert, nil
+	}
+
+	p.mu.Lock()
+	err := p.loadCA()
+	ca := p.ca
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Key generation takes a while, so other handshakes must not wait on it.
+	names := []string{name}
+	if name == "localhost" {
+		names = certNamesFor("localhost")
+	}
+	cert, err = ca.issueLeafCert(names...)
+	if err != nil {
+		frontProxyLog.Printf("could not issue certificate for %s: %v", name, err)
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.certs[name]; ok && certStillFresh(existing) {
+		return existing, nil
+	}
+	p.certs[name] = cert
+	return cert, nil
+}
+
+func certStillFresh(cert *tls.Certificate) bool {
+	return time.Now().Add(24 * time.Hour).Before(cert.Leaf.NotAfter)
+}
+
+// loadCA loads the Root CA on first use. Callers hold p.mu.
+func (p *frontProxy) loadCA() error {
+	if p.ca != nil {
+		return nil
+	}
+	ca, err := loadRootCA()
+	if err != nil {
+		return err
+	}
+	p.ca = ca
+	return nil
+}
+
+// configForClient asks for a client certificate on sites that require one,
+// accepting only unrevoked certificates from the Gecko Root CA.
+func (p *frontProxy) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, routeName := p.route(strings.ToLower(hello.ServerName))
+	if !p.clientAuth[routeName] {
+		return nil, nil
+	}
+	if err := p.loadCA(); err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca.cert)
+	revoked := p.revoked
+	return &tls.Config{
+		GetCertificate: p.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      pool,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if serial := fmt.Sprintf("%X", chains[0][0].SerialNumber); revoked[serial] {
+				return fmt.Errorf("client certificate %s has been revoked", serial)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// watchRoutes picks up sites that are created, deleted, enabled, disabled or
+// re-routed while the proxy is running.
+func (p *frontProxy) watchRoutes() {
+	ticker := time.NewTicker(routeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if routesStamp() != p.stamp {
+				p.reloadRoutes()
+			}
+		}
+	}
+}
+
+func routesStamp() string {
+	var b strings.Builder
+	for _, path := range []string{vhostRegistryPath, sitesEnabledDir(), htpasswdDir, clientCRLPath} {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%d;", info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+func (p *frontProxy) reloadRoutes() {
+	stamp := routesStamp()
+	config, err := GetConfig()
+	if err != nil {
+		frontProxyLog.Printf("could not load config: %v", err)
+		return
+	}
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		frontProxyLog.Printf("could not reload routes: %v", err)
+		return
+	}
+	backendPort, _ := webServerPorts(config)
+	webServer := newUpstreamProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:" + backendPort}, true)
+
+	fallback := newAccessHandler("localhost", nil, webServer)
+	routes := map[string]http.Handler{"localhost": fallback}
+	clientAuth := make(map[string]bool)
+	domains, _ := ListVirtualHosts()
+	needsFastCGI := false
+	for _, domain := range domains {
+		vhost := registry[domain]
+		upstream := ""
+		if vhost != nil {
+			upstream = vhost.Upstream
+		}
+		var handler http.Handler
+		switch upstream {
+		case "":
+			handler = webServer
+		case upstreamFastCGI:
+			handler = &fastCGIHandler{
+				docRoot: filepath.Join(wwwDir, domain),
+				addr:    fastCGIAddress(),
+				env:     vhostEnvironment(vhost),
+			}
+			needsFastCGI = true
+		default:
+			target, err := url.Parse(upstream)
+			if err != nil {
+				frontProxyLog.Printf("skipping %s: invalid upstream %q", domain, upstream)
+				continue
+			}
+			handler = newUpstreamProxy(target, false)
+		}
+		routes[domain] = newAccessHandler(domain, vhost, handler)
+		if vhost != nil {
+			for _, alias := range vhost.Aliases {
+				routes[alias] = routes[domain]
+			}
+			if vhost.ClientAuth {
+				for _, name := range append([]string{domain}, vhost.Aliases...) {
+					clientAuth[name] = true
+				}
+			}
+		}
+	}
+	if config.MailCatcherEnabled {
+		viewer := newUpstreamProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:" + config.MailHTTPPort}, false)
+		routes[mailCatcherHost()] = newAccessHandler(mailCatcherHost(), nil, viewer)
+	}
+	if needsFastCGI && !IsServiceRunning("php-cgi.exe") {
+		startPHPFastCGI()
+	}
+
+	p.mu.Lock()
+	p.routes, p.fallback, p.stamp = routes, fallback, stamp
+	p.clientAuth, p.revoked = clientAuth, revokedClientSerials()
+	p.mu.Unlock()
+}
+
+// newUpstreamProxy forwards to target. The web server needs the original Host
+// to pick the right vhost; other upstreams get their own host name.
+func newUpstreamProxy(target *url.URL, keepHost bool) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			if keepHost {
+				r.Out.Host = r.In.Host
+			}
+			r.SetXForwarded()
+		},
+		ErrorLog: frontProxyLog,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			frontProxyLog.Printf("%s %s: %v", r.Host, r.URL.Path, err)
+			http.Error(w, "502 Bad Gateway: "+target.Host+" is not reachable", http.StatusBadGateway)
+		},
+	}
+}
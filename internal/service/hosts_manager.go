@@ -0,0 +1,320 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	hostsFilePath    = `C:\Windows\System32\drivers\etc\hosts`
+	hostsBackupDir   = `C:\Gecko\etc\backup\hosts`
+	hostsBackupCount = 5
+	geckoStartBlock  = "#GeckoStart"
+	geckoEndBlock    = "#GeckoEnd"
+)
+
+var loopbackAddresses = []string{"127.0.0.1", "::1"}
+
+type hostsEntryState int
+
+const (
+	hostsEntryRemoved hostsEntryState = iota
+	hostsEntryEnabled
+	hostsEntryDisabled
+)
+
+// hostsEntry is one line inside the Gecko block. Lines that are not an
+// address mapping are kept verbatim in raw.
+type hostsEntry struct {
+	ip        string
+	hostnames []string
+	disabled  bool
+	raw       string
+}
+
+// hostsFile keeps everything outside the Gecko block exactly as it was read,
+// including the original line endings.
+type hostsFile struct {
+	before          []string
+	entries         []hostsEntry
+	after           []string
+	newline         string
+	trailingNewline bool
+}
+
+func parseHostsFile(content string) *hostsFile {
+	hf := &hostsFile{newline: "\n"}
+	if strings.Contains(content, "\r\n") {
+		hf.newline = "\r\n"
+	}
+	hf.trailingNewline = content == "" || strings.HasSuffix(content, "\n")
+	content = strings.TrimSuffix(strings.TrimSuffix(content, "\n"), "\r")
+	if content == "" {
+		return hf
+	}
+
+	section := 0 // 0 before the block, 1 inside, 2 after
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case section == 0 && trimmed == geckoStartBlock:
+			section = 1
+		case section == 1 && trimmed == geckoEndBlock:
+			section = 2
+		case section == 1:
+			if trimmed != "" {
+				hf.entries = append(hf.entries, parseHostsEntry(trimmed))
+			}
+		case section == 0:
+			hf.before = append(hf.before, line)
+		default:
+			hf.after = append(hf.after, line)
+		}
+	}
+	return hf
+}
+
+func parseHostsEntry(line string) hostsEntry {
+	body := line
+	disabled := false
+	if strings.HasPrefix(body, "#") {
+		disabled = true
+		body = strings.TrimSpace(strings.TrimLeft(body, "#"))
+	}
+	if i := strings.Index(body, "#"); i >= 0 {
+		body = body[:i]
+	}
+	fields := strings.Fields(body)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return hostsEntry{raw: line}
+	}
+	return hostsEntry{ip: fields[0], hostnames: fields[1:], disabled: disabled}
+}
+
+func (e hostsEntry) String() string {
+	if e.raw != "" {
+		return e.raw
+	}
+	line := e.ip + " " + strings.Join(e.hostnames, " ")
+	if e.disabled {
+		return "# " + line
+	}
+	return line
+}
+
+func (hf *hostsFile) String() string {
+	lines := append([]string{}, hf.before...)
+	if len(hf.entries) > 0 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, geckoStartBlock)
+		for _, entry := range hf.entries {
+			lines = append(lines, entry.String())
+		}
+		lines = append(lines, geckoEndBlock)
+	} else if len(hf.after) == 0 && len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		// Drop the separator line that was added along with the block.
+		lines = lines[:len(lines)-1]
+	}
+	lines = append(lines, hf.after...)
+	content := strings.Join(lines, hf.newline)
+	if hf.trailingNewline && content != "" {
+		content += hf.newline
+	}
+	return content
+}
+
+// setHost removes every mapping for hostname in the Gecko block, matching
+// whole tokens only, then adds loopback mappings for it unless state is
+// hostsEntryRemoved.
+func (hf *hostsFile) setHost(hostname string, state hostsEntryState) {
+	var entries []hostsEntry
+	for _, entry := range hf.entries {
+		if entry.raw != "" {
+			entries = append(entries, entry)
+			continue
+		}
+		var kept []string
+		for _, h := range entry.hostnames {
+			if !strings.EqualFold(h, hostname) {
+				kept = append(kept, h)
+			}
+		}
+		if len(kept) > 0 {
+			entry.hostnames = kept
+			entries = append(entries, entry)
+		}
+	}
+	if state != hostsEntryRemoved {
+		for _, ip := range loopbackAddresses {
+			entries = append(entries, hostsEntry{ip: ip, hostnames: []string{hostname}, disabled: state == hostsEntryDisabled})
+		}
+	}
+	hf.entries = entries
+}
+
+func updateHostsFile(domainName string, add bool) error {
+	state := hostsEntryRemoved
+	if add {
+		state = hostsEntryEnabled
+	}
+	_, err := applyHostsChange(domainName, state, false)
+	return err
+}
+
+// setHostsEntryEnabled comments or uncomments a site's hosts entries, keeping
+// them in the Gecko block so enabling the site again restores them.
+func setHostsEntryEnabled(domainName string, enable bool) error {
+	state := hostsEntryDisabled
+	if enable {
+		state = hostsEntryEnabled
+	}
+	_, err := applyHostsChange(domainName, state, false)
+	return err
+}
+
+// applyHostsChange rewrites the hosts file for one hostname and returns a diff
+// of the change. With dryRun set the file is left untouched.
+func applyHostsChange(hostname string, state hostsEntryState, dryRun bool) (string, error) {
+	data, err := os.ReadFile(hostsFilePath)
+	if err != nil {
+		return "", err
+	}
+	oldContent := string(data)
+	hf := parseHostsFile(oldContent)
+	hf.setHost(hostname, state)
+	newContent := hf.String()
+
+	diff := diffLines(oldContent, newContent)
+	if dryRun || newContent == oldContent {
+		return diff, nil
+	}
+	if err := backupHostsFile(data); err != nil {
+		return "", fmt.Errorf("could not back up hosts file: %w", err)
+	}
+	return diff, os.WriteFile(hostsFilePath, []byte(newContent), 0644)
+}
+
+// backupHostsFile stores a timestamped copy of the hosts file, keeping only
+// the newest hostsBackupCount copies.
+func backupHostsFile(data []byte) error {
+	if err := os.MkdirAll(hostsBackupDir, os.ModePerm); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("hosts-%s.bak", time.Now().Format("20060102-150405.000"))
+	if err := os.WriteFile(filepath.Join(hostsBackupDir, name), data, 0644); err != nil {
+		return err
+	}
+	backups, err := filepath.Glob(filepath.Join(hostsBackupDir, "hosts-*.bak"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > hostsBackupCount {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// diffLines returns a minimal line diff of old and new, prefixing removed
+// lines with "-" and added lines with "+". Unchanged lines are omitted.
+func diffLines(oldContent, newContent string) string {
+	split := func(s string) []string {
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	a, b := split(oldContent), split(newContent)
+
+	// Hosts files can be huge (ad-block lists), but changes only happen in the
+	// Gecko block, so strip the common head and tail before comparing.
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// Longest common subsequence table, filled from the end.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			out.WriteString("+ " + b[j] + "\n")
+			j++
+		default:
+			out.WriteString("- " + a[i] + "\n")
+			i++
+		}
+	}
+	return out.String()
+}
+
+// UpdateHostsEntry adds, removes, enables or disables a hostname in the Gecko
+// block of the hosts file. With dryRun set it only prints what would change.
+func UpdateHostsEntry(hostname, action string, dryRun bool) error {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	if err := checkDomainName(hostname); err != nil {
+		return err
+	}
+	var state hostsEntryState
+	switch action {
+	case "add", "enable":
+		state = hostsEntryEnabled
+	case "remove":
+		state = hostsEntryRemoved
+	case "disable":
+		state = hostsEntryDisabled
+	default:
+		return fmt.Errorf("unknown hosts action '%s'", action)
+	}
+
+	diff, err := applyHostsChange(hostname, state, dryRun)
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Printf("%sHosts file already up to date.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("%sDry run, %s would change as follows:%s\n", shared.ColorYellow, hostsFilePath, shared.ColorReset)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		color := shared.ColorGreen
+		if strings.HasPrefix(line, "-") {
+			color = shared.ColorRed
+		}
+		fmt.Printf("%s%s%s\n", color, line, shared.ColorReset)
+	}
+	if !dryRun {
+		fmt.Printf("%sHosts file updated. A backup was saved to %s%s\n", shared.ColorGreen, hostsBackupDir, shared.ColorReset)
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gecko/internal/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Both formats are "combined" plus the request duration, which Apache
+	// logs in microseconds and nginx in seconds.
+	apacheAccessLogFormat = `%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" %D`
+	nginxAccessLogFormat  = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_time`
+
+	accessLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+	logStatsTopN        = 10
+	// Caps on distinct keys so a crawler hitting random URLs cannot exhaust memory.
+	logStatsMaxPaths  = 20000
+	logStatsMaxAgents = 2000
+	logStatsOtherKey  = "(other)"
+)
+
+var errMalformedLogLine = errors.New("malformed access log line")
+
+type accessLogEntry struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	Status    int
+	Bytes     int64
+	UserAgent string
+	Duration  time.Duration
+	HasTiming bool
+}
+
+type pathStats struct {
+	Hits     int
+	Timed    int
+	Total    time.Duration
+	Max      time.Duration
+	Statuses map[int]int
+}
+
+type accessLogStats struct {
+	Since, First, Last time.Time
+	Requests           int
+	Malformed          int
+	Bytes              int64
+	PerMinute          map[int64]int
+	Statuses           map[int]int
+	Paths              map[string]*pathStats
+	Agents             map[string]int
+}
+
+func newAccessLogStats(since time.Time) *accessLogStats {
+	return &accessLogStats{
+		Since:     since,
+		PerMinute: make(map[int64]int),
+		Statuses:  make(map[int]int),
+		Paths:     make(map[string]*pathStats),
+		Agents:    make(map[string]int),
+	}
+}
+
+func (s *accessLogStats) add(e *accessLogEntry) {
+	if s.Requests == 0 || e.Time.Before(s.First) {
+		s.First = e.Time
+	}
+	if e.Time.After(s.Last) {
+		s.Last = e.Time
+	}
+	s.Requests++
+	s.Bytes += e.Bytes
+	s.PerMinute[e.Time.Unix()/60]++
+	s.Statuses[e.Status]++
+
+	path := e.Path
+	if _, ok := s.Paths[path]; !ok && len(s.Paths) >= logStatsMaxPaths {
+		path = logStatsOtherKey
+	}
+	p := s.Paths[path]
+	if p == nil {
+		p = &pathStats{Statuses: make(map[int]int)}
+		s.Paths[path] = p
+	}
+	p.Hits++
+	p.Statuses[e.Status]++
+	if e.HasTiming {
+		p.Timed++
+		p.Total += e.Duration
+		if e.Duration > p.Max {
+			p.Max = e.Duration
+		}
+	}
+
+	agent := e.UserAgent
+	if _, ok := s.Agents[agent]; !ok && len(s.Agents) >= logStatsMaxAgents {
+		agent = logStatsOtherKey
+	}
+	s.Agents[agent]++
+}
+
+// vhostAccessLogPath is where the active web server writes a site's log.
+func vhostAccessLogPath(domainName string) string {
+	if activeWebServer() == webServerNginx {
+		return filepath.Join(nginxLogDir, domainName+"_access.log")
+	}
+	return filepath.Join(`C:\Gecko\logs\httpd`, domainName+"_access.log")
+}
+
+// ParseLogWindow turns "15m", "6h", "7d" or "all" into a duration; zero
+// means the whole log.
+func ParseLogWindow(window string) (time.Duration, error) {
+	window = strings.TrimSpace(strings.ToLower(window))
+	switch {
+	case window == "" || window == "all":
+		return 0, nil
+	case strings.HasSuffix(window, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid time window '%s'", window)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid time window '%s' (use e.g. 15m, 6h, 7d or all)", window)
+	}
+	return d, nil
+}
+
+func ShowAccessLogStats(domainName string, window time.Duration) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if err := checkSiteName(domainName); err != nil {
+		return err
+	}
+	logPath := vhostAccessLogPath(domainName)
+	var since time.Time
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+	stats, err := collectAccessLogStats(logPath, since)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no access log for %s yet (%s)", domainName, logPath)
+	}
+	if err != nil {
+		return err
+	}
+	printAccessLogStats(domainName, window, stats)
+	return nil
+}
+
+func collectAccessLogStats(logPath string, since time.Time) (*accessLogStats, error) {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !since.IsZero() {
+		if err := seekAccessLog(file, since); err != nil {
+			return nil, err
+		}
+	}
+	stats := newAccessLogStats(since)
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var entry accessLogEntry
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip absurdly long lines instead of buffering them.
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			stats.Malformed++
+			continue
+		}
+		if len(line) > 0 {
+			if parseErr := parseAccessLogLine(string(line), &entry); parseErr != nil {
+				stats.Malformed++
+			} else if since.IsZero() || !entry.Time.Before(since) {
+				stats.add(&entry)
+			}
+		}
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// seekAccessLog binary-searches the chronological log for the first line at
+// or after since, so a short window over a huge log reads only its tail.
+func seekAccessLog(file *os.File, since time.Time) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	lo, hi := int64(0), info.Size()
+	var entry accessLogEntry
+	for hi-lo > 64*1024 {
+		mid := lo + (hi-lo)/2
+		if _, err := file.Seek(mid, io.SeekStart); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(file)
+		reader.ReadString('\n') // skip the partial line
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			hi = mid
+			continue
+		}
+		if parseAccessLogLine(line, &entry) != nil || entry.Time.Before(since) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if _, err := file.Seek(lo, io.SeekStart); err != nil {
+		return err
+	}
+	if lo > 0 {
+		// Realign to the start of the next line.
+		buf := make([]byte, 1)
+		for {
+			if _, err := file.Read(buf); err != nil || buf[0] == '\n' {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseAccessLogLine reads the combined format with an optional trailing
+// duration: an integer is Apache's %D in microseconds, a decimal is nginx's
+// $request_time in seconds.
+func parseAccessLogLine(line string, e *accessLogEntry) error {
+	*e = accessLogEntry{}
+	open := strings.IndexByte(line, '[')
+	if open < 0 {
+		return errMalformedLogLine
+	}
+	closeIdx := strings.IndexByte(line[open:], ']')
+	if closeIdx < 0 {
+		return errMalformedLogLine
+	}
+	t, err := time.Parse(accessLogTimeLayout, line[open+1:open+closeIdx])
+	if err != nil {
+		return errMalformedLogLine
+	}
+	e.Time = t
+	rest := line[open+closeIdx+1:]
+
+	request, rest, ok := cutQuoted(rest)
+	if !ok {
+		return errMalformedLogLine
+	}
+	parts := strings.Fields(request)
+	if len(parts) >= 2 {
+		e.Method = parts[0]
+		e.Path = parts[1]
+		if q := strings.IndexByte(e.Path, '?'); q >= 0 {
+			e.Path = e.Path[:q]
+		}
+	} else {
+		e.Path = request
+	}
+
+	fields := strings.SplitN(strings.TrimLeft(rest, " "), " ", 3)
+	if len(fields) < 2 {
+		return errMalformedLogLine
+	}
+	if e.Status, err = strconv.Atoi(fields[0]); err != nil {
+		return errMalformedLogLine
+	}
+	e.Bytes, _ = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+	if len(fields) < 3 {
+		return nil
+	}
+	rest = fields[2]
+
+	if _, rest, ok = cutQuoted(rest); !ok { // referer
+		return nil
+	}
+	if e.UserAgent, rest, ok = cutQuoted(rest); !ok {
+		return nil
+	}
+	if trailing := strings.Fields(rest); len(trailing) > 0 {
+		if strings.Contains(trailing[0], ".") {
+			if secs, err := strconv.ParseFloat(trailing[0], 64); err == nil {
+				e.Duration, e.HasTiming = time.Duration(secs*float64(time.Second)), true
+			}
+		} else if micros, err := strconv.ParseInt(trailing[0], 10, 64); err == nil {
+			e.Duration, e.HasTiming = time.Duration(micros)*time.Microsecond, true
+		}
+	}
+	return nil
+}
+
+// cutQuoted returns the first double-quoted value in s, honouring the
+// backslash escapes Apache and nginx write, and what follows it.
+func cutQuoted(s string) (string, string, bool) {
+	start := strings.IndexByte(s, '"')
+	if start < 0 {
+		return "", s, false
+	}
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", s, false
+}
+
+type rankedItem struct {
+	Key   string
+	Count int
+	Value time.Duration
+}
+
+func topCounts(counts map[string]int, n int) []rankedItem {
+	items := make([]rankedItem, 0, len(counts))
+	for key, count := range counts {
+		items = append(items, rankedItem{Key: key, Count: count})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+func printAccessLogStats(domainName string, window time.Duration, s *accessLogStats) {
+	span := "entire log"
+	if window > 0 {
+		span = "last " + formatLogWindow(window)
+	}
+	fmt.Printf("%sAccess log stats for %s (%s)%s\n", shared.ColorGreen, domainName, span, shared.ColorReset)
+	if s.Requests == 0 {
+		fmt.Println("No requests in this period.")
+		if s.Malformed > 0 {
+			fmt.Printf("%s%d lines could not be parsed.%s\n", shared.ColorYellow, s.Malformed, shared.ColorReset)
+		}
+		return
+	}
+
+	minutes := s.Last.Sub(s.First).Minutes() + 1
+	var peakMinute int64
+	peak := 0
+	for minute, count := range s.PerMinute {
+		if count > peak || (count == peak && minute < peakMinute) {
+			peak, peakMinute = count, minute
+		}
+	}
+	fmt.Printf("Requests:     %d (%s transferred)\n", s.Requests, formatBytes(s.Bytes))
+	fmt.Printf("From - to:    %s - %s\n", s.First.Local().Format("2006-01-02 15:04:05"), s.Last.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Per minute:   %.1f average, %d peak at %s\n", float64(s.Requests)/minutes, peak, time.Unix(peakMinute*60, 0).Local().Format("2006-01-02 15:04"))
+	if s.Malformed > 0 {
+		fmt.Printf("%sSkipped:      %d malformed lines%s\n", shared.ColorYellow, s.Malformed, shared.ColorReset)
+	}
+
+	fmt.Printf("\n%sStatus codes%s\n", shared.ColorYellow, shared.ColorReset)
+	classes := make(map[int]int)
+	codes := make([]int, 0, len(s.Statuses))
+	for code, count := range s.Statuses {
+		classes[code/100] += count
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for class := 1; class <= 5; class++ {
+		if classes[class] > 0 {
+			fmt.Printf("  %dxx  %7d  %5.1f%%\n", class, classes[class], 100*float64(classes[class])/float64(s.Requests))
+		}
+	}
+	var detail []string
+	for _, code := range codes {
+		detail = append(detail, fmt.Sprintf("%d: %d", code, s.Statuses[code]))
+	}
+	fmt.Printf("  %s(%s)%s\n", shared.ColorGray, strings.Join(detail, ", "), shared.ColorReset)
+
+	hits := make(map[string]int, len(s.Paths))
+	for path, p := range s.Paths {
+		hits[path] = p.Hits
+	}
+	fmt.Printf("\n%sMost requested URLs%s\n", shared.ColorYellow, shared.ColorReset)
+	for _, item := range topCounts(hits, logStatsTopN) {
+		fmt.Printf("  %7d  %s\n", item.Count, truncateForDisplay(item.Key, 60))
+	}
+
+	fmt.Printf("\n%sSlowest URLs (average)%s\n", shared.ColorYellow, shared.ColorReset)
+	var slow []rankedItem
+	for path, p := range s.Paths {
+		if p.Timed > 0 {
+			slow = append(slow, rankedItem{Key: path, Count: p.Timed, Value: p.Total / time.Duration(p.Timed)})
+		}
+	}
+	if len(slow) == 0 {
+		fmt.Println("  No timing data. Sites created before Gecko logged request durations")
+		fmt.Println("  need to be re-created or have %D added to their CustomLog format.")
+	} else {
+		sort.Slice(slow, func(i, j int) bool { return slow[i].Value > slow[j].Value })
+		if len(slow) > logStatsTopN {
+			slow = slow[:logStatsTopN]
+		}
+		for _, item := range slow {
+			fmt.Printf("  %9s avg  %9s max  %6d hits  %s\n", formatDuration(item.Value), formatDuration(s.Paths[item.Key].Max), item.Count, truncateForDisplay(item.Key, 40))
+		}
+	}
+
+	printErrorURLs(s, 4, "Client errors (4xx)")
+	printErrorURLs(s, 5, "Server errors (5xx)")
+
+	fmt.Printf("\n%sTop user agents%s\n", shared.ColorYellow, shared.ColorReset)
+	for _, item := range topCounts(s.Agents, logStatsTopN) {
+		agent := item.Key
+		if agent == "" || agent == "-" {
+			agent = "(none)"
+		}
+		fmt.Printf("  %7d  %s\n", item.Count, truncateForDisplay(agent, 60))
+	}
+}
+
+func printErrorURLs(s *accessLogStats, class int, title string) {
+	counts := make(map[string]int)
+	for path, p := range s.Paths {
+		for code, count := range p.Statuses {
+			if code/100 == class {
+				counts[fmt.Sprintf("%d %s", code, path)] += count
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Printf("\n%s%s%s\n", shared.ColorYellow, title, shared.ColorReset)
+	for _, item := range topCounts(counts, logStatsTopN) {
+		fmt.Printf("  %7d  %s\n", item.Count, truncateForDisplay(item.Key, 60))
+	}
+}
+
+func formatLogWindow(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(d.String(), "0s"), "0m")
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func truncateForDisplay(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
@@ -0,0 +1,537 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"gecko/internal/shared"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mailDir               = `C:\Gecko\mail`
+	defaultMailSMTPPort   = "1025"
+	defaultMailHTTPPort   = "8025"
+	mailSiteConfigName    = "00-mailcatcher.conf"
+	mailMaxMessageSize    = 25 << 20
+	mailMaxRecipients     = 100
+	smtpCommandTimeout    = 5 * time.Minute
+	phpMailSenderFallback = "gecko@localhost"
+)
+
+var (
+	mailMu         sync.Mutex
+	mailSMTPLn     net.Listener
+	mailHTTPServer *http.Server
+	mailSeq        uint32
+	errMailTooBig  = errors.New("message exceeds the size limit")
+)
+
+func IsMailCatcherRunning() bool {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+	return mailSMTPLn != nil
+}
+
+func mailCatcherEnabled() bool {
+	config, err := GetConfig()
+	return err == nil && config.MailCatcherEnabled
+}
+
+// mailCatcherHost is the vhost name the web viewer is reachable under.
+func mailCatcherHost() string {
+	return "mail" + getDefaultDomainSuffix()
+}
+
+// StartMailCatcher accepts mail for any recipient on localhost and stores it
+// under C:\Gecko\mail instead of delivering it, and serves the web viewer.
+func StartMailCatcher() error {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+	if mailSMTPLn != nil {
+		return nil
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mailDir, os.ModePerm); err != nil {
+		return err
+	}
+	smtpLn, err := net.Listen("tcp", "127.0.0.1:"+config.MailSMTPPort)
+	if err != nil {
+		return fmt.Errorf("could not listen on port %s: %w", config.MailSMTPPort, err)
+	}
+	httpLn, err := net.Listen("tcp", "127.0.0.1:"+config.MailHTTPPort)
+	if err != nil {
+		smtpLn.Close()
+		return fmt.Errorf("could not listen on port %s: %w", config.MailHTTPPort, err)
+	}
+	mailSMTPLn = smtpLn
+	mailHTTPServer = &http.Server{Handler: newMailViewer()}
+	go serveSMTP(smtpLn)
+	go mailHTTPServer.Serve(httpLn)
+	return nil
+}
+
+func StopMailCatcher() {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+	if mailSMTPLn != nil {
+		mailSMTPLn.Close()
+		mailHTTPServer.Close()
+		mailSMTPLn, mailHTTPServer = nil, nil
+	}
+}
+
+// ToggleMailCatcher starts or stops the catcher, points every installed PHP
+// at it (or back at the defaults) and publishes the viewer as a vhost.
+func ToggleMailCatcher() {
+	config, err := GetConfig()
+	if err != nil {
+		fmt.Printf("%sFailed to load configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	host := mailCatcherHost()
+
+	if config.MailCatcherEnabled {
+		StopMailCatcher()
+		config.MailCatcherEnabled = false
+		if err := SaveConfig(config); err != nil {
+			fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return
+		}
+		configurePHPMail(false, config)
+		os.Remove(filepath.Join(sitesEnabledDir(), mailSiteConfigName))
+		if err := updateHostsFile(host, false); err != nil {
+			fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
+		restartPHPHosts()
+		fmt.Printf("%sMail catcher stopped. PHP mail settings restored to their defaults.%s\n", shared.ColorGreen, shared.ColorReset)
+		return
+	}
+
+	fmt.Printf("%sStarting mail catcher on 127.0.0.1:%s...%s\n", shared.ColorYellow, config.MailSMTPPort, shared.ColorReset)
+	if err := StartMailCatcher(); err != nil {
+		fmt.Printf("%sError starting mail catcher: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	config.MailCatcherEnabled = true
+	if err := SaveConfig(config); err != nil {
+		StopMailCatcher()
+		fmt.Printf("%sFailed to save configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	configurePHPMail(true, config)
+
+	if err := publishMailCatcherSite(); err != nil {
+		fmt.Printf("%sCould not publish %s: %v%s\n", shared.ColorRed, host, err, shared.ColorReset)
+	}
+	if err := updateHostsFile(host, true); err != nil {
+		fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	restartPHPHosts()
+	fmt.Printf("%sMail catcher active. Mail sent by PHP is kept in %s.%s\n", shared.ColorGreen, mailDir, shared.ColorReset)
+	fmt.Printf("View it at http://%s or with \"gecko mail list\".\n", host)
+}
+
+// restartPHPHosts makes the web server and php-cgi pick up php.ini changes.
+func restartPHPHosts() {
+	if IsServiceRunning("php-cgi.exe") {
+		stopPHPFastCGI()
+		startPHPFastCGI()
+	}
+	if IsWebServerRunning() {
+		RestartWebServer()
+	}
+}
+
+func publishMailCatcherSite() error {
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		return err
+	}
+	if err := writeMailCatcherSite(); err != nil {
+		snap.restore()
+		return err
+	}
+	if !commitWebServerConfig(snap) {
+		return fmt.Errorf("%s rejected the viewer site", WebServerName())
+	}
+	return nil
+}
+
+// writeMailCatcherSite proxies the viewer host to the catcher's HTTP port.
+// Caught mail holds password reset links, so like any site it is only open to
+// this computer outside development mode; it is re-rendered when that
+// changes. The file is named so that ListVirtualHosts does not report it as a
+// site.
+func writeMailCatcherSite() error {
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	httpPort, _ := webServerPorts(config)
+	upstream := "http://127.0.0.1:" + config.MailHTTPPort
+	access := &vhostSpec{Domain: mailCatcherHost(), DevMode: config.DevelopmentMode}
+	var content string
+	if activeWebServer() == webServerNginx {
+		content = fmt.Sprintf(`server {
+    listen %s;
+    server_name %s;
+
+    location / {
+%s        proxy_pass %s;
+        proxy_set_header Host $host;
+    }
+}
+`, httpPort, mailCatcherHost(), nginxAccessRules(access, "        "), upstream)
+	} else {
+		content = fmt.Sprintf(`<IfModule !proxy_module>
+    LoadModule proxy_module modules/mod_proxy.so
+</IfModule>
+<IfModule !proxy_http_module>
+    LoadModule proxy_http_module modules/mod_proxy_http.so
+</IfModule>
+
+<VirtualHost *:%s>
+    ServerName %s
+    ProxyPreserveHost On
+    ProxyPass / %s/
+    ProxyPassReverse / %s/
+    <Location "/">
+%s    </Location>
+</VirtualHost>
+`, httpPort, mailCatcherHost(), upstream, upstream, apacheAccessDirectives(access, "        "))
+	}
+	if err := os.MkdirAll(sitesEnabledDir(), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sitesEnabledDir(), mailSiteConfigName), []byte(content), 0644)
+}
+
+// configurePHPMail sets the [mail function] settings in every installed PHP
+// version. PHP on Windows ignores sendmail_path and talks SMTP directly.
+func configurePHPMail(enable bool, config *Config) {
+	settings := map[string]string{"SMTP": "localhost", "smtp_port": "25"}
+	if enable {
+		settings = map[string]string{
+			"SMTP":          "127.0.0.1",
+			"smtp_port":     config.MailSMTPPort,
+			"sendmail_from": phpMailSenderFallback,
+		}
+	}
+	versions, err := listInstalledPHPVersions()
+	if err != nil {
+		fmt.Printf("%sNo PHP versions found in '%s'.%s\n", shared.ColorYellow, phpBaseDir, shared.ColorReset)
+		return
+	}
+	for _, version := range versions {
+		iniPath := filepath.Join(phpBaseDir, version, "php.ini")
+		if _, err := os.Stat(iniPath); err != nil {
+			fmt.Printf("%sSkipping %s: no php.ini%s\n", shared.ColorYellow, version, shared.ColorReset)
+			continue
+		}
+		if !enable {
+			// Only our own sender default is removed; a user's value stays.
+			if err := setINIValues(iniPath, "mail function", map[string]string{"sendmail_from": ""}, phpMailSenderFallback); err != nil {
+				fmt.Printf("%sCould not update %s: %v%s\n", shared.ColorRed, iniPath, err, shared.ColorReset)
+				continue
+			}
+		}
+		if err := setINIValues(iniPath, "mail function", settings, ""); err != nil {
+			fmt.Printf("%sCould not update %s: %v%s\n", shared.ColorRed, iniPath, err, shared.ColorReset)
+			continue
+		}
+		fmt.Printf("Updated mail settings in %s\n", iniPath)
+	}
+}
+
+// setINIValues replaces the active (or commented-out) lines for each key and
+// appends missing keys to section. An empty value comments the key out; with
+// onlyIf set, a key is only touched while it still has that value.
+func setINIValues(path, section string, values map[string]string, onlyIf string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	done := make(map[string]bool)
+	sectionEnd := -1
+	inSection := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			inSection = strings.EqualFold(strings.Trim(trimmed, "[]"), section)
+			if inSection {
+				sectionEnd = i + 1
+			}
+			continue
+		}
+		if inSection && trimmed != "" {
+			sectionEnd = i + 1
+		}
+		commented := strings.HasPrefix(trimmed, ";")
+		key, current, ok := strings.Cut(strings.TrimLeft(trimmed, "; "), "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value, managed := values[key]
+		if !managed || done[key] || (commented && !inSection) {
+			continue
+		}
+		if onlyIf != "" && (commented || strings.TrimSpace(current) != onlyIf) {
+			continue
+		}
+		if value == "" {
+			if !commented {
+				lines[i] = ";" + key + " = " + strings.TrimSpace(current)
+			}
+		} else {
+			lines[i] = key + " = " + value
+		}
+		done[key] = true
+	}
+
+	if onlyIf == "" {
+		var missing []string
+		for _, key := range sortedEnvKeys(values) {
+			if !done[key] && values[key] != "" {
+				missing = append(missing, key+" = "+values[key])
+			}
+		}
+		if len(missing) > 0 {
+			if sectionEnd < 0 {
+				lines = append(lines, "", "["+section+"]")
+				sectionEnd = len(lines)
+			}
+			lines = append(lines[:sectionEnd], append(missing, lines[sectionEnd:]...)...)
+		}
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\r\n")), 0644)
+}
+
+func serveSMTP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleSMTPSession(conn)
+	}
+}
+
+var smtpPathPattern = regexp.MustCompile(`(?i)^(MAIL FROM|RCPT TO):\s*<([^>]*)>`)
+
+// handleSMTPSession speaks just enough RFC 5321 for PHP's mail(), PHPMailer
+// and Symfony Mailer: any sender, any recipient, optional AUTH that always
+// succeeds, no TLS.
+func handleSMTPSession(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	var from string
+	var rcpts []string
+	reply("220 gecko ESMTP mail catcher ready")
+	for {
+		conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "HELO":
+			reply("250 gecko")
+		case "EHLO":
+			reply("250-gecko\r\n250-SIZE %d\r\n250-8BITMIME\r\n250-AUTH PLAIN LOGIN\r\n250 SMTPUTF8", mailMaxMessageSize)
+		case "AUTH":
+			// Any credentials are accepted; read and discard them.
+			fields := strings.Fields(line)
+			var prompts []string
+			switch {
+			case len(fields) == 2 && strings.EqualFold(fields[1], "LOGIN"):
+				prompts = []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"}
+			case len(fields) == 3 && strings.EqualFold(fields[1], "LOGIN"):
+				prompts = []string{"UGFzc3dvcmQ6"}
+			case len(fields) == 2:
+				prompts = []string{""}
+			}
+			for _, prompt := range prompts {
+				reply("334 %s", prompt)
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			m := smtpPathPattern.FindStringSubmatch(line)
+			if m == nil {
+				reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			from, rcpts = m[2], nil
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			m := smtpPathPattern.FindStringSubmatch(line)
+			if m == nil {
+				reply("501 5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(rcpts) >= mailMaxRecipients {
+				reply("452 4.5.3 Too many recipients")
+				continue
+			}
+			rcpts = append(rcpts, m[2])
+			reply("250 2.1.5 OK")
+		case "DATA":
+			if len(rcpts) == 0 {
+				reply("503 5.5.1 RCPT first")
+				continue
+			}
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data, err := readSMTPData(r)
+			if err == errMailTooBig {
+				reply("552 5.3.4 Message too big")
+				continue
+			}
+			if err != nil {
+				return
+			}
+			id, err := storeMail(from, rcpts, data)
+			if err != nil {
+				reply("451 4.3.0 Could not store message: %v", err)
+				continue
+			}
+			reply("250 2.0.0 OK queued as %s", id)
+			from, rcpts = "", nil
+		case "RSET":
+			from, rcpts = "", nil
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "VRFY":
+			reply("252 2.1.5 Cannot verify, but will accept")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 Command not implemented")
+		}
+	}
+}
+
+// readSMTPData reads up to the lone "." line and undoes dot-stuffing.
+func readSMTPData(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	tooBig := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+		if buf.Len()+len(line) > mailMaxMessageSize {
+			tooBig = true
+			continue
+		}
+		buf.WriteString(line)
+	}
+	if tooBig {
+		return nil, errMailTooBig
+	}
+	return buf.Bytes(), nil
+}
+
+// storeMail writes the message as an .eml file named by its arrival time, with
+// the envelope recorded in headers so Bcc recipients remain visible.
+func storeMail(from string, rcpts []string, data []byte) (string, error) {
+	mailMu.Lock()
+	mailSeq++
+	id := fmt.Sprintf("%s-%04d", time.Now().Format("20060102-150405"), mailSeq%10000)
+	mailMu.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Gecko-Envelope-From: <%s>\r\n", from)
+	fmt.Fprintf(&buf, "X-Gecko-Envelope-To: %s\r\n", strings.Join(rcpts, ", "))
+	fmt.Fprintf(&buf, "X-Gecko-Received: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.Write(data)
+
+	path := filepath.Join(mailDir, id+".eml")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, path)
+}
+
+// readMailFile reads a stored message by the ID printed in listings.
+func readMailFile(id string) ([]byte, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("invalid message id '%s'", id)
+	}
+	data, err := os.ReadFile(filepath.Join(mailDir, id+".eml"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("message '%s' not found", id)
+	}
+	return data, err
+}
+
+func DeleteMail(id string) error {
+	if _, err := readMailFile(id); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(mailDir, id+".eml"))
+}
+
+// ClearMail deletes every stored message and returns how many there were.
+func ClearMail() (int, error) {
+	ids, err := listMailIDs()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if err := os.Remove(filepath.Join(mailDir, id+".eml")); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// listMailIDs returns stored message IDs, newest first.
+func listMailIDs() ([]string, error) {
+	files, err := os.ReadDir(mailDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for i := len(files) - 1; i >= 0; i-- {
+		if name := files[i].Name(); strings.HasSuffix(name, ".eml") {
+			ids = append(ids, strings.TrimSuffix(name, ".eml"))
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,411 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"gecko/internal/shared"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mailMaxPartDepth = 10
+
+type mailHeaderField struct {
+	Name, Value string
+}
+
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+type parsedMail struct {
+	ID          string
+	From        string
+	To          string
+	Cc          string
+	EnvelopeTo  string
+	Subject     string
+	Date        time.Time
+	Size        int
+	Headers     []mailHeaderField
+	Text        string
+	HTML        string
+	Attachments []mailAttachment
+}
+
+var mailWordDecoder = &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+	return strings.NewReader(decodeCharset(charset, mustReadAll(input))), nil
+}}
+
+func mustReadAll(r io.Reader) []byte {
+	data, _ := io.ReadAll(r)
+	return data
+}
+
+// decodeCharset converts the 8-bit Western charsets to UTF-8; anything else
+// is shown as-is.
+func decodeCharset(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
+
+func decodeMailHeader(value string) string {
+	if decoded, err := mailWordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func loadMail(id string) (*parsedMail, error) {
+	data, err := readMailFile(id)
+	if err != nil {
+		return nil, err
+	}
+	return parseMail(id, data)
+}
+
+func parseMail(id string, data []byte) (*parsedMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("message '%s' is not valid: %w", id, err)
+	}
+	m := &parsedMail{
+		ID:         id,
+		From:       decodeMailHeader(msg.Header.Get("From")),
+		To:         decodeMailHeader(msg.Header.Get("To")),
+		Cc:         decodeMailHeader(msg.Header.Get("Cc")),
+		EnvelopeTo: msg.Header.Get("X-Gecko-Envelope-To"),
+		Subject:    decodeMailHeader(msg.Header.Get("Subject")),
+		Size:       len(data),
+		Headers:    readHeaderFields(data),
+	}
+	if m.Date, err = msg.Header.Date(); err != nil {
+		m.Date, _ = time.Parse(time.RFC1123Z, msg.Header.Get("X-Gecko-Received"))
+	}
+	walkMailPart(textproto.MIMEHeader(msg.Header), msg.Body, m, 0)
+	return m, nil
+}
+
+// readHeaderFields keeps headers in the order they were sent, which net/mail
+// does not.
+func readHeaderFields(data []byte) []mailHeaderField {
+	var fields []mailHeaderField
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields = append(fields, mailHeaderField{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+	for i := range fields {
+		fields[i].Value = decodeMailHeader(fields[i].Value)
+	}
+	return fields
+}
+
+// walkMailPart collects the first text/plain and text/html bodies and treats
+// every other leaf part as an attachment.
+func walkMailPart(header textproto.MIMEHeader, body io.Reader, m *parsedMail, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && depth < mailMaxPartDepth {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			walkMailPart(part.Header, part, m, depth+1)
+		}
+	}
+
+	var decoded io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		decoded = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		decoded = quotedprintable.NewReader(body)
+	}
+	data, _ := io.ReadAll(io.LimitReader(decoded, mailMaxMessageSize))
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	isAttachment := disposition == "attachment" || filename != ""
+	switch {
+	case mediaType == "text/plain" && !isAttachment && m.Text == "":
+		m.Text = decodeCharset(params["charset"], data)
+	case mediaType == "text/html" && !isAttachment && m.HTML == "":
+		m.HTML = decodeCharset(params["charset"], data)
+	default:
+		if filename == "" {
+			filename = fmt.Sprintf("part-%d", len(m.Attachments)+1)
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				filename += exts[0]
+			}
+		}
+		m.Attachments = append(m.Attachments, mailAttachment{
+			Filename:    decodeMailHeader(filename),
+			ContentType: mediaType,
+			ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+			Data:        data,
+		})
+	}
+}
+
+// ListMail prints the stored messages, newest first.
+func ListMail() error {
+	ids, err := listMailIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Printf("%sNo messages caught yet.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	fmt.Printf("%s%-20s  %-16s  %-28s  %s%s\n", shared.ColorGreen, "ID", "Received", "To", "Subject", shared.ColorReset)
+	for _, id := range ids {
+		m, err := loadMail(id)
+		if err != nil {
+			fmt.Printf("%-20s  %s(unreadable: %v)%s\n", id, shared.ColorRed, err, shared.ColorReset)
+			continue
+		}
+		fmt.Printf("%-20s  %-16s  %-28s  %s\n", id, m.Date.Local().Format("2006-01-02 15:04"), truncateForDisplay(m.To, 28), m.Subject)
+	}
+	return nil
+}
+
+// ShowMail prints a message: headers, then the text body (or the HTML source
+// when html is set, or the whole raw message when raw is set).
+func ShowMail(id string, html, raw bool) error {
+	if raw {
+		data, err := readMailFile(id)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(data)
+		return nil
+	}
+	m, err := loadMail(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sFrom:%s    %s\n", shared.ColorYellow, shared.ColorReset, m.From)
+	fmt.Printf("%sTo:%s      %s\n", shared.ColorYellow, shared.ColorReset, m.To)
+	if m.Cc != "" {
+		fmt.Printf("%sCc:%s      %s\n", shared.ColorYellow, shared.ColorReset, m.Cc)
+	}
+	fmt.Printf("%sRcpt:%s    %s\n", shared.ColorYellow, shared.ColorReset, m.EnvelopeTo)
+	fmt.Printf("%sDate:%s    %s\n", shared.ColorYellow, shared.ColorReset, m.Date.Local().Format(time.RFC1123))
+	fmt.Printf("%sSubject:%s %s\n\n", shared.ColorYellow, shared.ColorReset, m.Subject)
+
+	switch {
+	case html && m.HTML != "":
+		fmt.Println(m.HTML)
+	case m.Text != "":
+		fmt.Println(m.Text)
+	case m.HTML != "":
+		fmt.Printf("%s(HTML only; use --html to see the source or open http://%s/m/%s)%s\n", shared.ColorGray, mailCatcherHost(), m.ID, shared.ColorReset)
+	default:
+		fmt.Printf("%s(empty body)%s\n", shared.ColorGray, shared.ColorReset)
+	}
+	if len(m.Attachments) > 0 {
+		fmt.Printf("\n%sAttachments%s\n", shared.ColorYellow, shared.ColorReset)
+		for i, a := range m.Attachments {
+			fmt.Printf("  %d. %s (%s, %s)\n", i+1, a.Filename, a.ContentType, formatBytes(int64(len(a.Data))))
+		}
+		fmt.Printf("Save one with: gecko mail attachment %s <number> [dir]\n", m.ID)
+	}
+	return nil
+}
+
+// SaveMailAttachment writes attachment n (1-based) of a message into dir.
+func SaveMailAttachment(id string, n int, dir string) error {
+	m, err := loadMail(id)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(m.Attachments) {
+		return fmt.Errorf("message '%s' has %d attachment(s)", id, len(m.Attachments))
+	}
+	a := m.Attachments[n-1]
+	if dir == "" {
+		dir = "."
+	}
+	path := filepath.Join(dir, filepath.Base(filepath.Clean("/"+a.Filename)))
+	if err := os.WriteFile(path, a.Data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%sSaved %s%s\n", shared.ColorGreen, path, shared.ColorReset)
+	return nil
+}
+
+// mailViewerToken is embedded in the viewer's forms and required on every
+// POST, so another site open in the browser cannot delete the caught mail.
+var mailViewerToken = randomToken()
+
+var mailViewerFuncs = template.FuncMap{"csrfToken": func() string { return mailViewerToken }}
+
+var mailListTemplate = template.Must(template.New("list").Funcs(mailViewerFuncs).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="10">
+<title>Gecko Mail</title>` + mailViewerStyle + `</head><body>
+<h1>Gecko Mail <small>{{len .}} message(s)</small></h1>
+<form method="post" action="/clear"><input type="hidden" name="token" value="{{csrfToken}}"><button>Delete all</button></form>
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .}}<tr><td>{{.Date.Local.Format "2006-01-02 15:04:05"}}</td><td>{{.From}}</td><td>{{.To}}</td>
+<td><a href="/m/{{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a>{{if .Attachments}} &#128206;{{end}}</td><td>{{.Size}}</td></tr>
+{{else}}<tr><td colspan="5">No messages caught yet. Mail sent by PHP will appear here.</td></tr>{{end}}
+</table></body></html>`))
+
+var mailMessageTemplate = template.Must(template.New("message").Funcs(mailViewerFuncs).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Subject}} - Gecko Mail</title>` + mailViewerStyle + `</head><body>
+<p><a href="/">&larr; Inbox</a></p>
+<h1>{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</h1>
+<table class="meta">
+<tr><th>From</th><td>{{.From}}</td></tr><tr><th>To</th><td>{{.To}}</td></tr>
+{{if .Cc}}<tr><th>Cc</th><td>{{.Cc}}</td></tr>{{end}}
+<tr><th>Recipients</th><td>{{.EnvelopeTo}}</td></tr>
+<tr><th>Date</th><td>{{.Date.Local.Format "2006-01-02 15:04:05 -0700"}}</td></tr>
+</table>
+{{if .Attachments}}<p>Attachments: {{range $i, $a := .Attachments}}<a href="/m/{{$.ID}}/part/{{$i}}">{{$a.Filename}}</a> ({{$a.ContentType}}) {{end}}</p>{{end}}
+<p class="tabs">{{if .HTML}}<a href="#html">HTML</a>{{end}} {{if .Text}}<a href="#text">Text</a>{{end}} <a href="#headers">Headers</a> <a href="/m/{{.ID}}/raw">Raw</a></p>
+<form method="post" action="/m/{{.ID}}/delete"><input type="hidden" name="token" value="{{csrfToken}}"><button>Delete</button></form>
+{{if .HTML}}<h2 id="html">HTML</h2><iframe sandbox src="/m/{{.ID}}/html"></iframe>{{end}}
+{{if .Text}}<h2 id="text">Text</h2><pre>{{.Text}}</pre>{{end}}
+<h2 id="headers">Headers</h2>
+<table class="meta">{{range .Headers}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+</body></html>`))
+
+const mailViewerStyle = `<style>
+body{font-family:Segoe UI,sans-serif;margin:2em;color:#222}
+table{border-collapse:collapse;width:100%}th,td{text-align:left;padding:4px 8px;border-bottom:1px solid #ddd;vertical-align:top}
+table.meta th{width:10em;color:#555}h1 small{font-size:50%;color:#777}
+iframe{width:100%;height:60vh;border:1px solid #ccc}pre{white-space:pre-wrap;background:#f6f6f6;padding:1em}
+form{display:inline}</style>`
+
+// newMailViewer serves the caught messages. Message HTML is only ever
+// rendered in a sandboxed frame with a locked-down CSP.
+func newMailViewer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		ids, err := listMailIDs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var messages []*parsedMail
+		for _, id := range ids {
+			if m, err := loadMail(id); err == nil {
+				messages = append(messages, m)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mailListTemplate.Execute(w, messages)
+	})
+	mux.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !validMailViewerToken(r) {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		ClearMail()
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/m/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/m/"), "/")
+		m, err := loadMail(parts[0])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 1:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			mailMessageTemplate.Execute(w, m)
+		case parts[1] == "html":
+			html := m.HTML
+			for i, a := range m.Attachments {
+				if a.ContentID != "" {
+					html = strings.ReplaceAll(html, "cid:"+a.ContentID, fmt.Sprintf("/m/%s/part/%d", m.ID, i))
+				}
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data: http: https:; style-src 'unsafe-inline' http: https:; font-src data: http: https:")
+			io.WriteString(w, html)
+		case parts[1] == "raw":
+			data, _ := readMailFile(m.ID)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(data)
+		case parts[1] == "part" && len(parts) == 3:
+			n, err := strconv.Atoi(parts[2])
+			if err != nil || n < 0 || n >= len(m.Attachments) {
+				http.NotFound(w, r)
+				return
+			}
+			a := m.Attachments[n]
+			w.Header().Set("Content-Type", a.ContentType)
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Filename}))
+			w.Write(a.Data)
+		case parts[1] == "delete" && r.Method == http.MethodPost:
+			if !validMailViewerToken(r) {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+			DeleteMail(m.ID)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+func validMailViewerToken(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(mailViewerToken)) == 1
+}
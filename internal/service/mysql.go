@@ -2,10 +2,13 @@ package service
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"gecko/internal/shared"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 )
 
@@ -15,9 +18,17 @@ const (
 	mysqlDataDir      = `C:\Gecko\etc\config\mysql\`
 	mysqlLogError     = `C:\Gecko\logs\mysql\mysql_error.log`
 	mysqlBinLog       = `C:\Gecko\logs\mysql\binlog`
+	mysqlClientExe    = `C:\Gecko\bin\mysql\bin\mysql.exe`
+	mysqlDumpExe      = `C:\Gecko\bin\mysql\bin\mysqldump.exe`
 )
 
-func runMysqlInstallDb() bool {
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,63}$`)
+
+// runMysqlInstallDb creates the data directory with the given root password
+// and records the password in the config once that succeeded. The password is
+// set afterwards through a bootstrap run that reads it from stdin, so it never
+// shows up on a command line.
+func runMysqlInstallDb(password string) bool {
 	fmt.Printf("%sRunning mysql_install_db.exe...%s\n", shared.ColorYellow, shared.ColorReset)
 	cmd := exec.Command(mysqlInstallDbExe, "--datadir="+mysqlDataDir)
 	output, err := cmd.CombinedOutput()
@@ -27,11 +38,41 @@ func runMysqlInstallDb() bool {
 		fmt.Println(string(output))
 		return false
 	}
+	if err := setInitialMySQLRootPassword(password); err != nil {
+		fmt.Printf("%sError setting the MySQL root password: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return false
+	}
 
 	fmt.Printf("%sMySQL database initialized successfully.%s\n", shared.ColorGreen, shared.ColorReset)
+	if err := saveMySQLRootPassword(password); err != nil {
+		fmt.Printf("%sFailed to save the root password to config: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
 	return true
 }
 
+// setInitialMySQLRootPassword runs mysqld in bootstrap mode on the fresh data
+// directory. FLUSH PRIVILEGES loads the grant tables bootstrap skips.
+func setInitialMySQLRootPassword(password string) error {
+	if password == "" {
+		return nil
+	}
+	cmd := exec.Command(mysqlExe, "--bootstrap", "--datadir="+mysqlDataDir, "--console")
+	cmd.Stdin = strings.NewReader("FLUSH PRIVILEGES;\nALTER USER 'root'@'localhost' IDENTIFIED BY " + sqlQuote(password) + ";\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func saveMySQLRootPassword(password string) error {
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	config.MySQLRootPassword = password
+	return SaveConfig(config)
+}
+
 func checkAndInitializeIfNeeded() bool {
 	dir, err := os.ReadDir(mysqlDataDir)
 	if err != nil {
@@ -46,7 +87,16 @@ func checkAndInitializeIfNeeded() bool {
 
 	if len(dir) == 0 {
 		fmt.Printf("%sMySQL data directory is empty. Automatically initializing...%s\n", shared.ColorYellow, shared.ColorReset)
-		return runMysqlInstallDb()
+		password, err := generateRandomPassword(16)
+		if err != nil {
+			fmt.Printf("%sFailed to generate random password: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return false
+		}
+		if !runMysqlInstallDb(password) {
+			return false
+		}
+		fmt.Printf("%sMySQL root password: %s%s%s (saved in the config, shown again from the menu)\n", shared.ColorGreen, shared.ColorYellow, password, shared.ColorReset)
+		return true
 	}
 
 	return false
@@ -86,7 +136,7 @@ func StartMySQL() {
 	fmt.Printf("%sMySQL started in background on %s:%s.%s\n", shared.ColorGreen, bindAddress, config.MySQLPort, shared.ColorReset)
 }
 
-func InitializeMySQL() {
+func InitializeMySQL(reader *bufio.Reader) {
 	fmt.Printf("%sManual MySQL database initialization...%s\n", shared.ColorYellow, shared.ColorReset)
 	dir, _ := os.ReadDir(mysqlDataDir)
 
@@ -94,7 +144,6 @@ func InitializeMySQL() {
 		fmt.Printf("%sWarning: The MySQL data directory is not empty.%s\n", shared.ColorRed, shared.ColorReset)
 		fmt.Print(shared.ColorYellow, "Do you want to delete existing data and reinitialize? (y/n): ", shared.ColorReset)
 
-		reader := bufio.NewReader(os.Stdin)
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(strings.ToLower(choice))
 
@@ -107,7 +156,12 @@ func InitializeMySQL() {
 		os.MkdirAll(mysqlDataDir, os.ModePerm)
 		fmt.Printf("%sData directory cleared.%s\n", shared.ColorGreen, shared.ColorReset)
 	}
-	runMysqlInstallDb()
+	password, err := readRootPassword(reader, "Enter a password for MySQL 'root' (or press Enter for a random one): ")
+	if err != nil {
+		fmt.Printf("%s%v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	runMysqlInstallDb(password)
 }
 
 func StopMySQL() {
@@ -117,3 +171,165 @@ func StopMySQL() {
 		fmt.Printf("%sMySQL stopped.%s\n", shared.ColorYellow, shared.ColorReset)
 	}
 }
+
+func isValidSQLIdentifier(name string) bool {
+	return sqlIdentifierPattern.MatchString(name)
+}
+
+func sqlQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// mysqlCommand runs a MySQL client tool as root. The password travels in
+// MYSQL_PWD rather than on the command line.
+func mysqlCommand(exe string, args ...string) *exec.Cmd {
+	config, _ := GetConfig()
+	return mysqlCommandAs(config.MySQLRootPassword, exe, args...)
+}
+
+func mysqlCommandAs(password, exe string, args ...string) *exec.Cmd {
+	return mysqlCommandAsUser("root", password, exe, args...)
+}
+
+func mysqlCommandAsUser(user, password, exe string, args ...string) *exec.Cmd {
+	config, _ := GetConfig()
+	baseArgs := []string{"--host=127.0.0.1", "--port=" + config.MySQLPort, "--user=" + user}
+	cmd := exec.Command(exe, append(baseArgs, args...)...)
+	cmd.Env = os.Environ()
+	if password != "" {
+		cmd.Env = append(cmd.Env, "MYSQL_PWD="+password)
+	}
+	return cmd
+}
+
+func runMySQLQuery(query string) (string, error) {
+	config, _ := GetConfig()
+	return runMySQLQueryAs(config.MySQLRootPassword, query)
+}
+
+func runMySQLQueryAs(password, query string) (string, error) {
+	cmd := mysqlCommandAs(password, mysqlClientExe, "--batch", "--skip-column-names", "-e", query)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("mysql query failed: %v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+func dumpMySQLDatabase(dbName string, out io.Writer) error {
+	if !isValidSQLIdentifier(dbName) {
+		return fmt.Errorf("invalid database name '%s'", dbName)
+	}
+	if !IsServiceRunning("mysqld.exe") {
+		return fmt.Errorf("MySQL is not running. Please start it first")
+	}
+	var stderr bytes.Buffer
+	cmd := mysqlCommand(mysqlDumpExe, "--single-transaction", "--routines", "--triggers", dbName)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mysqldump failed: %v\nOutput: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func ensureMySQLDatabase(db *VHostDatabase) error {
+	if !isValidSQLIdentifier(db.Name) || !isValidSQLIdentifier(db.User) {
+		return fmt.Errorf("invalid database or user name")
+	}
+	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%[1]s` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci; "+
+		"CREATE USER IF NOT EXISTS '%[2]s'@'localhost' IDENTIFIED BY %[3]s; "+
+		"ALTER USER '%[2]s'@'localhost' IDENTIFIED BY %[3]s; "+
+		"GRANT ALL PRIVILEGES ON `%[1]s`.* TO '%[2]s'@'localhost'; FLUSH PRIVILEGES;",
+		db.Name, db.User, sqlQuote(db.Password))
+	_, err := runMySQLQuery(query)
+	return err
+}
+
+func restoreMySQLDatabase(db *VHostDatabase, in io.Reader) error {
+	if !IsServiceRunning("mysqld.exe") {
+		return fmt.Errorf("MySQL is not running. Please start it first")
+	}
+	if err := ensureMySQLDatabase(db); err != nil {
+		return err
+	}
+	// Restore as the application user so the dump cannot touch anything
+	// beyond its own database.
+	cmd := mysqlCommandAsUser(db.User, db.Password, mysqlClientExe, db.Name)
+	cmd.Stdin = in
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mysql restore failed: %v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ManageMySQLRootPassword shows the saved root password and offers to
+// change it on the running server.
+func ManageMySQLRootPassword(reader *bufio.Reader) {
+	config, err := GetConfig()
+	if err != nil {
+		fmt.Printf("%sFailed to load configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	if config.MySQLRootPassword == "" {
+		fmt.Println("No MySQL root password has been saved; root may have no password at all.")
+	} else {
+		fmt.Printf("MySQL Superuser (root) Password: %s%s%s\n", shared.ColorGreen, config.MySQLRootPassword, shared.ColorReset)
+	}
+	fmt.Print(shared.ColorYellow, "Change it? (y/n): ", shared.ColorReset)
+	choice, _ := reader.ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(choice)) != "y" {
+		return
+	}
+	if err := ChangeMySQLRootPassword(reader); err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+}
+
+// ChangeMySQLRootPassword sets a new password on every root account of the
+// running server and saves it in the config. If the saved password no
+// longer works, the current one is asked for.
+func ChangeMySQLRootPassword(reader *bufio.Reader) error {
+	if !IsServiceRunning("mysqld.exe") {
+		return fmt.Errorf("MySQL is not running. Please start it first")
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	current := config.MySQLRootPassword
+	hosts, err := runMySQLQueryAs(current, "SELECT Host FROM mysql.user WHERE User = 'root'")
+	if err != nil && strings.Contains(err.Error(), "Access denied") {
+		fmt.Print(shared.ColorYellow, "The saved password was rejected. Current MySQL root password: ", shared.ColorReset)
+		current, _ = reader.ReadString('\n')
+		current = strings.TrimSpace(current)
+		hosts, err = runMySQLQueryAs(current, "SELECT Host FROM mysql.user WHERE User = 'root'")
+	}
+	if err != nil {
+		return err
+	}
+
+	password, err := readRootPassword(reader, "Enter the new password for MySQL 'root' (or press Enter for a random one): ")
+	if err != nil {
+		return err
+	}
+	var statements []string
+	for _, host := range strings.Split(hosts, "\n") {
+		if host = strings.TrimSpace(host); host != "" {
+			statements = append(statements, fmt.Sprintf("ALTER USER 'root'@%s IDENTIFIED BY %s;", sqlQuote(host), sqlQuote(password)))
+		}
+	}
+	if len(statements) == 0 {
+		return fmt.Errorf("no root account found on the server")
+	}
+	if _, err := runMySQLQueryAs(current, strings.Join(statements, " ")+" FLUSH PRIVILEGES;"); err != nil {
+		return err
+	}
+	if err := saveMySQLRootPassword(password); err != nil {
+		return fmt.Errorf("the password was changed but could not be saved in the config: %w", err)
+	}
+	fmt.Printf("%sMySQL root password changed and saved in the config.%s\n", shared.ColorGreen, shared.ColorReset)
+	return nil
+}
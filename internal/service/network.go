@@ -0,0 +1,36 @@
+package service
+
+import (
+	"net"
+)
+
+// getLANIPs returns the addresses other devices on the local network can use
+// to reach this machine, IPv4 first.
+func getLANIPs() []net.IP {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var v4, v6 []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				v4 = append(v4, ip4)
+			} else {
+				v6 = append(v6, ipNet.IP)
+			}
+		}
+	}
+	return append(v4, v6...)
+}
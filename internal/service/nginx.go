@@ -0,0 +1,326 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nginxExe               = `C:\Gecko\bin\nginx\nginx.exe`
+	nginxDir               = `C:\Gecko\bin\nginx\`
+	nginxConfigDir         = `C:\Gecko\etc\config\nginx`
+	nginxConfFile          = `C:\Gecko\etc\config\nginx\nginx.conf`
+	nginxSitesEnabledDir   = `C:\Gecko\etc\config\nginx\sites-enabled`
+	nginxSitesAvailableDir = `C:\Gecko\etc\config\nginx\sites-available`
+	nginxLogDir            = `C:\Gecko\logs\nginx`
+	phpCgiExe              = `C:\Gecko\bin\php\php\php-cgi.exe`
+	defaultFastCGIPort     = "9000"
+)
+
+var nginxErrorPattern = regexp.MustCompile(`\[emerg\] (.+?) in (.+):(\d+)`)
+
+func nginxArgs(extra ...string) []string {
+	return append([]string{"-p", nginxDir, "-c", nginxConfFile}, extra...)
+}
+
+func StartNginx() {
+	if err := ensureNginxConfig(); err != nil {
+		fmt.Printf("%sError preparing nginx config: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	os.MkdirAll(nginxLogDir, os.ModePerm)
+	startPHPFastCGI()
+	cmd := exec.Command(nginxExe, nginxArgs()...)
+	cmd.Dir = nginxDir
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("%sError starting Nginx: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	cmd.Process.Release()
+	fmt.Printf("%sNginx started in background.%s\n", shared.ColorGreen, shared.ColorReset)
+}
+
+func StopNginx() {
+	// A graceful quit first, then make sure nothing is left behind.
+	exec.Command(nginxExe, nginxArgs("-s", "quit")...).Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for IsServiceRunning("nginx.exe") && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+	err := exec.Command("taskkill", "/F", "/IM", "nginx.exe").Run()
+	stopPHPFastCGI()
+	if err == nil || !IsServiceRunning("nginx.exe") {
+		fmt.Printf("%sNginx stopped.%s\n", shared.ColorYellow, shared.ColorReset)
+	}
+}
+
+func RestartNginx() {
+	fmt.Printf("%sRestarting Nginx to apply changes...%s\n", shared.ColorYellow, shared.ColorReset)
+	StopNginx()
+	StartNginx()
+}
+
+// ReloadNginx makes the nginx master re-read its config and replace workers
+// gracefully. Nginx is started if it is not running.
+func ReloadNginx() {
+	if !IsServiceRunning("nginx.exe") {
+		StartNginx()
+		return
+	}
+	fmt.Printf("%sGracefully reloading Nginx...%s\n", shared.ColorYellow, shared.ColorReset)
+	if err := runCmd(nginxExe, nginxArgs("-s", "reload")...); err != nil {
+		fmt.Printf("%sGraceful reload failed (%v). Falling back to a full restart.%s\n", shared.ColorYellow, err, shared.ColorReset)
+		RestartNginx()
+		return
+	}
+	fmt.Printf("%sNginx reloaded.%s\n", shared.ColorGreen, shared.ColorReset)
+}
+
+func testNginxConfig() error {
+	cmd := exec.Command(nginxExe, nginxArgs("-t")...)
+	cmd.Dir = nginxDir
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// Without nginx.exe nothing is validated, so nothing may be committed.
+		return fmt.Errorf("could not run %s to test the configuration: %w", nginxExe, err)
+	}
+	out := strings.TrimSpace(string(output))
+	configErr := &configTestError{Output: out}
+	if m := nginxErrorPattern.FindStringSubmatch(out); m != nil {
+		configErr.Message = m[1]
+		configErr.File = filepath.FromSlash(m[2])
+		configErr.Line, _ = strconv.Atoi(m[3])
+	}
+	return configErr
+}
+
+func fastCGIAddress() string {
+	config, err := GetConfig()
+	if err != nil || config.PHPFastCGIPort == "" {
+		return "127.0.0.1:" + defaultFastCGIPort
+	}
+	return "127.0.0.1:" + config.PHPFastCGIPort
+}
+
+func startPHPFastCGI() {
+	if IsServiceRunning("php-cgi.exe") {
+		return
+	}
+	cmd := exec.Command(phpCgiExe, "-b", fastCGIAddress())
+	// php-cgi exits after 500 requests by default and nothing would restart it.
+	cmd.Env = append(os.Environ(), "PHP_FCGI_MAX_REQUESTS=0")
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("%sError starting PHP FastCGI: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	cmd.Process.Release()
+	fmt.Printf("%sPHP FastCGI started on %s.%s\n", shared.ColorGreen, fastCGIAddress(), shared.ColorReset)
+}
+
+func stopPHPFastCGI() {
+	exec.Command("taskkill", "/F", "/IM", "php-cgi.exe").Run()
+}
+
+func nginxPHPLocation(env map[string]string, indent string) string {
+	lines := []string{
+		`location / {`,
+		`    try_files $uri $uri/ /index.php?$query_string;`,
+		`}`,
+		`location ~ \.php$ {`,
+		`    try_files $uri =404;`,
+		`    fastcgi_pass ` + fastCGIAddress() + `;`,
+		`    fastcgi_index index.php;`,
+		`    include ` + filepath.ToSlash(filepath.Join(nginxDir, "conf", "fastcgi_params")) + `;`,
+		`    fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;`,
+	}
+	if params := nginxEnvParams(env, "    "); params != "" {
+		lines = append(lines, strings.Split(strings.TrimRight(params, "\n"), "\n")...)
+	}
+	lines = append(lines, `}`)
+	return indent + strings.Join(lines, "\n"+indent) + "\n"
+}
+
+func renderNginxServer(spec *vhostSpec) string {
+	docRoot := filepath.ToSlash(spec.DocRoot)
+	logDir := filepath.ToSlash(nginxLogDir)
+	var b strings.Builder
+
+	writeServer := func(listen string, ssl bool) {
+		b.WriteString("server {\n")
+		b.WriteString(fmt.Sprintf("    listen %s;\n", listen))
+		b.WriteString(fmt.Sprintf("    server_name %s;\n", strings.Join(append([]string{spec.Domain}, spec.Aliases...), " ")))
+		b.WriteString(fmt.Sprintf("    root \"%s\";\n", docRoot))
+		b.WriteString("    index index.php index.html index.htm;\n\n")
+		b.WriteString(fmt.Sprintf("    error_log \"%s/%s_error.log\";\n", logDir, spec.Domain))
+		b.WriteString(fmt.Sprintf("    access_log \"%s/%s_access.log\" gecko_timed;\n", logDir, spec.Domain))
+		if ssl {
+			b.WriteString("\n")
+			b.WriteString(fmt.Sprintf("    ssl_certificate     \"%s\";\n", filepath.ToSlash(spec.CertPath)))
+			b.WriteString(fmt.Sprintf("    ssl_certificate_key \"%s\";\n", filepath.ToSlash(spec.KeyPath)))
+			if spec.ClientCA != "" {
+				b.WriteString(fmt.Sprintf("    ssl_client_certificate \"%s\";\n", filepath.ToSlash(spec.ClientCA)))
+				b.WriteString(fmt.Sprintf("    ssl_crl \"%s\";\n", filepath.ToSlash(spec.ClientCRL)))
+				b.WriteString("    ssl_verify_client on;\n")
+				b.WriteString("    ssl_verify_depth 1;\n")
+			}
+		}
+		switch {
+		case spec.HTTPSOnly && !ssl && spec.SSL:
+			b.WriteString(fmt.Sprintf("\n    return 301 %s$request_uri;\n", httpsURL("$host", spec.SSLPort)))
+		case spec.HTTPSOnly && !ssl:
+			b.WriteString("\n    return 403;\n")
+		default:
+			if rules := nginxAccessRules(spec, "    "); rules != "" {
+				b.WriteString("\n" + rules)
+			}
+			// Dotfiles such as .env and .git hold secrets, not content. This
+			// comes before the PHP location so it wins for /.x.php too.
+			b.WriteString("\n    location ~ /\\.(?!well-known(/|$)) {\n        deny all;\n    }\n")
+			b.WriteString(nginxPHPLocation(spec.Env, "    "))
+		}
+		b.WriteString("}\n")
+	}
+
+	writeServer(spec.HTTPPort, false)
+	if spec.SSL {
+		b.WriteString("\n")
+		writeServer(spec.SSLPort+" ssl", true)
+	}
+	return b.String()
+}
+
+// writeNginxMainConfig writes nginx.conf, including the default localhost
+// server that mirrors Apache's 00-default.conf.
+func writeNginxMainConfig() error {
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{nginxSitesEnabledDir, nginxSitesAvailableDir, nginxLogDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	httpPort, sslPort := webServerPorts(config)
+	defaultSpec := &vhostSpec{
+		Domain:   "localhost",
+		DocRoot:  wwwDir,
+		HTTPPort: httpPort + " default_server",
+		SSLPort:  sslPort + " default_server",
+		CertPath: defaultCertPath,
+		KeyPath:  defaultKeyPath,
+		DevMode:  config.DevelopmentMode,
+	}
+	if _, err := os.Stat(defaultCertPath); err == nil {
+		defaultSpec.SSL = true
+	}
+
+	logDir := filepath.ToSlash(nginxLogDir)
+	content := fmt.Sprintf(`# Generated by Gecko. Site configs live in sites-enabled.
+worker_processes  1;
+error_log  "%[1]s/error.log";
+pid        "%[1]s/nginx.pid";
+
+events {
+    worker_connections  1024;
+}
+
+http {
+    include       "%[2]s";
+    default_type  application/octet-stream;
+    sendfile      on;
+    keepalive_timeout  65;
+    client_max_body_size 128m;
+    log_format    gecko_timed  '%[5]s';
+
+%[3]s
+    include "%[4]s/*.conf";
+}
+`, logDir,
+		filepath.ToSlash(filepath.Join(nginxDir, "conf", "mime.types")),
+		indentLines(renderNginxServer(defaultSpec), "    "),
+		filepath.ToSlash(nginxSitesEnabledDir),
+		nginxAccessLogFormat)
+
+	return os.WriteFile(nginxConfFile, []byte(content), 0644)
+}
+
+func indentLines(text, indent string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ensureNginxConfig creates the nginx config on first use, carrying over
+// every site (enabled or disabled) that already exists for Apache. Later
+// changes reach both web servers through mirrorVHostToInactive.
+func ensureNginxConfig() error {
+	if _, err := os.Stat(nginxConfFile); err == nil {
+		return nil
+	}
+	fmt.Printf("%sGenerating nginx configuration from existing sites...%s\n", shared.ColorYellow, shared.ColorReset)
+	if err := writeNginxMainConfig(); err != nil {
+		return err
+	}
+	enabled, _ := listVHostConfigs(apacheSitesEnabledDir)
+	disabled, _ := listVHostConfigs(apacheSitesAvailableDir)
+	if err := writeNginxSites(enabled, nginxSitesEnabledDir); err != nil {
+		return err
+	}
+	if mailCatcherEnabled() {
+		if err := writeMailCatcherSite(); err != nil {
+			return err
+		}
+	}
+	return writeNginxSites(disabled, nginxSitesAvailableDir)
+}
+
+// regenerateNginxConfig re-renders nginx.conf and every site from the current
+// settings, e.g. after a port or development mode change.
+func regenerateNginxConfig() error {
+	if err := writeNginxMainConfig(); err != nil {
+		return err
+	}
+	enabled, _ := listVHostConfigs(nginxSitesEnabledDir)
+	disabled, _ := listVHostConfigs(nginxSitesAvailableDir)
+	if err := writeNginxSites(enabled, nginxSitesEnabledDir); err != nil {
+		return err
+	}
+	if mailCatcherEnabled() {
+		if err := writeMailCatcherSite(); err != nil {
+			return err
+		}
+	}
+	return writeNginxSites(disabled, nginxSitesAvailableDir)
+}
+
+func writeNginxSites(domains []string, dir string) error {
+	for _, domain := range domains {
+		spec, err := newVHostSpec(domain, vhostHasCert(domain) && !frontProxyEnabled())
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, domain+".conf")
+		if err := os.WriteFile(path, []byte(renderNginxServer(spec)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -74,5 +74,5 @@ func SwitchPHPVersion(reader *bufio.Reader) {
 	}
 
 	fmt.Printf("%sSuccessfully switched to %s.%s\n", shared.ColorGreen, selectedVersionDirName, shared.ColorReset)
-	RestartApache()
+	RestartWebServer()
 }
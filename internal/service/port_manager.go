@@ -18,7 +18,7 @@ func ChangeServicePorts(reader *bufio.Reader) {
 	}
 
 	fmt.Println(shared.ColorGreen, "Select a service to change its port:", shared.ColorReset)
-	fmt.Printf("1. Apache (HTTP: %s, HTTPS: %s)\n", config.ApachePort, config.ApacheSSLPort)
+	fmt.Printf("1. %s (HTTP: %s, HTTPS: %s)\n", WebServerName(), config.ApachePort, config.ApacheSSLPort)
 	fmt.Printf("2. MySQL (Current: %s)\n", config.MySQLPort)
 	fmt.Printf("3. PostgreSQL (Current: %s)\n", config.PostgresPort)
 	fmt.Println("x. Back to main menu")
@@ -29,9 +29,29 @@ func ChangeServicePorts(reader *bufio.Reader) {
 
 	switch choice {
 	case "1":
-		changeApachePorts(reader, config)
-		if IsServiceRunning("httpd.exe") {
-			RestartApache()
+		oldPortHTTP, oldPortSSL := config.ApachePort, config.ApacheSSLPort
+		snap, err := snapshotWebServerConfig()
+		if err != nil {
+			fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return
+		}
+		if !changeWebServerPorts(reader, config) {
+			return
+		}
+		if !commitWebServerConfig(snap) {
+			config.ApachePort, config.ApacheSSLPort = oldPortHTTP, oldPortSSL
+			SaveConfig(config)
+			return
+		}
+		if config.FrontProxyEnabled {
+			if IsFrontProxyRunning() {
+				StopFrontProxy()
+				if err := StartFrontProxy(); err != nil {
+					fmt.Printf("%sError restarting front proxy: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+				}
+			}
+		} else if IsWebServerRunning() {
+			RestartWebServer()
 		}
 	case "2":
 		changeMySQLPort(reader, config)
@@ -51,7 +71,10 @@ func ChangeServicePorts(reader *bufio.Reader) {
 	}
 }
 
-func changeApachePorts(reader *bufio.Reader, config *Config) {
+// changeWebServerPorts asks for new HTTP/HTTPS ports and rewrites the web
+// server config for them. The ports are stored as apache_port and
+// apache_ssl_port whichever backend is active.
+func changeWebServerPorts(reader *bufio.Reader, config *Config) bool {
 	oldPortHTTP := config.ApachePort
 	oldPortSSL := config.ApacheSSLPort
 
@@ -71,9 +94,44 @@ func changeApachePorts(reader *bufio.Reader, config *Config) {
 
 	if newPortHTTP == oldPortHTTP && newPortSSL == oldPortSSL {
 		fmt.Println("Ports are the same. Operation cancelled.")
-		return
+		return false
 	}
 
+	if config.FrontProxyEnabled {
+		// The web server stays on the backend ports; only the proxy moves.
+		fmt.Printf("%sUpdating front proxy ports...%s\n", shared.ColorYellow, shared.ColorReset)
+	} else if activeWebServer() == webServerNginx {
+		fmt.Printf("%sUpdating Nginx configuration files...%s\n", shared.ColorYellow, shared.ColorReset)
+		config.ApachePort, config.ApacheSSLPort = newPortHTTP, newPortSSL
+		if err := regenerateNginxConfig(); err != nil {
+			config.ApachePort, config.ApacheSSLPort = oldPortHTTP, oldPortSSL
+			fmt.Printf("%sError writing nginx config: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return false
+		}
+	} else if !rewriteApachePorts(oldPortHTTP, oldPortSSL, newPortHTTP, newPortSSL) {
+		return false
+	} else {
+		// Client certificate sites redirect plain HTTP to the HTTPS port.
+		config.ApachePort, config.ApacheSSLPort = newPortHTTP, newPortSSL
+		if !rewriteClientAuthVHosts() {
+			config.ApachePort, config.ApacheSSLPort = oldPortHTTP, oldPortSSL
+			return false
+		}
+	}
+
+	config.ApachePort = newPortHTTP
+	config.ApacheSSLPort = newPortSSL
+	if err := SaveConfig(config); err != nil {
+		fmt.Printf("%sFailed to save new port configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return false
+	}
+
+	fmt.Printf("%s%s ports updated successfully in all config files.%s\n", shared.ColorGreen, WebServerName(), shared.ColorReset)
+	fmt.Println(shared.ColorYellow + "Restart " + WebServerName() + " to apply the new ports." + shared.ColorReset)
+	return true
+}
+
+func rewriteApachePorts(oldPortHTTP, oldPortSSL, newPortHTTP, newPortSSL string) bool {
 	fmt.Printf("%sUpdating Apache configuration files...%s\n", shared.ColorYellow, shared.ColorReset)
 
 	// change apache http port
@@ -89,34 +147,29 @@ func changeApachePorts(reader *bufio.Reader, config *Config) {
 		`<VirtualHost\s+[^:]+:` + oldPortSSL + `>`: "<VirtualHost _default_:" + newPortSSL + ">",
 	})
 
-	vhostDir := `C:\Gecko\etc\config\httpd\sites-enabled`
-	files, err := os.ReadDir(vhostDir)
-	if err != nil {
-		fmt.Printf("%sError reading vhost directory: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-		return
-	}
+	for _, vhostDir := range []string{apacheSitesEnabledDir, apacheSitesAvailableDir} {
+		files, err := os.ReadDir(vhostDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%sError reading vhost directory: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return false
+		}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".conf") {
-			filePath := filepath.Join(vhostDir, file.Name())
-			fmt.Printf("Updating %s...\n", file.Name())
-			patterns := map[string]string{
-				`\*:` + oldPortHTTP: "*:" + newPortHTTP,
-				`\*:` + oldPortSSL:  "*:" + newPortSSL,
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".conf") {
+				filePath := filepath.Join(vhostDir, file.Name())
+				fmt.Printf("Updating %s...\n", file.Name())
+				patterns := map[string]string{
+					`\*:` + oldPortHTTP: "*:" + newPortHTTP,
+					`\*:` + oldPortSSL:  "*:" + newPortSSL,
+				}
+				updateFileWithPatterns(filePath, patterns)
 			}
-			updateFileWithPatterns(filePath, patterns)
 		}
 	}
-
-	config.ApachePort = newPortHTTP
-	config.ApacheSSLPort = newPortSSL
-	if err := SaveConfig(config); err != nil {
-		fmt.Printf("%sFailed to save new port configuration: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-		return
-	}
-
-	fmt.Printf("%sApache ports updated successfully in all config files.%s\n", shared.ColorGreen, shared.ColorReset)
-	fmt.Println(shared.ColorYellow + "Restart Apache to apply the new ports." + shared.ColorReset)
+	return true
 }
 
 func changeMySQLPort(reader *bufio.Reader, config *Config) {
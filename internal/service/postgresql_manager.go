@@ -2,9 +2,11 @@ package service
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"gecko/internal/shared"
+	"io"
 	"math/big"
 	"os"
 	"os/exec"
@@ -21,6 +23,7 @@ const (
 	pgctlExe     = `C:\Gecko\bin\pgsql\bin\pg_ctl.exe`
 	psqlExe      = `C:\Gecko\bin\pgsql\bin\psql.exe`
 	pgsqlLogFile = `C:\Gecko\logs\pgsql.log`
+	pgDumpExe    = `C:\Gecko\bin\pgsql\bin\pg_dump.exe`
 )
 
 func isPostgreSQLInitialized() bool {
@@ -47,6 +50,23 @@ func generateRandomPassword(length int) (string, error) {
 	return string(result), nil
 }
 
+// readRootPassword asks for a password, generating a random one when the
+// answer is blank.
+func readRootPassword(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(shared.ColorYellow, prompt, shared.ColorReset)
+	password, _ := reader.ReadString('\n')
+	password = strings.TrimSpace(password)
+	if password != "" {
+		return password, nil
+	}
+	password, err := generateRandomPassword(16)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random password: %w", err)
+	}
+	fmt.Printf("%sGenerated Random Password: %s%s%s%s (This is also saved in the config)\n", shared.ColorGreen, shared.ColorYellow, password, shared.ColorGreen, shared.ColorReset)
+	return password, nil
+}
+
 func InitializePostgreSQL(reader *bufio.Reader) {
 	if _, err := os.Stat(initdbExe); os.IsNotExist(err) {
 		fmt.Printf("%sError: initdb.exe not found at %s%s\n", shared.ColorRed, initdbExe, shared.ColorReset)
@@ -74,18 +94,10 @@ func InitializePostgreSQL(reader *bufio.Reader) {
 		return
 	}
 
-	fmt.Print(shared.ColorYellow, "Enter a password for 'postgres' (or press Enter for a random one): ", shared.ColorReset)
-	password, _ := reader.ReadString('\n')
-	password = strings.TrimSpace(password)
-
-	if password == "" {
-		randomPass, err := generateRandomPassword(16)
-		if err != nil {
-			fmt.Printf("%sFailed to generate random password: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-			return
-		}
-		password = randomPass
-		fmt.Printf("%sGenerated Random Password: %s%s%s%s (This is also saved in the config)\n", shared.ColorGreen, shared.ColorYellow, password, shared.ColorGreen, shared.ColorReset)
+	password, err := readRootPassword(reader, "Enter a password for 'postgres' (or press Enter for a random one): ")
+	if err != nil {
+		fmt.Printf("%s%v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
 	}
 
 	config.PostgresPassword = password
@@ -182,3 +194,86 @@ func ViewPostgresPassword() {
 
 	fmt.Printf("PostgreSQL Superuser (postgres) Password: %s%s%s\n", shared.ColorGreen, config.PostgresPassword, shared.ColorReset)
 }
+
+func postgresCommand(exe string, args ...string) *exec.Cmd {
+	config, _ := GetConfig()
+	baseArgs := []string{"-h", "127.0.0.1", "-p", config.PostgresPort, "-U", "postgres"}
+	cmd := exec.Command(exe, append(baseArgs, args...)...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+config.PostgresPassword)
+	return cmd
+}
+
+func runPostgresQuery(database, query string) (string, error) {
+	cmd := postgresCommand(psqlExe, "-d", database, "-v", "ON_ERROR_STOP=1", "-tA", "-c", query)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("psql query failed: %v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+func dumpPostgresDatabase(dbName string, out io.Writer) error {
+	if !isValidSQLIdentifier(dbName) {
+		return fmt.Errorf("invalid database name '%s'", dbName)
+	}
+	if !IsServiceRunning("postgres.exe") {
+		return fmt.Errorf("PostgreSQL is not running. Please start it first")
+	}
+	var stderr bytes.Buffer
+	cmd := postgresCommand(pgDumpExe, "--no-owner", "--no-privileges", "-d", dbName)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump failed: %v\nOutput: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func ensurePostgresDatabase(db *VHostDatabase) error {
+	if !isValidSQLIdentifier(db.Name) || !isValidSQLIdentifier(db.User) {
+		return fmt.Errorf("invalid database or user name")
+	}
+	roleQuery := fmt.Sprintf(`DO $$ BEGIN
+IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '%[1]s') THEN
+CREATE ROLE "%[1]s" LOGIN PASSWORD %[2]s;
+ELSE
+ALTER ROLE "%[1]s" WITH LOGIN PASSWORD %[2]s;
+END IF;
+END $$;`, db.User, sqlQuote(db.Password))
+	if _, err := runPostgresQuery("postgres", roleQuery); err != nil {
+		return err
+	}
+	exists, err := runPostgresQuery("postgres", fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = '%s'", db.Name))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(exists) != "1" {
+		if _, err := runPostgresQuery("postgres", fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s" ENCODING 'UTF8'`, db.Name, db.User)); err != nil {
+			return err
+		}
+		// Other application roles should not be able to connect to it.
+		if _, err := runPostgresQuery("postgres", fmt.Sprintf(`REVOKE ALL ON DATABASE "%s" FROM PUBLIC`, db.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restorePostgresDatabase(db *VHostDatabase, in io.Reader) error {
+	if !IsServiceRunning("postgres.exe") {
+		return fmt.Errorf("PostgreSQL is not running. Please start it first")
+	}
+	if err := ensurePostgresDatabase(db); err != nil {
+		return err
+	}
+	// Restore as the application role so it owns the restored objects.
+	config, _ := GetConfig()
+	cmd := exec.Command(psqlExe, "-h", "127.0.0.1", "-p", config.PostgresPort, "-U", db.User, "-d", db.Name, "-v", "ON_ERROR_STOP=1", "-q")
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+db.Password)
+	cmd.Stdin = in
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("psql restore failed: %v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
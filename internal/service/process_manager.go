@@ -0,0 +1,567 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	geckoLogsDir         = `C:\Gecko\logs`
+	processLogMaxSize    = 10 << 20
+	processCheckInterval = 2 * time.Second
+	processStopTimeout   = 10 * time.Second
+	processMinBackoff    = time.Second
+	processMaxBackoff    = time.Minute
+	// A process that stays up this long is considered healthy again and its
+	// restart delay starts over.
+	processStableAfter = 30 * time.Second
+	// processGracePeriod is how long a process gets to exit after Ctrl+Break
+	// before its tree is killed.
+	processGracePeriod = 5 * time.Second
+
+	ProcessRunning    = "Running"
+	ProcessRestarting = "Restarting"
+	ProcessStopped    = "Stopped"
+)
+
+// supervisorMutexName is held by whichever Gecko process supervises, so the
+// menu and "gecko process serve" never run the same workers twice or reap
+// each other's.
+const supervisorMutexName = `Local\GeckoProcessSupervisor`
+
+var processNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// VHostProcess is a long-running command that belongs to a site, such as a
+// queue worker or an asset watcher. Dir is relative to the document root.
+type VHostProcess struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	Dir     string `json:"dir,omitempty"`
+}
+
+type ProcessStatus struct {
+	Domain   string
+	Name     string
+	State    string
+	PID      int
+	Restarts int
+}
+
+var (
+	supervisorMu      sync.Mutex
+	runningSupervisor *processSupervisor
+)
+
+// processSupervisor runs the processes of every enabled site and keeps them
+// in step with the registry while the web server is up.
+type processSupervisor struct {
+	lock  windows.Handle
+	mu    sync.Mutex
+	procs map[string]*managedProcess
+	stamp string
+	stop  chan struct{}
+}
+
+type managedProcess struct {
+	domain   string
+	spec     VHostProcess
+	env      []string
+	mu       sync.Mutex
+	state    string
+	pid      int
+	restarts int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func processLogPath(domainName, name string) string {
+	return filepath.Join(geckoLogsDir, domainName, name+".log")
+}
+
+// processPIDPath records the PID and creation time of a running process, so
+// one left behind when Gecko itself was killed can be reaped on next start.
+func processPIDPath(domainName, name string) string {
+	return filepath.Join(geckoLogsDir, domainName, name+".pid")
+}
+
+func IsProcessSupervisorRunning() bool {
+	supervisorMu.Lock()
+	defer supervisorMu.Unlock()
+	return runningSupervisor != nil
+}
+
+// StartProcessSupervisor starts the processes of all enabled sites. It is
+// called whenever Gecko starts the web server, and fails when another Gecko
+// process is already supervising them.
+func StartProcessSupervisor() error {
+	supervisorMu.Lock()
+	defer supervisorMu.Unlock()
+	if runningSupervisor != nil {
+		return nil
+	}
+	name, err := windows.UTF16PtrFromString(supervisorMutexName)
+	if err != nil {
+		return err
+	}
+	lock, err := windows.CreateMutex(nil, false, name)
+	if err == windows.ERROR_ALREADY_EXISTS {
+		windows.CloseHandle(lock)
+		return fmt.Errorf("another Gecko process is already running the site processes")
+	} else if err != nil {
+		return fmt.Errorf("could not take the process supervisor lock: %w", err)
+	}
+	reapOrphanedProcesses()
+	s := &processSupervisor{lock: lock, procs: make(map[string]*managedProcess), stop: make(chan struct{})}
+	s.reconcile()
+	go s.watch()
+	runningSupervisor = s
+	return nil
+}
+
+// ServeProcessesUntilInterrupt is the CLI entry: it supervises until Ctrl+C
+// and stops every process on the way out.
+func ServeProcessesUntilInterrupt() error {
+	if err := StartProcessSupervisor(); err != nil {
+		return err
+	}
+	fmt.Printf("%sSupervising site processes. Press Ctrl+C to stop.%s\n", shared.ColorGreen, shared.ColorReset)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	fmt.Printf("%sStopping site processes...%s\n", shared.ColorYellow, shared.ColorReset)
+	StopProcessSupervisor()
+	return nil
+}
+
+func StopProcessSupervisor() {
+	supervisorMu.Lock()
+	s := runningSupervisor
+	runningSupervisor = nil
+	supervisorMu.Unlock()
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	s.mu.Lock()
+	procs := make([]*managedProcess, 0, len(s.procs))
+	for key, p := range s.procs {
+		procs = append(procs, p)
+		delete(s.procs, key)
+	}
+	s.mu.Unlock()
+	terminateAll(procs)
+	windows.CloseHandle(s.lock)
+}
+
+// terminateAll stops the processes in parallel. Callers must not hold s.mu,
+// as each may take up to the grace period plus processStopTimeout.
+func terminateAll(procs []*managedProcess) {
+	var wg sync.WaitGroup
+	for _, p := range procs {
+		wg.Add(1)
+		go func(p *managedProcess) {
+			defer wg.Done()
+			p.terminate()
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (s *processSupervisor) watch() {
+	ticker := time.NewTicker(processCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if routesStamp() != s.stamp {
+				s.reconcile()
+			}
+		}
+	}
+}
+
+// reconcile starts processes that were added or whose site was enabled,
+// stops those that were removed, and restarts any whose command changed.
+func (s *processSupervisor) reconcile() {
+	stamp := routesStamp()
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		fmt.Printf("%sProcess manager: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	wanted := make(map[string]*managedProcess)
+	domains, _ := ListVirtualHosts()
+	for _, domain := range domains {
+		vhost := registry[domain]
+		if vhost == nil {
+			continue
+		}
+		env := os.Environ()
+		vhostEnv := vhostEnvironment(vhost)
+		for _, key := range sortedEnvKeys(vhostEnv) {
+			env = append(env, key+"="+vhostEnv[key])
+		}
+		for _, spec := range vhost.Processes {
+			wanted[domain+"/"+spec.Name] = &managedProcess{domain: domain, spec: spec, env: env}
+		}
+	}
+
+	s.mu.Lock()
+	var stale []*managedProcess
+	for key, p := range s.procs {
+		if w, ok := wanted[key]; !ok || w.spec != p.spec || strings.Join(w.env, "\x00") != strings.Join(p.env, "\x00") {
+			stale = append(stale, p)
+			delete(s.procs, key)
+		}
+	}
+	s.mu.Unlock()
+	// Replaced processes are fully gone before their successors start.
+	terminateAll(stale)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	for key, p := range wanted {
+		if _, ok := s.procs[key]; !ok {
+			p.stop, p.done = make(chan struct{}), make(chan struct{})
+			p.state = ProcessRestarting
+			s.procs[key] = p
+			go p.run()
+		}
+	}
+	s.stamp = stamp
+}
+
+// run starts the command and restarts it with exponential backoff whenever it
+// exits, until terminate is called.
+func (p *managedProcess) run() {
+	defer close(p.done)
+	backoff := processMinBackoff
+	for {
+		logFile, err := openProcessLog(p.domain, p.spec.Name)
+		if err != nil {
+			p.setState(ProcessStopped, 0)
+			return
+		}
+		started := time.Now()
+		cmd := p.command()
+		cmd.Stdout, cmd.Stderr = logFile, logFile
+		fmt.Fprintf(logFile, "[gecko] %s starting: %s\n", started.Format(time.RFC3339), p.spec.Command)
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(logFile, "[gecko] could not start: %v\n", err)
+		} else {
+			pid := cmd.Process.Pid
+			p.setState(ProcessRunning, pid)
+			recordProcessPID(p.domain, p.spec.Name, pid)
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			select {
+			case err := <-exited:
+				fmt.Fprintf(logFile, "[gecko] %s exited: %v\n", time.Now().Format(time.RFC3339), exitDescription(err))
+			case <-p.stop:
+				stopProcessTree(pid, exited)
+				fmt.Fprintf(logFile, "[gecko] %s stopped\n", time.Now().Format(time.RFC3339))
+				os.Remove(processPIDPath(p.domain, p.spec.Name))
+				logFile.Close()
+				p.setState(ProcessStopped, 0)
+				return
+			}
+			os.Remove(processPIDPath(p.domain, p.spec.Name))
+		}
+		logFile.Close()
+
+		if time.Since(started) > processStableAfter {
+			backoff = processMinBackoff
+		}
+		p.mu.Lock()
+		p.state, p.pid = ProcessRestarting, 0
+		p.restarts++
+		p.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			p.setState(ProcessStopped, 0)
+			return
+		}
+		if backoff *= 2; backoff > processMaxBackoff {
+			backoff = processMaxBackoff
+		}
+	}
+}
+
+// command runs the line through cmd.exe so npm, artisan and batch files work
+// as they do in a terminal. CmdLine is passed verbatim to keep quotes intact.
+// Its own process group lets Ctrl+Break reach it without reaching Gecko.
+func (p *managedProcess) command() *exec.Cmd {
+	cmd := exec.Command("cmd.exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine:       `cmd.exe /S /C "` + p.spec.Command + `"`,
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+	cmd.Dir = filepath.Join(wwwDir, p.domain, filepath.FromSlash(p.spec.Dir))
+	cmd.Env = p.env
+	return cmd
+}
+
+func (p *managedProcess) setState(state string, pid int) {
+	p.mu.Lock()
+	p.state, p.pid = state, pid
+	p.mu.Unlock()
+}
+
+func (p *managedProcess) terminate() {
+	close(p.stop)
+	<-p.done
+}
+
+// stopProcessTree sends Ctrl+Break to the process group so workers can finish
+// the job at hand, and kills the tree once the grace period is over.
+func stopProcessTree(pid int, exited <-chan error) {
+	if windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(pid)) == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(processGracePeriod):
+		}
+	}
+	killProcessTree(pid)
+	select {
+	case <-exited:
+	case <-time.After(processStopTimeout):
+	}
+}
+
+// killProcessTree also takes down the children cmd.exe started, like node
+// under npm.
+func killProcessTree(pid int) {
+	exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// processCreationTime tells a recorded PID apart from a later process that
+// reused it.
+func processCreationTime(pid int) (int64, bool) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, false
+	}
+	defer windows.CloseHandle(handle)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0, false
+	}
+	return creation.Nanoseconds(), true
+}
+
+func recordProcessPID(domainName, name string, pid int) {
+	created, ok := processCreationTime(pid)
+	if !ok {
+		return
+	}
+	os.WriteFile(processPIDPath(domainName, name), []byte(fmt.Sprintf("%d %d\n", pid, created)), 0644)
+}
+
+// reapOrphanedProcesses kills processes a previous Gecko started but never
+// stopped, for instance because it was closed with the console window.
+func reapOrphanedProcesses() {
+	paths, _ := filepath.Glob(filepath.Join(geckoLogsDir, "*", "*.pid"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var pid int
+		var created int64
+		if _, err := fmt.Sscan(string(data), &pid, &created); err == nil {
+			if now, ok := processCreationTime(pid); ok && now == created {
+				fmt.Printf("%sStopping leftover process %s (PID %d).%s\n", shared.ColorYellow, strings.TrimSuffix(path, ".pid"), pid, shared.ColorReset)
+				killProcessTree(pid)
+			}
+		}
+		os.Remove(path)
+	}
+}
+
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// openProcessLog appends to the process log, moving it aside to .1 once it
+// grows past processLogMaxSize.
+func openProcessLog(domainName, name string) (*os.File, error) {
+	path := processLogPath(domainName, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > processLogMaxSize {
+		os.Rename(path, path+".1")
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// ProcessStatuses lists every declared process with its current state, for
+// the status view.
+func ProcessStatuses() []ProcessStatus {
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return nil
+	}
+	supervisorMu.Lock()
+	s := runningSupervisor
+	supervisorMu.Unlock()
+
+	var statuses []ProcessStatus
+	for domain, vhost := range registry {
+		for _, spec := range vhost.Processes {
+			status := ProcessStatus{Domain: domain, Name: spec.Name, State: ProcessStopped}
+			if s != nil {
+				s.mu.Lock()
+				if p, ok := s.procs[domain+"/"+spec.Name]; ok {
+					p.mu.Lock()
+					status.State, status.PID, status.Restarts = p.state, p.pid, p.restarts
+					p.mu.Unlock()
+				}
+				s.mu.Unlock()
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Domain != statuses[j].Domain {
+			return statuses[i].Domain < statuses[j].Domain
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// ListVHostProcesses prints the processes declared for one site, or for all
+// sites when domainName is empty.
+func ListVHostProcesses(domainName string) error {
+	if domainName != "" {
+		if _, err := getExistingVHost(domainName); err != nil {
+			return err
+		}
+		domainName = strings.ToLower(strings.TrimSpace(domainName))
+	}
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	domains := make([]string, 0, len(registry))
+	for domain, vhost := range registry {
+		if len(vhost.Processes) > 0 && (domainName == "" || domain == domainName) {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		fmt.Printf("%sNo processes declared.%s\n", shared.ColorYellow, shared.ColorReset)
+		return nil
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Printf("%s%s%s\n", shared.ColorGreen, domain, shared.ColorReset)
+		for _, spec := range registry[domain].Processes {
+			dir := ""
+			if spec.Dir != "" {
+				dir = fmt.Sprintf(" (in %s)", spec.Dir)
+			}
+			fmt.Printf("  %-12s %s%s\n", spec.Name, spec.Command, dir)
+			fmt.Printf("  %s%-12s log: %s%s\n", shared.ColorGray, "", processLogPath(domain, spec.Name), shared.ColorReset)
+		}
+	}
+	return nil
+}
+
+// checkVHostProcess normalizes a process declaration and rejects names,
+// commands and working directories the supervisor cannot run safely.
+func checkVHostProcess(spec *VHostProcess) error {
+	spec.Name = strings.ToLower(strings.TrimSpace(spec.Name))
+	if !processNamePattern.MatchString(spec.Name) {
+		return fmt.Errorf("'%s' is not a valid process name (use letters, digits, - and _)", spec.Name)
+	}
+	spec.Command = strings.TrimSpace(spec.Command)
+	if spec.Command == "" || strings.ContainsAny(spec.Command, "\r\n") {
+		return fmt.Errorf("the command must be a single non-empty line")
+	}
+	if spec.Dir != "" && !filepath.IsLocal(filepath.FromSlash(spec.Dir)) {
+		return fmt.Errorf("the working directory must be inside the document root")
+	}
+	spec.Dir = filepath.ToSlash(spec.Dir)
+	return nil
+}
+
+// AddVHostProcess declares a named process for a site, replacing any process
+// with the same name. A running Gecko picks the change up within seconds.
+func AddVHostProcess(domainName, name, command, dir string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	spec := VHostProcess{Name: name, Command: command, Dir: dir}
+	if err := checkVHostProcess(&spec); err != nil {
+		return err
+	}
+	name = spec.Name
+	replaced := false
+	for i := range vhost.Processes {
+		if vhost.Processes[i].Name == name {
+			vhost.Processes[i], replaced = spec, true
+		}
+	}
+	if !replaced {
+		vhost.Processes = append(vhost.Processes, spec)
+	}
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	fmt.Printf("%sProcess '%s' saved for %s. Its output goes to %s.%s\n", shared.ColorGreen, name, vhost.Domain, processLogPath(vhost.Domain, name), shared.ColorReset)
+	return nil
+}
+
+func RemoveVHostProcess(domainName, name string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	kept := vhost.Processes[:0]
+	for _, spec := range vhost.Processes {
+		if spec.Name != name {
+			kept = append(kept, spec)
+		}
+	}
+	if len(kept) == len(vhost.Processes) {
+		return fmt.Errorf("%s has no process named '%s'", vhost.Domain, name)
+	}
+	vhost.Processes = kept
+	if len(kept) == 0 {
+		vhost.Processes = nil
+	}
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	fmt.Printf("%sProcess '%s' removed from %s.%s\n", shared.ColorGreen, name, vhost.Domain, shared.ColorReset)
+	return nil
+}
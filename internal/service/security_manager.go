@@ -64,28 +64,32 @@ func applyApacheSecuritySettings(isDevMode bool) error {
 		fmt.Printf("%sApplying Private Mode (local access only) to Apache...%s\n", shared.ColorYellow, shared.ColorReset)
 	}
 
-	vhostDir := `C:\Gecko\etc\config\httpd\sites-enabled`
-	files, err := os.ReadDir(vhostDir)
-	if err != nil {
-		return fmt.Errorf("could not read vhost directory: %w", err)
-	}
 	re := regexp.MustCompile(oldDirective)
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".conf") {
-			filePath := filepath.Join(vhostDir, file.Name())
-			content, err := os.ReadFile(filePath)
-			if err != nil {
-				continue
+	for _, vhostDir := range []string{apacheSitesEnabledDir, apacheSitesAvailableDir} {
+		files, err := os.ReadDir(vhostDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not read vhost directory: %w", err)
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".conf") {
+				filePath := filepath.Join(vhostDir, file.Name())
+				content, err := os.ReadFile(filePath)
+				if err != nil {
+					continue
+				}
+				newContent := re.ReplaceAllString(string(content), newDirective)
+				os.WriteFile(filePath, []byte(newContent), 0644)
 			}
-			newContent := re.ReplaceAllString(string(content), newDirective)
-			os.WriteFile(filePath, []byte(newContent), 0644)
 		}
 	}
 	return nil
 }
 
 func ToggleDevelopmentMode() {
-	isApacheRunning := IsServiceRunning("httpd.exe")
+	isWebServerRunning := IsWebServerRunning()
 	isMySQLRunning := IsServiceRunning("mysqld.exe")
 	isPgRunning := IsServiceRunning("postgres.exe")
 
@@ -97,8 +101,26 @@ func ToggleDevelopmentMode() {
 
 	newMode := !config.DevelopmentMode
 
-	if err := applyApacheSecuritySettings(newMode); err != nil {
-		fmt.Printf("%sFailed to apply Apache security settings: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
+	// Generated configs are rendered with the new mode, so flip it while they are written.
+	config.DevelopmentMode = newMode
+	if activeWebServer() == webServerNginx {
+		err = regenerateNginxConfig()
+	} else if err = applyApacheSecuritySettings(newMode); err == nil {
+		if err = regenerateAccessControlledSites(); err == nil && config.MailCatcherEnabled {
+			err = writeMailCatcherSite()
+		}
+	}
+	config.DevelopmentMode = !newMode
+	if err != nil {
+		fmt.Printf("%sFailed to apply %s security settings: %v%s\n", shared.ColorRed, WebServerName(), err, shared.ColorReset)
+	}
+	if !commitWebServerConfig(snap) {
+		return
 	}
 	if err := applyPostgresSecuritySettings(newMode); err != nil {
 		fmt.Printf("%sFailed to apply PostgreSQL security settings: %v%s\n", shared.ColorRed, err, shared.ColorReset)
@@ -110,14 +132,22 @@ func ToggleDevelopmentMode() {
 		return
 	}
 
+	// The default certificate lists the LAN addresses only in dev mode.
+	if _, err := os.Stat(defaultCertPath); err == nil {
+		if err := generateCert(certNamesFor("localhost"), defaultCertPath, defaultKeyPath); err != nil {
+			fmt.Printf("%sFailed to re-issue the default certificate: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
+		resetFrontProxyCertificates()
+	}
+
 	if newMode {
 		fmt.Printf("%sDevelopment Mode activated. Services will be accessible from your local network.%s\n", shared.ColorGreen, shared.ColorReset)
 	} else {
 		fmt.Printf("%sPrivate Mode activated. Services will only be accessible from this computer.%s\n", shared.ColorGreen, shared.ColorReset)
 	}
 
-	if isApacheRunning {
-		RestartApache()
+	if isWebServerRunning {
+		ReloadWebServer()
 	}
 	if isMySQLRunning {
 		StopMySQL()
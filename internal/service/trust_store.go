@@ -0,0 +1,396 @@
+package service
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// nssCertutilExe is NSS's certutil, which shares its name with the
+	// Windows tool and is therefore only looked for in Gecko's own bin dir.
+	nssCertutilExe  = `C:\Gecko\bin\nss\certutil.exe`
+	trustStoreAlias = "gecko-root-ca"
+	javaStorePass   = "changeit"
+	firefoxPrefMark = "// added by Gecko"
+)
+
+// trustStore is one place the Gecko Root CA can be installed. detect reports
+// whether the store exists on this machine at all.
+type trustStore struct {
+	name      string
+	detect    func() bool
+	install   func() error
+	uninstall func() error
+}
+
+var trustStores = []trustStore{
+	{"windows", func() bool { return true }, installRootCAToWindows, removeRootCAFromWindows},
+	{"wsl", func() bool { return len(wslDistros()) > 0 }, installRootCAToWSL, removeRootCAFromWSL},
+	{"firefox", func() bool { return len(firefoxProfiles()) > 0 }, installRootCAToFirefox, removeRootCAFromFirefox},
+	{"java", func() bool { return keytoolPath() != "" }, installRootCAToJava, removeRootCAFromJava},
+}
+
+// TrustStoreNames lists the stores accepted by InstallRootCATrust's only
+// argument.
+func TrustStoreNames() []string {
+	names := make([]string, len(trustStores))
+	for i, store := range trustStores {
+		names[i] = store.name
+	}
+	return names
+}
+
+func selectTrustStores(only []string) ([]trustStore, error) {
+	if len(only) == 0 {
+		return trustStores, nil
+	}
+	var selected []trustStore
+	for _, name := range only {
+		found := false
+		for _, store := range trustStores {
+			if store.name == strings.ToLower(name) {
+				selected = append(selected, store)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown trust store '%s' (choose from %s)", name, strings.Join(TrustStoreNames(), ", "))
+		}
+	}
+	return selected, nil
+}
+
+// InstallRootCATrust adds the Gecko Root CA to every trust store found on
+// this machine, or just the named ones.
+func InstallRootCATrust(only []string) error {
+	if _, err := os.Stat(caCertPath); err != nil {
+		return fmt.Errorf("the Gecko Root CA has not been generated yet")
+	}
+	stores, err := selectTrustStores(only)
+	if err != nil {
+		return err
+	}
+	failed := updateTrustStores(stores, true)
+	printNodeCAHint(true)
+	if failed > 0 {
+		return fmt.Errorf("the CA could not be installed in %d store(s)", failed)
+	}
+	return nil
+}
+
+// UninstallRootCATrust removes the Gecko Root CA from every store it was
+// installed in, or just the named ones.
+func UninstallRootCATrust(only []string) error {
+	stores, err := selectTrustStores(only)
+	if err != nil {
+		return err
+	}
+	failed := updateTrustStores(stores, false)
+	printNodeCAHint(false)
+	if failed > 0 {
+		return fmt.Errorf("the CA could not be removed from %d store(s)", failed)
+	}
+	return nil
+}
+
+// updateTrustStores installs or removes the CA in each store present and
+// returns how many failed.
+func updateTrustStores(stores []trustStore, install bool) int {
+	failed := 0
+	for _, store := range stores {
+		if !store.detect() {
+			if install {
+				fmt.Printf("%s[%s] not found, skipping.%s\n", shared.ColorYellow, store.name, shared.ColorReset)
+			}
+			continue
+		}
+		action := store.uninstall
+		if install {
+			action = store.install
+		}
+		if err := action(); err != nil {
+			fmt.Printf("%s[%s] %v%s\n", shared.ColorRed, store.name, err, shared.ColorReset)
+			failed++
+		}
+	}
+	return failed
+}
+
+func installRootCAToWindows() error {
+	fmt.Printf("%s[windows] Installing Gecko Root CA to the Windows Trust Store...%s\n", shared.ColorYellow, shared.ColorReset)
+	fmt.Println("A security prompt will appear. Please accept it to trust the new CA.")
+	if err := runCmd("certutil", "-addstore", "-f", "ROOT", caCertPath); err != nil {
+		return err
+	}
+	fmt.Printf("%s[windows] CA installed. Chrome, Edge and other Chromium browsers use this store.%s\n", shared.ColorGreen, shared.ColorReset)
+	return nil
+}
+
+// removeRootCAFromWindows deletes by serial number so an older Gecko CA with
+// the same name, or another CA, is never touched by mistake.
+func removeRootCAFromWindows() error {
+	cert, err := readCertificateFile(caCertPath)
+	if err != nil {
+		return err
+	}
+	return removeCertFromWindows(cert)
+}
+
+func removeCertFromWindows(cert *x509.Certificate) error {
+	serial := hex.EncodeToString(cert.SerialNumber.Bytes())
+	if exec.Command("certutil", "-store", "ROOT", serial).Run() != nil {
+		return nil
+	}
+	if err := runCmd("certutil", "-delstore", "ROOT", serial); err != nil {
+		return err
+	}
+	fmt.Printf("%s[windows] CA removed from the Windows Trust Store.%s\n", shared.ColorGreen, shared.ColorReset)
+	return nil
+}
+
+// wslDistros lists the installed WSL distributions. wsl.exe writes UTF-16,
+// which for distro names is ASCII with NUL bytes in between.
+func wslDistros() []string {
+	if _, err := exec.LookPath("wsl.exe"); err != nil {
+		return nil
+	}
+	out, err := exec.Command("wsl.exe", "--list", "--quiet").Output()
+	if err != nil {
+		return nil
+	}
+	out = bytes.ReplaceAll(out, []byte{0}, nil)
+	var distros []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if line != "" && !strings.HasPrefix(strings.ToLower(line), "docker-desktop") {
+			distros = append(distros, line)
+		}
+	}
+	return distros
+}
+
+// The anchor directories of Debian/Ubuntu, Fedora/RHEL and Arch, with the
+// refresh command each family uses.
+const wslInstallScript = `set -e
+for dir in /usr/local/share/ca-certificates /etc/pki/ca-trust/source/anchors /etc/ca-certificates/trust-source/anchors; do
+	if [ -d "$dir" ]; then cat > "$dir/` + trustStoreAlias + `.crt"; found=1; break; fi
+done
+[ -n "$found" ] || { echo "no CA anchor directory found"; exit 1; }
+if command -v update-ca-certificates >/dev/null; then update-ca-certificates
+elif command -v update-ca-trust >/dev/null; then update-ca-trust extract
+else trust extract-compat; fi`
+
+const wslRemoveScript = `rm -f /usr/local/share/ca-certificates/` + trustStoreAlias + `.crt /etc/pki/ca-trust/source/anchors/` + trustStoreAlias + `.crt /etc/ca-certificates/trust-source/anchors/` + trustStoreAlias + `.crt
+if command -v update-ca-certificates >/dev/null; then update-ca-certificates --fresh
+elif command -v update-ca-trust >/dev/null; then update-ca-trust extract
+else trust extract-compat; fi`
+
+func runInWSL(distro, script string, stdin []byte) error {
+	cmd := exec.Command("wsl.exe", "--distribution", distro, "--user", "root", "--exec", "sh", "-c", script)
+	cmd.Stdin = bytes.NewReader(stdin)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v\nOutput: %s", distro, err, strings.TrimSpace(string(bytes.ReplaceAll(output, []byte{0}, nil))))
+	}
+	return nil
+}
+
+func installRootCAToWSL() error {
+	pemData, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, distro := range wslDistros() {
+		fmt.Printf("%s[wsl] Installing CA in %s...%s\n", shared.ColorYellow, distro, shared.ColorReset)
+		if err := runInWSL(distro, wslInstallScript, pemData); err != nil {
+			fmt.Printf("%s[wsl] %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			failed = append(failed, distro)
+			continue
+		}
+		fmt.Printf("%s[wsl] CA installed in %s.%s\n", shared.ColorGreen, distro, shared.ColorReset)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func removeRootCAFromWSL() error {
+	var failed []string
+	for _, distro := range wslDistros() {
+		if err := runInWSL(distro, wslRemoveScript, nil); err != nil {
+			fmt.Printf("%s[wsl] %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			failed = append(failed, distro)
+			continue
+		}
+		fmt.Printf("%s[wsl] CA removed from %s.%s\n", shared.ColorGreen, distro, shared.ColorReset)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// firefoxProfiles returns the NSS databases of every Firefox profile, plus
+// Thunderbird's, which shares the format.
+func firefoxProfiles() []string {
+	appData := os.Getenv("APPDATA")
+	if appData == "" {
+		return nil
+	}
+	var profiles []string
+	for _, pattern := range []string{
+		filepath.Join(appData, "Mozilla", "Firefox", "Profiles", "*"),
+		filepath.Join(appData, "Thunderbird", "Profiles", "*"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		for _, dir := range matches {
+			if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err == nil {
+				profiles = append(profiles, dir)
+			}
+		}
+	}
+	return profiles
+}
+
+// installRootCAToFirefox adds the CA to each profile's NSS database when
+// NSS tools are available. Without them it turns on
+// security.enterprise_roots.enabled, making Firefox read the Windows store.
+func installRootCAToFirefox() error {
+	useNSS := fileExists(nssCertutilExe)
+	var failed []string
+	for _, profile := range firefoxProfiles() {
+		var err error
+		if useNSS {
+			_ = exec.Command(nssCertutilExe, "-D", "-d", "sql:"+profile, "-n", caCommonName).Run()
+			err = runCmd(nssCertutilExe, "-A", "-d", "sql:"+profile, "-n", caCommonName, "-t", "C,,", "-i", caCertPath)
+		} else {
+			err = setFirefoxEnterpriseRoots(profile, true)
+		}
+		if err != nil {
+			fmt.Printf("%s[firefox] %s: %v%s\n", shared.ColorRed, filepath.Base(profile), err, shared.ColorReset)
+			failed = append(failed, filepath.Base(profile))
+			continue
+		}
+		fmt.Printf("%s[firefox] CA trusted in profile %s.%s\n", shared.ColorGreen, filepath.Base(profile), shared.ColorReset)
+	}
+	if !useNSS {
+		fmt.Println("[firefox] NSS tools not found; Firefox was told to trust the Windows store instead. Restart Firefox to apply.")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func removeRootCAFromFirefox() error {
+	useNSS := fileExists(nssCertutilExe)
+	var failed []string
+	for _, profile := range firefoxProfiles() {
+		if useNSS {
+			// certutil -D fails when the nickname is absent, which is fine.
+			_ = exec.Command(nssCertutilExe, "-D", "-d", "sql:"+profile, "-n", caCommonName).Run()
+		}
+		if err := setFirefoxEnterpriseRoots(profile, false); err != nil {
+			failed = append(failed, filepath.Base(profile))
+			continue
+		}
+		fmt.Printf("%s[firefox] CA removed from profile %s.%s\n", shared.ColorGreen, filepath.Base(profile), shared.ColorReset)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// setFirefoxEnterpriseRoots adds or removes Gecko's line in a profile's
+// user.js, leaving anything the user wrote alone.
+func setFirefoxEnterpriseRoots(profile string, enable bool) error {
+	path := filepath.Join(profile, "user.js")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		if line != "" && !strings.Contains(line, firefoxPrefMark) {
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+	}
+	if enable {
+		lines = append(lines, `user_pref("security.enterprise_roots.enabled", true); `+firefoxPrefMark)
+	}
+	if len(lines) == 0 {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return os.Remove(path)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// keytoolPath finds keytool from JAVA_HOME first, then PATH.
+func keytoolPath() string {
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		path := filepath.Join(home, "bin", "keytool.exe")
+		if fileExists(path) {
+			return path
+		}
+	}
+	if path, err := exec.LookPath("keytool"); err == nil {
+		return path
+	}
+	return ""
+}
+
+func installRootCAToJava() error {
+	keytool := keytoolPath()
+	fmt.Printf("%s[java] Importing CA into the cacerts of %s...%s\n", shared.ColorYellow, filepath.Dir(filepath.Dir(keytool)), shared.ColorReset)
+	// Replace a CA from an earlier install; keytool refuses duplicate aliases.
+	_ = exec.Command(keytool, "-delete", "-cacerts", "-storepass", javaStorePass, "-alias", trustStoreAlias).Run()
+	err := runCmd(keytool, "-importcert", "-noprompt", "-trustcacerts", "-cacerts", "-storepass", javaStorePass, "-alias", trustStoreAlias, "-file", caCertPath)
+	if err != nil {
+		return fmt.Errorf("%v (the JDK directory may need an elevated prompt)", err)
+	}
+	fmt.Printf("%s[java] CA installed.%s\n", shared.ColorGreen, shared.ColorReset)
+	return nil
+}
+
+func removeRootCAFromJava() error {
+	keytool := keytoolPath()
+	if exec.Command(keytool, "-list", "-cacerts", "-storepass", javaStorePass, "-alias", trustStoreAlias).Run() != nil {
+		return nil
+	}
+	if err := runCmd(keytool, "-delete", "-cacerts", "-storepass", javaStorePass, "-alias", trustStoreAlias); err != nil {
+		return err
+	}
+	fmt.Printf("%s[java] CA removed.%s\n", shared.ColorGreen, shared.ColorReset)
+	return nil
+}
+
+// printNodeCAHint covers Node.js, which ignores the Windows store unless
+// started with --use-system-ca, and reads NODE_EXTRA_CA_CERTS instead.
+func printNodeCAHint(installed bool) {
+	current := os.Getenv("NODE_EXTRA_CA_CERTS")
+	switch {
+	case installed && !strings.EqualFold(current, caCertPath):
+		fmt.Printf("%s[node] Node.js does not read the Windows store. To trust Gecko sites from Node, run:%s\n", shared.ColorYellow, shared.ColorReset)
+		fmt.Printf("  setx NODE_EXTRA_CA_CERTS \"%s\"\n", caCertPath)
+	case !installed && strings.EqualFold(current, caCertPath):
+		fmt.Printf("%s[node] NODE_EXTRA_CA_CERTS still points at the Gecko CA. To clear it, run:%s\n", shared.ColorYellow, shared.ColorReset)
+		fmt.Println(`  reg delete HKCU\Environment /v NODE_EXTRA_CA_CERTS /f`)
+	}
+}
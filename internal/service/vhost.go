@@ -1,7 +1,7 @@
 package service
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"gecko/internal/shared"
 	"os"
@@ -11,72 +11,220 @@ import (
 
 const (
 	wwwDir           = `C:\Gecko\www`
-	sitesEnabledDir  = `C:\Gecko\etc\config\httpd\sites-enabled`
-	hostsFilePath    = `C:\Windows\System32\drivers\etc\hosts`
-	geckoStartBlock  = "#GeckoStart"
-	geckoEndBlock    = "#GeckoEnd"
 	prohibitedVHosts = "00-default.conf"
 )
 
-func createVHostFile(docRoot, domainName string, useSSL bool) error {
+// vhostSpec is the backend-neutral description of a site that the Apache and
+// nginx renderers turn into config files.
+type vhostSpec struct {
+	Domain   string
+	Aliases  []string
+	DocRoot  string
+	HTTPPort string
+	SSLPort  string
+	SSL      bool
+	CertPath string
+	KeyPath  string
+	DevMode  bool
+	// AllowFrom and AuthUserFile come from the site's access rules.
+	AllowFrom    []string
+	AuthUserFile string
+	Env          map[string]string
+	// ClientCA and ClientCRL are set when the site requires client
+	// certificates. HTTPSOnly then keeps plain HTTP away from the site,
+	// unless the front proxy checks certificates in front of it.
+	ClientCA  string
+	ClientCRL string
+	HTTPSOnly bool
+}
+
+func newVHostSpec(domainName string, useSSL bool) (*vhostSpec, error) {
 	config, err := GetConfig()
 	if err != nil {
-		return fmt.Errorf("could not load config to create vhost file: %w", err)
+		return nil, fmt.Errorf("could not load config to create vhost file: %w", err)
+	}
+	vhost, err := GetVHost(domainName)
+	if err != nil {
+		return nil, err
+	}
+	httpPort, sslPort := webServerPorts(config)
+	spec := &vhostSpec{
+		Domain:       domainName,
+		Aliases:      vhost.Aliases,
+		DocRoot:      filepath.Join(wwwDir, domainName),
+		HTTPPort:     httpPort,
+		SSLPort:      sslPort,
+		SSL:          useSSL,
+		CertPath:     filepath.Join(vhostCertsDir, domainName+".crt"),
+		KeyPath:      filepath.Join(vhostKeysDir, domainName+".key"),
+		DevMode:      config.DevelopmentMode,
+		AuthUserFile: vhostAuthUserFile(domainName),
+		Env:          vhostEnvironment(vhost),
+	}
+	if vhost.Access != nil {
+		spec.AllowFrom = vhost.Access.AllowFrom
+	}
+	if vhost.ClientAuth {
+		spec.ClientCA, spec.ClientCRL = caCertPath, clientCRLPath
+		spec.HTTPSOnly = !config.FrontProxyEnabled
+	}
+	return spec, nil
+}
+
+// vhostHasCert reports whether a site already has an SSL certificate issued
+// by the Gecko CA, which decides if its config gets an SSL block.
+func vhostHasCert(domainName string) bool {
+	if !isSSLEnabled() {
+		return false
 	}
+	_, err := os.Stat(filepath.Join(vhostCertsDir, domainName+".crt"))
+	return err == nil
+}
 
-	httpPort := config.ApachePort
-	sslPort := config.ApacheSSLPort
+func createVHostFile(docRoot, domainName string, useSSL bool) error {
+	spec, err := newVHostSpec(domainName, useSSL)
+	if err != nil {
+		return err
+	}
+	spec.DocRoot = docRoot
 
-	var requireLine string
-	if config.DevelopmentMode {
-		requireLine = "Require all granted"
-	} else {
-		requireLine = "Require local"
+	if err := os.MkdirAll(sitesEnabledDir(), os.ModePerm); err != nil {
+		return err
 	}
+	configPath := filepath.Join(sitesEnabledDir(), domainName+".conf")
+	return os.WriteFile(configPath, []byte(renderVHost(spec)), 0644)
+}
 
-	docRootApache := filepath.ToSlash(docRoot)
+// rewriteVHostFile re-renders an existing site's config where it is, so an
+// enabled site stays enabled and a disabled one stays disabled.
+func rewriteVHostFile(domainName string) error {
+	configPath := vhostConfigPath(domainName)
+	if configPath == "" {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	spec, err := newVHostSpec(domainName, vhostHasCert(domainName) && !frontProxyEnabled())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, []byte(renderVHost(spec)), 0644)
+}
+
+// applyVHostConfig re-renders a site after its registry record changed and
+// reloads the web server if the new config passes the test.
+func applyVHostConfig(domainName string) error {
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		return err
+	}
+	if err := rewriteVHostFile(domainName); err != nil {
+		snap.restore()
+		return err
+	}
+	if !commitWebServerConfig(snap) {
+		return fmt.Errorf("%s configuration test failed", WebServerName())
+	}
+	mirrorVHostToInactive(domainName)
+	if IsWebServerRunning() {
+		ReloadWebServer()
+	}
+	return nil
+}
+
+func renderVHost(spec *vhostSpec) string {
+	if activeWebServer() == webServerNginx {
+		return renderNginxServer(spec)
+	}
+	return renderApacheVHost(spec)
+}
+
+func renderApacheVHost(spec *vhostSpec) string {
+	accessLines := apacheAccessDirectives(spec, "        ")
+	envLines := apacheEnvDirectives(spec.Env, "    ")
+	aliasLine := ""
+	if len(spec.Aliases) > 0 {
+		aliasLine = "    ServerAlias " + strings.Join(spec.Aliases, " ") + "\n"
+	}
+
+	docRootApache := filepath.ToSlash(spec.DocRoot)
 	var configContent strings.Builder
 
 	vhostTemplate := `<VirtualHost *:%s>
     ServerName %s
-    DocumentRoot "%s"
-    <Directory "%s">
+%s    DocumentRoot "%s"
+%s    <Directory "%s">
         AllowOverride All
-        %s
-    </Directory>
+%s    </Directory>
 
 	# >> Add logs
 	ErrorLog "C:/Gecko/logs/httpd/%s_error.log"
-    CustomLog "C:/Gecko/logs/httpd/%s_access.log" combined
+    CustomLog "C:/Gecko/logs/httpd/%s_access.log" "%s"
+</VirtualHost>
+`
+	if spec.HTTPSOnly {
+		httpsOnlyTemplate := `<VirtualHost *:%s>
+    ServerName %s
+%s%s
+	# >> Add logs
+	ErrorLog "C:/Gecko/logs/httpd/%s_error.log"
+    CustomLog "C:/Gecko/logs/httpd/%s_access.log" "%s"
 </VirtualHost>
 `
-	configContent.WriteString(fmt.Sprintf(vhostTemplate, httpPort, domainName, docRootApache, docRootApache, requireLine, domainName, domainName))
+		configContent.WriteString(fmt.Sprintf(httpsOnlyTemplate, spec.HTTPPort, spec.Domain, aliasLine, apacheHTTPSOnlyDirectives(spec), spec.Domain, spec.Domain, apacheAccessLogFormat))
+	} else {
+		configContent.WriteString(fmt.Sprintf(vhostTemplate, spec.HTTPPort, spec.Domain, aliasLine, docRootApache, envLines, docRootApache, accessLines, spec.Domain, spec.Domain, apacheAccessLogFormat))
+	}
 
-	if useSSL {
-		certPath := filepath.ToSlash(filepath.Join(vhostCertsDir, domainName+".crt"))
-		keyPath := filepath.ToSlash(filepath.Join(vhostKeysDir, domainName+".key"))
+	if spec.SSL {
+		certPath := filepath.ToSlash(spec.CertPath)
+		keyPath := filepath.ToSlash(spec.KeyPath)
 		sslVHostTemplate := `
 <VirtualHost *:%s>
     ServerName %s
-    DocumentRoot "%s"
-    <Directory "%s">
+%s    DocumentRoot "%s"
+%s    <Directory "%s">
         AllowOverride All
-        %s
-    </Directory>
+%s    </Directory>
 
 	# >> Add logs
 	ErrorLog "C:/Gecko/logs/httpd/%s_error.log"
-    CustomLog "C:/Gecko/logs/httpd/%s_access.log" combined
+    CustomLog "C:/Gecko/logs/httpd/%s_access.log" "%s"
 
     SSLEngine on
     SSLCertificateFile      "%s"
     SSLCertificateKeyFile   "%s"
-</VirtualHost>`
-		configContent.WriteString(fmt.Sprintf(sslVHostTemplate, sslPort, domainName, docRootApache, docRootApache, requireLine, domainName, domainName, certPath, keyPath))
+%s</VirtualHost>`
+		configContent.WriteString(fmt.Sprintf(sslVHostTemplate, spec.SSLPort, spec.Domain, aliasLine, docRootApache, envLines, docRootApache, accessLines, spec.Domain, spec.Domain, apacheAccessLogFormat, certPath, keyPath, apacheClientAuthDirectives(spec)))
+	}
+
+	return configContent.String()
+}
+
+// apacheHTTPSOnlyDirectives sends plain HTTP to the HTTPS side, where client
+// certificates are checked, or refuses it while the site has no certificate.
+func apacheHTTPSOnlyDirectives(spec *vhostSpec) string {
+	if !spec.SSL {
+		return `    <Location "/">
+        Require all denied
+    </Location>
+`
 	}
+	return fmt.Sprintf("    Redirect permanent / %s/\n", httpsURL(spec.Domain, spec.SSLPort))
+}
 
-	configPath := filepath.Join(sitesEnabledDir, domainName+".conf")
-	return os.WriteFile(configPath, []byte(configContent.String()), 0644)
+// apacheClientAuthDirectives requires a client certificate from the Gecko
+// Root CA that is not on its CRL, and hands its details to PHP as SSL_CLIENT_*.
+func apacheClientAuthDirectives(spec *vhostSpec) string {
+	if spec.ClientCA == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+    SSLVerifyClient require
+    SSLVerifyDepth  1
+    SSLCACertificateFile "%s"
+    SSLCARevocationFile  "%s"
+    SSLCARevocationCheck leaf
+    SSLOptions +StdEnvVars
+`, filepath.ToSlash(spec.ClientCA), filepath.ToSlash(spec.ClientCRL))
 }
 
 func isSSLEnabled() bool {
@@ -86,80 +234,171 @@ func isSSLEnabled() bool {
 	return true
 }
 
-func CreateVirtualHost(domainName, choice string) {
-	domainName = strings.ToLower(strings.TrimSpace(domainName))
-	if domainName == "" {
-		fmt.Printf("%sDomain name cannot be empty.%s\n", shared.ColorRed, shared.ColorReset)
-		return
+func CreateVirtualHost(domainName, choice string) bool {
+	domainName, _, err := NormalizeDomainName(domainName)
+	if err != nil {
+		fmt.Printf("%sInvalid domain name: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return false
 	}
 	docRoot := filepath.Join(wwwDir, domainName)
-	vhostConfigFile := filepath.Join(sitesEnabledDir, domainName+".conf")
-	if _, err := os.Stat(vhostConfigFile); err == nil && choice != "y" {
-		return
+	if VirtualHostExists(domainName) && choice != "y" {
+		return false
+	}
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return false
 	}
+	// Whatever goes wrong from here on, the config, the hosts file, the
+	// certificate and a replaced docroot are put back the way they were.
+	backup := backupFiles(hostsFilePath, filepath.Join(vhostCertsDir, domainName+".crt"), filepath.Join(vhostKeysDir, domainName+".key"))
+	committed := false
+	oldDocRoot := ""
+	defer func() {
+		if committed {
+			if oldDocRoot != "" {
+				os.RemoveAll(oldDocRoot)
+			}
+			return
+		}
+		snap.restore()
+		backup.restore()
+		if oldDocRoot != "" {
+			os.RemoveAll(docRoot)
+			os.Rename(oldDocRoot, docRoot)
+		}
+	}()
+	// A replaced site comes back enabled.
+	_ = os.Remove(filepath.Join(sitesAvailableDir(), domainName+".conf"))
 	fmt.Printf("%sProcessing Virtual Host for %s...%s\n", shared.ColorYellow, domainName, shared.ColorReset)
 	if choice == "y" {
-		if err := formatVHostDirectory(docRoot, domainName); err != nil {
+		if oldDocRoot, err = formatVHostDirectory(docRoot, domainName); err != nil {
 			fmt.Printf("%sError formatting directory: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-			return
+			return false
 		}
 	} else {
 		if err := createDocRoot(docRoot, domainName); err != nil {
 			fmt.Printf("%sError creating document root: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-			return
+			return false
 		}
 	}
 	sslEnabled := isSSLEnabled()
-	if sslEnabled {
-		if err := activateSSLListener(); err != nil {
-			fmt.Printf("%sError activating Apache SSL listener: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-			return
+	// With the front proxy terminating TLS the web server only needs plain HTTP.
+	backendSSL := sslEnabled && !frontProxyEnabled()
+	if backendSSL {
+		if activeWebServer() == webServerApache {
+			if err := activateSSLListener(); err != nil {
+				fmt.Printf("%sError activating Apache SSL listener: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+				return false
+			}
 		}
 		if err := GenerateVHostCert(domainName); err != nil {
 			fmt.Printf("%sError generating SSL certificate: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-			return
+			return false
 		}
-	} else {
+	} else if !sslEnabled {
 		fmt.Printf("%sSSL is not enabled. Creating HTTP-only virtual host.%s\n", shared.ColorYellow, shared.ColorReset)
 	}
-	if err := createVHostFile(docRoot, domainName, sslEnabled); err != nil {
+	if err := createVHostFile(docRoot, domainName, backendSSL); err != nil {
 		fmt.Printf("%sError creating vhost config file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-		return
+		return false
 	}
-	if err := updateHostsFile(domainName, true); err != nil {
-		fmt.Printf("%sError updating hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
-		return
+	for _, hostname := range vhostHostnames(domainName) {
+		if err := updateHostsFile(hostname, true); err != nil {
+			fmt.Printf("%sError updating hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+			return false
+		}
+	}
+	if !commitWebServerConfig(snap) {
+		return false
 	}
-	RestartApache()
+	committed = true
+	mirrorVHostToInactive(domainName)
+	ReloadWebServer()
 	if sslEnabled {
 		fmt.Printf("%sSuccessfully processed virtual host. You can access it at https://%s%s\n", shared.ColorGreen, domainName, shared.ColorReset)
 	} else {
 		fmt.Printf("%sSuccessfully processed virtual host. You can access it at http://%s%s\n", shared.ColorGreen, domainName, shared.ColorReset)
 	}
+	return true
+}
+
+// fileBackup holds files as they were before a change; a nil entry is a file
+// that did not exist yet.
+type fileBackup map[string][]byte
+
+func backupFiles(paths ...string) fileBackup {
+	backup := make(fileBackup)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil && data == nil {
+			data = []byte{}
+		}
+		backup[path] = data
+	}
+	return backup
+}
+
+func (b fileBackup) restore() {
+	for path, data := range b {
+		if data == nil {
+			os.Remove(path)
+			continue
+		}
+		if current, err := os.ReadFile(path); err != nil || !bytes.Equal(current, data) {
+			os.WriteFile(path, data, 0644)
+		}
+	}
 }
 
 func DeleteVirtualHost(domainName string) {
 	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	// Never let a malformed name turn the RemoveAll below into a path traversal.
+	if err := checkSiteName(domainName); err != nil {
+		fmt.Printf("%sRefusing to delete: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		return
+	}
 	fmt.Printf("%sDeleting virtual host %s...%s\n", shared.ColorYellow, domainName, shared.ColorReset)
-	_ = os.Remove(filepath.Join(sitesEnabledDir, domainName+".conf"))
+	hostnames := vhostHostnames(domainName)
+	_ = os.Remove(filepath.Join(sitesEnabledDir(), domainName+".conf"))
+	_ = os.Remove(filepath.Join(sitesAvailableDir(), domainName+".conf"))
 	_ = os.RemoveAll(filepath.Join(wwwDir, domainName))
 	_ = os.Remove(filepath.Join(vhostCertsDir, domainName+".crt"))
 	_ = os.Remove(filepath.Join(vhostKeysDir, domainName+".key"))
-	if err := updateHostsFile(domainName, false); err != nil {
-		fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	_ = os.Remove(htpasswdPath(domainName))
+	_ = removeVHostRecord(domainName)
+	mirrorVHostToInactive(domainName)
+	for _, hostname := range hostnames {
+		if err := updateHostsFile(hostname, false); err != nil {
+			fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
 	}
-	RestartApache()
+	ReloadWebServer()
 	fmt.Printf("%sVirtual host %s deleted successfully.%s\n", shared.ColorGreen, domainName, shared.ColorReset)
 }
 
 func ListVirtualHosts() ([]string, error) {
-	files, err := os.ReadDir(sitesEnabledDir)
+	return listVHostConfigs(sitesEnabledDir())
+}
+
+// ListDisabledVirtualHosts returns sites whose config has been parked in
+// sites-available by DisableVirtualHost.
+func ListDisabledVirtualHosts() ([]string, error) {
+	vhosts, err := listVHostConfigs(sitesAvailableDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return vhosts, err
+}
+
+func listVHostConfigs(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 	var vhosts []string
 	for _, file := range files {
-		if file.Name() == "00-default.conf" || file.Name() == "00-default-ssl.conf" {
+		if file.Name() == "00-default.conf" || file.Name() == "00-default-ssl.conf" || file.Name() == mailSiteConfigName || file.Name() == apacheDotfilesConfig {
 			continue
 		}
 		if strings.HasSuffix(file.Name(), ".conf") {
@@ -170,18 +409,125 @@ func ListVirtualHosts() ([]string, error) {
 	return vhosts, nil
 }
 
-func formatVHostDirectory(path, domainName string) error {
-	fmt.Printf("%sFormatting directory %s...%s\n", shared.ColorYellow, path, shared.ColorReset)
-	if err := os.RemoveAll(path); err != nil {
+func VirtualHostExists(domainName string) bool {
+	return vhostConfigPath(domainName) != ""
+}
+
+func IsVirtualHostEnabled(domainName string) bool {
+	_, err := os.Stat(filepath.Join(sitesEnabledDir(), domainName+".conf"))
+	return err == nil
+}
+
+// vhostConfigPath returns the site's config file, enabled or not, or "" if
+// the site does not exist.
+func vhostConfigPath(domainName string) string {
+	for _, dir := range []string{sitesEnabledDir(), sitesAvailableDir()} {
+		path := filepath.Join(dir, domainName+".conf")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func DisableVirtualHost(domainName string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if err := checkSiteName(domainName); err != nil {
 		return err
 	}
-	return createDocRoot(path, domainName)
+	return setVirtualHostEnabled(domainName, false)
+}
+
+func EnableVirtualHost(domainName string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if err := checkSiteName(domainName); err != nil {
+		return err
+	}
+	return setVirtualHostEnabled(domainName, true)
+}
+
+func setVirtualHostEnabled(domainName string, enable bool) error {
+	enabledPath := filepath.Join(sitesEnabledDir(), domainName+".conf")
+	availablePath := filepath.Join(sitesAvailableDir(), domainName+".conf")
+	from, to, action := enabledPath, availablePath, "Disabling"
+	if enable {
+		from, to, action = availablePath, enabledPath, "Enabling"
+	}
+	if _, err := os.Stat(from); err != nil {
+		if _, errTo := os.Stat(to); errTo == nil {
+			return fmt.Errorf("virtual host '%s' is already %s", domainName, ternaryState(enable))
+		}
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+
+	fmt.Printf("%s%s virtual host %s...%s\n", shared.ColorYellow, action, domainName, shared.ColorReset)
+	snap, err := snapshotWebServerConfig()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if err := setHostsEntryEnabled(domainName, enable); err != nil {
+		fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+	}
+	if !commitWebServerConfig(snap) {
+		setHostsEntryEnabled(domainName, !enable)
+		return fmt.Errorf("%s configuration test failed", WebServerName())
+	}
+	mirrorVHostToInactive(domainName)
+	ReloadWebServer()
+	fmt.Printf("%sVirtual host %s is now %s.%s\n", shared.ColorGreen, domainName, ternaryState(enable), shared.ColorReset)
+	return nil
+}
+
+func ternaryState(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// formatVHostDirectory moves the existing docroot aside and creates a fresh
+// one. It returns where the old files went, or "" if there were none, so the
+// caller can delete them once the site is in place or move them back.
+func formatVHostDirectory(path, domainName string) (string, error) {
+	fmt.Printf("%sFormatting directory %s...%s\n", shared.ColorYellow, path, shared.ColorReset)
+	old := path + ".replaced"
+	if err := os.RemoveAll(old); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, old); os.IsNotExist(err) {
+		old = ""
+	} else if err != nil {
+		return "", err
+	}
+	if err := createDocRoot(path, domainName); err != nil {
+		if old != "" {
+			os.RemoveAll(path)
+			os.Rename(old, path)
+		}
+		return "", err
+	}
+	return old, nil
 }
 
 func createDocRoot(path, domainName string) error {
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return err
 	}
+	// Only drop the welcome page into an empty docroot, so an existing project's
+	// index.php is never shadowed by it.
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
 	indexPath := filepath.Join(path, "index.html")
 	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
 		htmlTemplate := `<!DOCTYPE html>
@@ -208,66 +554,3 @@ func createDocRoot(path, domainName string) error {
 	}
 	return nil
 }
-
-func updateHostsFile(domainName string, add bool) error {
-	file, err := os.Open(hostsFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	var lines []string
-	var geckoLines []string
-	inGeckoBlock := false
-	scanner := bufio.NewReader(file)
-	for {
-		line, errRead := scanner.ReadString('\n')
-		line = strings.TrimRight(line, "\r\n")
-
-		if strings.TrimSpace(line) == geckoStartBlock {
-			inGeckoBlock = true
-			continue
-		}
-		if strings.TrimSpace(line) == geckoEndBlock {
-			inGeckoBlock = false
-			continue
-		}
-		if inGeckoBlock {
-			if strings.TrimSpace(line) != "" {
-				geckoLines = append(geckoLines, line)
-			}
-		} else {
-			lines = append(lines, line)
-		}
-		if errRead != nil {
-			break
-		}
-	}
-	file.Close()
-
-	newGeckoLines := []string{}
-	entry := "127.0.0.1 " + domainName
-	found := false
-	for _, line := range geckoLines {
-		if strings.Contains(line, domainName) {
-			found = true
-			if add {
-				newGeckoLines = append(newGeckoLines, entry)
-			}
-		} else {
-			newGeckoLines = append(newGeckoLines, line)
-		}
-	}
-
-	if add && !found {
-		newGeckoLines = append(newGeckoLines, entry)
-	}
-
-	finalContent := strings.Join(lines, "\r\n")
-	if len(newGeckoLines) > 0 {
-		finalContent += "\r\n\r\n" + geckoStartBlock + "\r\n"
-		finalContent += strings.Join(newGeckoLines, "\r\n") + "\r\n"
-		finalContent += geckoEndBlock
-	}
-
-	return os.WriteFile(hostsFilePath, []byte(finalContent), 0644)
-}
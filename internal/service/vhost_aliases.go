@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// certNamesFor is the SAN list for a site certificate: the domain and its
+// aliases. Sites are only reached by name, while a bare IP address lands on
+// the default host, so only the localhost certificate covers the loopback
+// addresses and, in dev mode, this machine's LAN addresses.
+func certNamesFor(domainName string) []string {
+	if domainName == "localhost" {
+		names := []string{"localhost", "127.0.0.1", "::1"}
+		if config, err := GetConfig(); err == nil && config.DevelopmentMode {
+			for _, ip := range getLANIPs() {
+				names = append(names, ip.String())
+			}
+		}
+		return names
+	}
+	names := []string{domainName}
+	if vhost, err := GetVHost(domainName); err == nil {
+		names = append(names, vhost.Aliases...)
+	}
+	return names
+}
+
+// vhostHostnames returns the names of a site that need hosts file entries.
+// Wildcard aliases cannot be expressed there and rely on the DNS resolver.
+func vhostHostnames(domainName string) []string {
+	names := []string{domainName}
+	if vhost, err := GetVHost(domainName); err == nil {
+		for _, alias := range vhost.Aliases {
+			if !strings.HasPrefix(alias, "*.") {
+				names = append(names, alias)
+			}
+		}
+	}
+	return names
+}
+
+// siteForName returns the enabled site that answers to name, by its domain or
+// through an alias, a wildcard alias included.
+func siteForName(name string) (string, bool) {
+	domains, err := ListVirtualHosts()
+	if err != nil {
+		return "", false
+	}
+	for _, domain := range domains {
+		if domain == name {
+			return domain, true
+		}
+	}
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return "", false
+	}
+	_, parent, _ := strings.Cut(name, ".")
+	for _, domain := range domains {
+		vhost := registry[domain]
+		if vhost == nil {
+			continue
+		}
+		for _, alias := range vhost.Aliases {
+			if alias == name || alias == "*."+parent {
+				return domain, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkAlias accepts a host name or a single leading wildcard label.
+func checkAlias(alias string) error {
+	if err := checkDomainName(strings.TrimPrefix(alias, "*.")); err != nil {
+		return err
+	}
+	if strings.HasPrefix(alias, "*.") && strings.Count(alias, ".") < 2 {
+		return fmt.Errorf("wildcard '%s' must cover a domain, not a whole TLD", alias)
+	}
+	return nil
+}
+
+func AddVHostAlias(domainName, alias string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	if err := checkAlias(alias); err != nil {
+		return err
+	}
+	if alias == vhost.Domain {
+		return fmt.Errorf("'%s' is already the site's main name", alias)
+	}
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	for domain, other := range registry {
+		if domain == alias && domain != vhost.Domain {
+			return fmt.Errorf("'%s' is already a virtual host", alias)
+		}
+		for _, existing := range other.Aliases {
+			if existing == alias {
+				return fmt.Errorf("'%s' is already an alias of %s", alias, domain)
+			}
+		}
+	}
+	if VirtualHostExists(alias) {
+		return fmt.Errorf("'%s' is already a virtual host", alias)
+	}
+
+	// The alias only reaches the hosts file once the certificate and config
+	// that cover it are in place; if either fails, the site is put back.
+	previous := vhost.Aliases
+	backup := backupFiles(filepath.Join(vhostCertsDir, vhost.Domain+".crt"), filepath.Join(vhostKeysDir, vhost.Domain+".key"))
+	vhost.Aliases = append(append([]string(nil), previous...), alias)
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	if err := applyVHostNames(vhost.Domain); err != nil {
+		vhost.Aliases = previous
+		SaveVHost(vhost)
+		backup.restore()
+		return err
+	}
+	if strings.HasPrefix(alias, "*.") {
+		if !isDNSResolverActive(alias) {
+			fmt.Printf("%sNote: the hosts file cannot hold wildcards; turn on the local DNS resolver so %s resolves.%s\n", shared.ColorYellow, alias, shared.ColorReset)
+		}
+	} else if IsVirtualHostEnabled(vhost.Domain) {
+		if err := updateHostsFile(alias, true); err != nil {
+			fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
+	}
+	fmt.Printf("%s%s now also answers to %s.%s\n", shared.ColorGreen, vhost.Domain, alias, shared.ColorReset)
+	return nil
+}
+
+func RemoveVHostAlias(domainName, alias string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	kept := vhost.Aliases[:0]
+	for _, existing := range vhost.Aliases {
+		if existing != alias {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(vhost.Aliases) {
+		return fmt.Errorf("'%s' is not an alias of %s", alias, vhost.Domain)
+	}
+	vhost.Aliases = kept
+	if len(kept) == 0 {
+		vhost.Aliases = nil
+	}
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(alias, "*.") {
+		if err := updateHostsFile(alias, false); err != nil {
+			fmt.Printf("%sCould not update hosts file: %v%s\n", shared.ColorRed, err, shared.ColorReset)
+		}
+	}
+	if err := applyVHostNames(vhost.Domain); err != nil {
+		return err
+	}
+	fmt.Printf("%sAlias %s removed from %s.%s\n", shared.ColorGreen, alias, vhost.Domain, shared.ColorReset)
+	return nil
+}
+
+func ListVHostAliases(domainName string) error {
+	vhost, err := getExistingVHost(domainName)
+	if err != nil {
+		return err
+	}
+	if len(vhost.Aliases) == 0 {
+		fmt.Printf("%s%s has no aliases.%s\n", shared.ColorYellow, vhost.Domain, shared.ColorReset)
+		return nil
+	}
+	fmt.Printf("%sAliases of %s%s\n", shared.ColorGreen, vhost.Domain, shared.ColorReset)
+	for _, alias := range vhost.Aliases {
+		fmt.Printf("  %s\n", alias)
+	}
+	return nil
+}
+
+// applyVHostNames re-issues the site certificate so it covers the current
+// names, then re-renders the site config.
+func applyVHostNames(domainName string) error {
+	if _, err := os.Stat(filepath.Join(vhostCertsDir, domainName+".crt")); err == nil {
+		if err := GenerateVHostCert(domainName); err != nil {
+			return fmt.Errorf("could not re-issue the certificate: %w", err)
+		}
+	}
+	return applyVHostConfig(domainName)
+}
@@ -0,0 +1,548 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gecko/internal/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	archiveFormatVersion = 1
+	archiveManifestName  = "manifest.json"
+	archiveRegistryName  = "vhost/vhost.json"
+	archiveHtpasswdName  = "vhost/htpasswd"
+	archiveDumpName      = "database/dump.sql"
+	archiveDocRootPrefix = "www/"
+)
+
+type archiveManifest struct {
+	FormatVersion int            `json:"format_version"`
+	Domain        string         `json:"domain"`
+	CreatedAt     time.Time      `json:"created_at"`
+	SSL           bool           `json:"ssl"`
+	Database      *VHostDatabase `json:"database,omitempty"`
+}
+
+// ExportVirtualHost packs a site's docroot, registry record and database dump
+// into a single zip archive that ImportVirtualHost can restore elsewhere. The
+// web server config is left out: it depends on this machine's ports, backend
+// and paths, so the importing side renders its own.
+func ExportVirtualHost(domainName, outPath string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	if err := checkSiteName(domainName); err != nil {
+		return err
+	}
+	if vhostConfigPath(domainName) == "" {
+		return fmt.Errorf("virtual host '%s' not found", domainName)
+	}
+	vhost, err := GetVHost(domainName)
+	if err != nil {
+		return err
+	}
+	if outPath == "" {
+		outPath = domainName + ".gecko.zip"
+	}
+
+	fmt.Printf("%sExporting %s to %s...%s\n", shared.ColorYellow, domainName, outPath, shared.ColorReset)
+	file, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(file)
+	if err := writeVHostArchive(archive, vhost); err != nil {
+		archive.Close()
+		file.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%sVirtual host exported successfully to %s%s\n", shared.ColorGreen, outPath, shared.ColorReset)
+	return nil
+}
+
+func writeVHostArchive(archive *zip.Writer, vhost *VHost) error {
+	manifest := archiveManifest{
+		FormatVersion: archiveFormatVersion,
+		Domain:        vhost.Domain,
+		CreatedAt:     time.Now().UTC(),
+		SSL:           vhostHasCert(vhost.Domain),
+		Database:      vhost.Database,
+	}
+
+	registryData, err := json.MarshalIndent(vhost, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(archive, archiveRegistryName, registryData); err != nil {
+		return err
+	}
+	if htpasswd, err := os.ReadFile(htpasswdPath(vhost.Domain)); err == nil {
+		if err := writeArchiveFile(archive, archiveHtpasswdName, htpasswd); err != nil {
+			return err
+		}
+	}
+
+	if vhost.Database != nil {
+		fmt.Printf("%sDumping %s database '%s'...%s\n", shared.ColorYellow, vhost.Database.Engine, vhost.Database.Name, shared.ColorReset)
+		w, err := archive.Create(archiveDumpName)
+		if err != nil {
+			return err
+		}
+		switch vhost.Database.Engine {
+		case "mysql":
+			err = dumpMySQLDatabase(vhost.Database.Name, w)
+		case "postgres":
+			err = dumpPostgresDatabase(vhost.Database.Name, w)
+		default:
+			err = fmt.Errorf("unknown database engine '%s'", vhost.Database.Engine)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	docRoot := filepath.Join(wwwDir, vhost.Domain)
+	fmt.Printf("%sPacking document root %s...%s\n", shared.ColorYellow, docRoot, shared.ColorReset)
+	err = filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(docRoot, path)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = archiveDocRootPrefix + filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		w, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pack document root: %w", err)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeArchiveFile(archive, archiveManifestName, manifestData)
+}
+
+func writeArchiveFile(archive *zip.Writer, name string, content []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// ImportVirtualHost recreates a site from an archive made by ExportVirtualHost.
+// Certificates are issued fresh against this machine's Gecko Root CA. The
+// archive is untrusted input: every setting it carries goes through the same
+// checks as the command that sets it, and anything that runs or reaches code
+// on this machine is only kept once the user agrees.
+func ImportVirtualHost(archivePath string, reader *bufio.Reader) error {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("could not open archive: %w", err)
+	}
+	defer archive.Close()
+
+	manifest, err := readArchiveManifest(&archive.Reader)
+	if err != nil {
+		return err
+	}
+	if manifest.FormatVersion > archiveFormatVersion {
+		return fmt.Errorf("archive format version %d is newer than this Gecko supports", manifest.FormatVersion)
+	}
+	domainName, warnings, err := NormalizeDomainName(manifest.Domain)
+	if err != nil {
+		return fmt.Errorf("archive contains an invalid domain name: %w", err)
+	}
+	if len(warnings) > 0 {
+		for _, warning := range warnings {
+			fmt.Printf("%sWarning: %s%s\n", shared.ColorYellow, warning, shared.ColorReset)
+		}
+		fmt.Print(shared.ColorYellow, "Import '", domainName, "' anyway? (y/n): ", shared.ColorReset)
+		confirm, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(confirm)) != "y" {
+			return fmt.Errorf("import cancelled")
+		}
+	}
+
+	var db *VHostDatabase
+	if manifest.Database != nil {
+		copied := *manifest.Database
+		db = &copied
+		if err := checkImportedDatabase(db, domainName); err != nil {
+			return fmt.Errorf("archive database cannot be imported: %w", err)
+		}
+	}
+	archived := &VHost{}
+	if f := findArchiveFile(&archive.Reader, archiveRegistryName); f != nil {
+		if err := readArchiveJSON(f, archived); err != nil {
+			return err
+		}
+	}
+	vhost, err := importedVHost(archived, domainName, reader)
+	if err != nil {
+		return err
+	}
+	vhost.Database = db
+
+	fmt.Printf("%sImporting %s from %s...%s\n", shared.ColorYellow, domainName, archivePath, shared.ColorReset)
+	docRoot := filepath.Join(wwwDir, domainName)
+	vhostConfigFile := vhostConfigPath(domainName)
+	if vhostConfigFile != "" || !dirIsEmpty(docRoot) {
+		if vhostConfigFile != "" {
+			fmt.Printf("%sWarning: VHost for '%s' already exists.%s\n", shared.ColorRed, domainName, shared.ColorReset)
+		} else {
+			fmt.Printf("%sWarning: %s already exists and is not empty.%s\n", shared.ColorRed, docRoot, shared.ColorReset)
+		}
+		fmt.Print(shared.ColorYellow, "Do you want to replace it and its files? (y/n): ", shared.ColorReset)
+		confirm, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(confirm)) != "y" {
+			return fmt.Errorf("import cancelled")
+		}
+	}
+
+	// Extract next to the docroot and swap it in, so a broken archive leaves
+	// the existing files alone.
+	staging := docRoot + ".importing"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := extractDocRoot(&archive.Reader, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.RemoveAll(docRoot); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.Rename(staging, docRoot); err != nil {
+		return fmt.Errorf("could not move the extracted files to %s (they are in %s): %w", docRoot, staging, err)
+	}
+	if vhostConfigFile != "" {
+		_ = os.Remove(vhostConfigFile)
+	}
+
+	if vhost.ClientAuth {
+		if err := ensureClientCRL(); err != nil {
+			fmt.Printf("%sThe site required client certificates, but no CRL could be written, so it no longer does: %v%s\n", shared.ColorYellow, err, shared.ColorReset)
+			vhost.ClientAuth = false
+		}
+	}
+	if err := SaveVHost(vhost); err != nil {
+		return err
+	}
+	_ = os.Remove(htpasswdPath(domainName))
+	if f := findArchiveFile(&archive.Reader, archiveHtpasswdName); f != nil {
+		if err := extractArchiveFile(f, htpasswdPath(domainName)); err != nil {
+			return err
+		}
+	}
+
+	if !CreateVirtualHost(domainName, "") {
+		return fmt.Errorf("failed to recreate virtual host '%s'", domainName)
+	}
+
+	if db != nil {
+		f := findArchiveFile(&archive.Reader, archiveDumpName)
+		if f == nil {
+			return fmt.Errorf("archive manifest lists a database but contains no dump")
+		}
+		fmt.Printf("%sRestoring %s database '%s'...%s\n", shared.ColorYellow, db.Engine, db.Name, shared.ColorReset)
+		dump, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer dump.Close()
+		if db.Engine == "postgres" {
+			err = restorePostgresDatabase(db, dump)
+		} else {
+			err = restoreMySQLDatabase(db, dump)
+		}
+		if err != nil {
+			return fmt.Errorf("site files restored, but the database could not be: %w", err)
+		}
+	}
+
+	fmt.Printf("%sVirtual host %s imported successfully.%s\n", shared.ColorGreen, domainName, shared.ColorReset)
+	return nil
+}
+
+// checkImportedDatabase applies the checks CreateDatabase does to the
+// archive's database and refuses one whose name or user another site owns,
+// since restoring it would reset that user's password.
+func checkImportedDatabase(db *VHostDatabase, domainName string) error {
+	engine, err := normalizeDBEngine(db.Engine)
+	if err != nil {
+		return err
+	}
+	db.Engine = engine
+	if err := checkDatabaseName(db.Name, engine); err != nil {
+		return err
+	}
+	if !isValidSQLIdentifier(db.User) {
+		return fmt.Errorf("'%s' is not a valid user name", db.User)
+	}
+	for _, name := range []string{db.Name, db.User} {
+		if reservedDatabaseUsers[name] {
+			return fmt.Errorf("'%s' is a reserved user name", name)
+		}
+	}
+	if db.Password == "" {
+		return fmt.Errorf("the user '%s' has no password", db.User)
+	}
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	for domain, vhost := range registry {
+		other := vhost.Database
+		if domain == domainName || other == nil || other.Engine != engine {
+			continue
+		}
+		if other.Name == db.Name || other.User == db.User {
+			return fmt.Errorf("%s database '%s' or user '%s' already belongs to %s", dbEngineName(engine), db.Name, db.User, domain)
+		}
+	}
+	return nil
+}
+
+// importedVHost rebuilds a registry record from the archive's copy, keeping
+// only what passes the checks the matching commands apply. Processes, the
+// upstream and aliases under public TLDs are listed for confirmation first.
+func importedVHost(archived *VHost, domainName string, reader *bufio.Reader) (*VHost, error) {
+	vhost := &VHost{Domain: domainName, ClientAuth: archived.ClientAuth}
+	skip := func(what string, err error) {
+		fmt.Printf("%sSkipping %s from the archive: %v%s\n", shared.ColorYellow, what, err, shared.ColorReset)
+	}
+
+	for _, key := range sortedEnvKeys(archived.Env) {
+		if err := checkEnvVar(key, archived.Env[key]); err != nil {
+			skip("variable "+key, err)
+			continue
+		}
+		if vhost.Env == nil {
+			vhost.Env = make(map[string]string)
+		}
+		vhost.Env[key] = archived.Env[key]
+	}
+	if archived.EnvFile != "" {
+		// The path is from the exporting machine; only one inside the site's
+		// own document root means the same thing here.
+		docRoot := filepath.Join(wwwDir, domainName)
+		if rel, err := filepath.Rel(docRoot, filepath.Clean(archived.EnvFile)); err == nil && filepath.IsLocal(rel) {
+			vhost.EnvFile = filepath.Join(docRoot, rel)
+		} else {
+			skip("the .env file "+archived.EnvFile, fmt.Errorf("it is outside the document root"))
+		}
+	}
+	if archived.Access != nil {
+		for _, network := range archived.Access.AllowFrom {
+			cidr, err := normalizeCIDR(network)
+			if err != nil {
+				skip("allowed network "+network, err)
+				continue
+			}
+			if vhost.Access == nil {
+				vhost.Access = &VHostAccess{}
+			}
+			vhost.Access.AllowFrom = append(vhost.Access.AllowFrom, cidr)
+		}
+	}
+
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]string)
+	for domain, other := range registry {
+		if domain == domainName {
+			continue
+		}
+		taken[domain] = domain
+		for _, alias := range other.Aliases {
+			taken[alias] = domain
+		}
+	}
+	var publicAliases []string
+	for _, alias := range archived.Aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if err := checkAlias(alias); err != nil {
+			skip("alias "+alias, err)
+			continue
+		}
+		if owner, ok := taken[alias]; ok || alias == domainName {
+			skip("alias "+alias, fmt.Errorf("it is already used by %s", owner))
+			continue
+		}
+		taken[alias] = domainName
+		if !hasReservedTLD(alias) {
+			publicAliases = append(publicAliases, alias)
+		}
+		vhost.Aliases = append(vhost.Aliases, alias)
+	}
+	names := make(map[string]bool)
+	for _, spec := range archived.Processes {
+		if err := checkVHostProcess(&spec); err != nil {
+			skip("process "+spec.Name, err)
+			continue
+		}
+		if names[spec.Name] {
+			continue
+		}
+		names[spec.Name] = true
+		vhost.Processes = append(vhost.Processes, spec)
+	}
+	if archived.Upstream != "" {
+		if vhost.Upstream, err = normalizeUpstream(archived.Upstream); err != nil {
+			skip("upstream "+archived.Upstream, err)
+		}
+	}
+
+	if len(vhost.Processes) == 0 && vhost.Upstream == "" && len(publicAliases) == 0 {
+		return vhost, nil
+	}
+	fmt.Printf("%sThe archive also asks for:%s\n", shared.ColorYellow, shared.ColorReset)
+	for _, spec := range vhost.Processes {
+		dir := ""
+		if spec.Dir != "" {
+			dir = fmt.Sprintf(" (in %s)", spec.Dir)
+		}
+		fmt.Printf("  process %-12s %s%s\n", spec.Name, spec.Command, dir)
+	}
+	if vhost.Upstream != "" {
+		fmt.Printf("  upstream %s\n", vhost.Upstream)
+	}
+	for _, alias := range publicAliases {
+		fmt.Printf("  alias %s (not a reserved TLD, so it may hide a real website)\n", alias)
+	}
+	fmt.Print(shared.ColorYellow, "Import these as well? Processes run as you while the web server is up. (y/n): ", shared.ColorReset)
+	confirm, _ := reader.ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(confirm)) == "y" {
+		return vhost, nil
+	}
+	vhost.Processes, vhost.Upstream = nil, ""
+	kept := vhost.Aliases[:0]
+	for _, alias := range vhost.Aliases {
+		if hasReservedTLD(alias) {
+			kept = append(kept, alias)
+		}
+	}
+	vhost.Aliases = kept
+	if len(kept) == 0 {
+		vhost.Aliases = nil
+	}
+	return vhost, nil
+}
+
+func readArchiveManifest(archive *zip.Reader) (*archiveManifest, error) {
+	f := findArchiveFile(archive, archiveManifestName)
+	if f == nil {
+		return nil, fmt.Errorf("not a Gecko site archive: %s is missing", archiveManifestName)
+	}
+	var manifest archiveManifest
+	if err := readArchiveJSON(f, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func readArchiveJSON(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", f.Name, err)
+	}
+	return nil
+}
+
+func dirIsEmpty(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err != nil || len(entries) == 0
+}
+
+func findArchiveFile(archive *zip.Reader, name string) *zip.File {
+	for _, f := range archive.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func extractDocRoot(archive *zip.Reader, docRoot string) error {
+	if err := os.MkdirAll(docRoot, os.ModePerm); err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		if !strings.HasPrefix(f.Name, archiveDocRootPrefix) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rel := filepath.FromSlash(strings.TrimPrefix(f.Name, archiveDocRootPrefix))
+		target := filepath.Join(docRoot, rel)
+		// Refuse entries that would land outside the docroot.
+		if !strings.HasPrefix(target, filepath.Clean(docRoot)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry '%s' escapes the document root", f.Name)
+		}
+		if err := extractArchiveFile(f, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractArchiveFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vhostRegistryPath = `C:\Gecko\etc\config\vhosts.json`
+)
+
+// VHost is everything Gecko knows about a site beyond its Apache config file.
+type VHost struct {
+	Domain   string         `json:"domain"`
+	Database *VHostDatabase `json:"database,omitempty"`
+	// Upstream is where the front proxy sends requests: empty for the web
+	// server, "fastcgi" for php-cgi, or an http(s) URL.
+	Upstream string            `json:"upstream,omitempty"`
+	Access   *VHostAccess      `json:"access,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	EnvFile  string            `json:"env_file,omitempty"`
+	// Aliases are extra names the site answers to; "*.name" is allowed.
+	Aliases []string `json:"aliases,omitempty"`
+	// Processes run alongside the site while the web server is up.
+	Processes []VHostProcess `json:"processes,omitempty"`
+	// ClientAuth makes the site's HTTPS side demand a client certificate
+	// signed by the Gecko Root CA.
+	ClientAuth bool `json:"client_auth,omitempty"`
+}
+
+type VHostDatabase struct {
+	Engine   string `json:"engine"`
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+func loadVHostRegistry() (map[string]*VHost, error) {
+	registry := make(map[string]*VHost)
+	data, err := os.ReadFile(vhostRegistryPath)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vhost registry: %w", err)
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("failed to parse vhost registry: %w", err)
+	}
+	for domain, vhost := range registry {
+		vhost.Domain = domain
+	}
+	return registry, nil
+}
+
+func saveVHostRegistry(registry map[string]*VHost) error {
+	data, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal vhost registry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(vhostRegistryPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(vhostRegistryPath, data, 0644)
+}
+
+// GetVHost returns the registry record for a domain, or an empty record if the
+// site was created before the registry existed.
+func GetVHost(domainName string) (*VHost, error) {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if vhost, ok := registry[domainName]; ok {
+		return vhost, nil
+	}
+	return &VHost{Domain: domainName}, nil
+}
+
+func SaveVHost(vhost *VHost) error {
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	registry[vhost.Domain] = vhost
+	return saveVHostRegistry(registry)
+}
+
+func removeVHostRecord(domainName string) error {
+	registry, err := loadVHostRegistry()
+	if err != nil {
+		return err
+	}
+	if _, ok := registry[domainName]; !ok {
+		return nil
+	}
+	delete(registry, domainName)
+	return saveVHostRegistry(registry)
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"fmt"
+	"gecko/internal/shared"
+	"os"
+	"path/filepath"
+)
+
+const (
+	webServerApache = "apache"
+	webServerNginx  = "nginx"
+)
+
+// configSnapshot holds the contents of every file under a config directory
+// so a failed change can be rolled back.
+type configSnapshot struct {
+	dir   string
+	files map[string][]byte
+}
+
+type configTestError struct {
+	File    string
+	Line    int
+	Message string
+	Output  string
+}
+
+func (e *configTestError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("syntax error in %s on line %d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("configuration test failed: %s", e.Output)
+}
+
+// activeWebServer is the backend chosen with "web_server" in gecko-config.json.
+func activeWebServer() string {
+	config, err := GetConfig()
+	if err == nil && config.WebServer == webServerNginx {
+		return webServerNginx
+	}
+	return webServerApache
+}
+
+func WebServerName() string {
+	if activeWebServer() == webServerNginx {
+		return "Nginx"
+	}
+	return "Apache"
+}
+
+func webServerProcess() string {
+	if activeWebServer() == webServerNginx {
+		return "nginx.exe"
+	}
+	return "httpd.exe"
+}
+
+func IsWebServerRunning() bool {
+	return IsServiceRunning(webServerProcess())
+}
+
+func StartWebServer() {
+	if activeWebServer() == webServerNginx {
+		StartNginx()
+	} else {
+		StartApache()
+	}
+	if err := StartProcessSupervisor(); err != nil {
+		fmt.Printf("%sNote: site processes not started here: %v%s\n", shared.ColorYellow, err, shared.ColorReset)
+	}
+}
+
+func StopWebServer() {
+	StopProcessSupervisor()
+	if activeWebServer() == webServerNginx {
+		StopNginx()
+	} else {
+		StopApache()
+	}
+}
+
+// RestartWebServer fully stops and starts the web server. Config changes
+// that do not need it should use ReloadWebServer.
+func RestartWebServer() {
+	if activeWebServer() == webServerNginx {
+		RestartNginx()
+	} else {
+		RestartApache()
+	}
+}
+
+func ReloadWebServer() {
+	if activeWebServer() == webServerNginx {
+		ReloadNginx()
+	} else {
+		ReloadApache()
+	}
+}
+
+func GetWebServerVersion() string {
+	if activeWebServer() == webServerNginx {
+		return getVersion(nginxExe, "-v")
+	}
+	return GetApacheVersion()
+}
+
+func GetWebServerPort() string {
+	return findPortsByPIDs(getPIDsByProcessName(webServerProcess()))
+}
+
+// webServerPorts returns the ports Apache or nginx should listen on. When the
+// front proxy owns the public ports, the web server moves to the backend ports.
+func webServerPorts(config *Config) (string, string) {
+	if config.FrontProxyEnabled {
+		return config.BackendHTTPPort, config.BackendSSLPort
+	}
+	return config.ApachePort, config.ApacheSSLPort
+}
+
+func sitesEnabledDir() string {
+	if activeWebServer() == webServerNginx {
+		return nginxSitesEnabledDir
+	}
+	return apacheSitesEnabledDir
+}
+
+func sitesAvailableDir() string {
+	if activeWebServer() == webServerNginx {
+		return nginxSitesAvailableDir
+	}
+	return apacheSitesAvailableDir
+}
+
+// mirrorVHostToInactive makes the other web server's copy of a site match the
+// active one, enabled, disabled or gone, so switching web_server brings up
+// the same sites. nginx is left alone until its first use, which copies
+// every site over anyway.
+func mirrorVHostToInactive(domainName string) {
+	enabledDir, availableDir := apacheSitesEnabledDir, apacheSitesAvailableDir
+	render := renderApacheVHost
+	if activeWebServer() == webServerApache {
+		if _, err := os.Stat(nginxConfFile); err != nil {
+			return
+		}
+		enabledDir, availableDir = nginxSitesEnabledDir, nginxSitesAvailableDir
+		render = renderNginxServer
+	}
+	os.Remove(filepath.Join(enabledDir, domainName+".conf"))
+	os.Remove(filepath.Join(availableDir, domainName+".conf"))
+	dir := enabledDir
+	if !IsVirtualHostEnabled(domainName) {
+		if !VirtualHostExists(domainName) {
+			return
+		}
+		dir = availableDir
+	}
+	spec, err := newVHostSpec(domainName, vhostHasCert(domainName) && !frontProxyEnabled())
+	if err == nil && spec.SSL && activeWebServer() == webServerNginx {
+		err = activateSSLListener()
+	}
+	if err == nil {
+		err = os.MkdirAll(dir, os.ModePerm)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, domainName+".conf"), []byte(render(spec)), 0644)
+	}
+	if err != nil {
+		fmt.Printf("%sCould not update the inactive web server's copy of %s: %v%s\n", shared.ColorYellow, domainName, err, shared.ColorReset)
+	}
+}
+
+func snapshotWebServerConfig() (*configSnapshot, error) {
+	dir := apacheConfigDir
+	if activeWebServer() == webServerNginx {
+		if err := ensureNginxConfig(); err != nil {
+			return nil, err
+		}
+		dir = nginxConfigDir
+	}
+	snap := &configSnapshot{dir: dir, files: make(map[string][]byte)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		snap.files[path] = content
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not snapshot %s config: %w", WebServerName(), err)
+	}
+	return snap, nil
+}
+
+func (s *configSnapshot) restore() error {
+	// Files created after the snapshot are removed, everything else is put back.
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if _, ok := s.files[path]; !ok {
+				return os.Remove(path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for path, content := range s.files {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testWebServerConfig() error {
+	if activeWebServer() == webServerNginx {
+		return testNginxConfig()
+	}
+	return testApacheConfig()
+}
+
+// commitWebServerConfig checks the configuration written since snap was taken.
+// If the web server rejects it, the snapshot is restored and the error is reported.
+func commitWebServerConfig(snap *configSnapshot) bool {
+	name := WebServerName()
+	fmt.Printf("%sTesting %s configuration...%s\n", shared.ColorYellow, name, shared.ColorReset)
+	err := testWebServerConfig()
+	if err == nil {
+		return true
+	}
+	fmt.Printf("%s%s rejected the new configuration: %v%s\n", shared.ColorRed, name, err, shared.ColorReset)
+	if snap == nil {
+		return false
+	}
+	if restoreErr := snap.restore(); restoreErr != nil {
+		fmt.Printf("%sCould not restore the previous configuration: %v%s\n", shared.ColorRed, restoreErr, shared.ColorReset)
+		return false
+	}
+	fmt.Printf("%sThe previous configuration has been restored. %s was not restarted.%s\n", shared.ColorYellow, name, shared.ColorReset)
+	return false
+}
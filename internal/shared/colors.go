@@ -6,4 +6,5 @@ const (
 	ColorGreen  = "\033[32m"
 	ColorYellow = "\033[33m"
 	ColorWhite  = "\033[97m"
+	ColorGray   = "\033[90m"
 )
@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"unicode/utf16"
+)
+
+// A minimal PKCS#12 (RFC 7292) encoder for client certificate bundles. The
+// key is shrouded with pbeWithSHAAnd3-KeyTripleDES-CBC and the file is
+// MACed with HMAC-SHA1, the combination every browser, Windows and phone
+// still imports. Certificates are stored unencrypted, like openssl's
+// -certpbe NONE.
+
+const pkcs12Iterations = 2048
+
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHA3KeyDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+// encoding/asn1 ignores struct tags on RawValue fields, so the [0] EXPLICIT
+// wrappers and attribute SETs are built by hand with asn1Wrap.
+
+type p12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type p12Algorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type p12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type p12EncryptedKey struct {
+	Algorithm p12Algorithm
+	Data      []byte
+}
+
+type p12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type p12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []p12Attribute `asn1:"set,optional"`
+}
+
+type p12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type p12DigestInfo struct {
+	Algorithm p12Algorithm
+	Digest    []byte
+}
+
+type p12MacData struct {
+	Mac        p12DigestInfo
+	Salt       []byte
+	Iterations int
+}
+
+type p12PFX struct {
+	Version  int
+	AuthSafe p12ContentInfo
+	MacData  p12MacData
+}
+
+// EncodePKCS12 bundles key, its certificate and the chain above it into a
+// password-protected .p12 file. friendlyName is the label browsers show.
+func EncodePKCS12(key any, cert *x509.Certificate, chain []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	if password == "" {
+		return nil, errors.New("a PKCS#12 bundle needs a password")
+	}
+	pass := bmpPassword(password)
+	keyID := sha1.Sum(cert.Raw)
+	attrs, err := p12Attributes(keyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []p12SafeBag
+	for i, c := range append([]*x509.Certificate{cert}, chain...) {
+		bag, err := asn1.Marshal(p12CertBag{ID: oidX509Certificate, Data: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+		safeBag := p12SafeBag{ID: oidCertBag, Value: asn1Wrap(asn1.ClassContextSpecific, 0, bag)}
+		if i == 0 {
+			safeBag.Attributes = attrs
+		}
+		certBags = append(certBags, safeBag)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	shrouded, err := p12ShroudKey(keyDER, pass)
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []p12SafeBag{{ID: oidShroudedKeyBag, Value: asn1Wrap(asn1.ClassContextSpecific, 0, shrouded), Attributes: attrs}}
+
+	var authSafe []p12ContentInfo
+	for _, bags := range [][]p12SafeBag{certBags, keyBags} {
+		info, err := p12DataContent(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, info)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	content, err := asn1.Marshal(authSafeDER)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 8)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(pass, macSalt, 3, pkcs12Iterations, 20))
+	mac.Write(authSafeDER)
+	return asn1.Marshal(p12PFX{
+		Version:  3,
+		AuthSafe: p12ContentInfo{ContentType: oidData, Content: asn1Wrap(asn1.ClassContextSpecific, 0, content)},
+		MacData: p12MacData{
+			Mac:        p12DigestInfo{Algorithm: p12Algorithm{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, Digest: mac.Sum(nil)},
+			Salt:       macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+func p12Attributes(keyID []byte, friendlyName string) ([]p12Attribute, error) {
+	idValue, err := asn1.Marshal(keyID)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []p12Attribute{{ID: oidLocalKeyID, Values: asn1Wrap(asn1.ClassUniversal, asn1.TagSet, idValue)}}
+	if friendlyName != "" {
+		name := asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(friendlyName)}
+		nameValue, err := asn1.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, p12Attribute{ID: oidFriendlyName, Values: asn1Wrap(asn1.ClassUniversal, asn1.TagSet, nameValue)})
+	}
+	return attrs, nil
+}
+
+func asn1Wrap(class, tag int, inner []byte) asn1.RawValue {
+	return asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: inner}
+}
+
+// p12DataContent wraps safe bags in an unencrypted data ContentInfo.
+func p12DataContent(bags []p12SafeBag) (p12ContentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return p12ContentInfo{}, err
+	}
+	octets, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return p12ContentInfo{}, err
+	}
+	return p12ContentInfo{ContentType: oidData, Content: asn1Wrap(asn1.ClassContextSpecific, 0, octets)}, nil
+}
+
+func p12ShroudKey(keyDER, pass []byte) ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pkcs12KDF(pass, salt, 1, pkcs12Iterations, 24))
+	if err != nil {
+		return nil, err
+	}
+	iv := pkcs12KDF(pass, salt, 2, pkcs12Iterations, block.BlockSize())
+	padding := block.BlockSize() - len(keyDER)%block.BlockSize()
+	encrypted := append([]byte{}, keyDER...)
+	for i := 0; i < padding; i++ {
+		encrypted = append(encrypted, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(p12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(p12EncryptedKey{
+		Algorithm: p12Algorithm{Algorithm: oidPBEWithSHA3KeyDES, Parameters: asn1.RawValue{FullBytes: params}},
+		Data:      encrypted,
+	})
+}
+
+// bmpPassword is the password as PKCS#12 wants it: UTF-16BE with a
+// terminating NUL.
+func bmpPassword(password string) []byte {
+	return append(bmpString(password), 0, 0)
+}
+
+func bmpString(s string) []byte {
+	var out []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return out
+}
+
+// pkcs12KDF derives size bytes of key (id 1), IV (id 2) or MAC key (id 3)
+// material with SHA-1, as in RFC 7292 appendix B.2.
+func pkcs12KDF(pass, salt []byte, id byte, iterations, size int) []byte {
+	const v = 64
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(src)+v-1)/v))
+		for i := range out {
+			out[i] = src[i%len(src)]
+		}
+		return out
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	input := append(fill(salt), fill(pass)...)
+
+	var out []byte
+	one := big.NewInt(1)
+	modulus := new(big.Int).Lsh(one, v*8)
+	for len(out) < size {
+		sum := sha1.Sum(append(append([]byte{}, d...), input...))
+		a := sum[:]
+		for i := 1; i < iterations; i++ {
+			sum = sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(input); j += v {
+			chunk := new(big.Int).SetBytes(input[j : j+v])
+			chunk.Add(chunk, b).Mod(chunk, modulus)
+			chunk.FillBytes(input[j : j+v])
+		}
+	}
+	return out[:size]
+}
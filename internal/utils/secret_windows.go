@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ProtectData encrypts data with DPAPI for the current Windows user, so only
+// that account on this machine can decrypt it.
+func ProtectData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("nothing to protect")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	return copyAndFreeBlob(out), nil
+}
+
+func UnprotectData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("nothing to unprotect")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	return copyAndFreeBlob(out), nil
+}
+
+func copyAndFreeBlob(blob windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	return append([]byte{}, unsafe.Slice(blob.Data, blob.Size)...)
+}
+
+// ReadPassword prints prompt and reads a line from the console without
+// echoing it.
+func ReadPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	handle := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err == nil {
+		windows.SetConsoleMode(handle, mode&^windows.ENABLE_ECHO_INPUT)
+		defer windows.SetConsoleMode(handle, mode)
+	}
+	// Read a byte at a time so nothing past the newline is swallowed from
+	// readers that share stdin.
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			if buf[0] != '\r' {
+				line = append(line, buf[0])
+			}
+		}
+		if err != nil {
+			if len(line) > 0 {
+				break
+			}
+			fmt.Println()
+			return "", err
+		}
+	}
+	fmt.Println()
+	return string(line), nil
+}